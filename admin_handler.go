@@ -1,12 +1,15 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -14,6 +17,8 @@ import (
 // AdminHandler handles requests for the admin web interface.
 type AdminHandler struct {
 	hooks *HookStore
+	queue *Queue
+	db    *DB
 }
 
 // Index renders the main page that shows a list of hooks.
@@ -24,20 +29,107 @@ func (h AdminHandler) Index(w http.ResponseWriter, r *http.Request, _ httprouter
 		http.Error(w, "error", http.StatusInternalServerError)
 		return
 	}
-	render(w, hooks, "hooks/index")
+	render(w, r, hooks, "hooks/index")
+}
+
+// Export responds with the configuration of all hooks in the format of the
+// -config file. It includes component secrets and is only available to admins.
+func (h AdminHandler) Export(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !currentUser(r).IsAdmin() {
+		forbidden(w, r)
+		return
+	}
+
+	c, err := h.hooks.Export()
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="rehook.json"`)
+	writeJSON(w, http.StatusOK, c)
+}
+
+// Database renders the database maintenance page.
+func (h AdminHandler) Database(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !currentUser(r).IsAdmin() {
+		forbidden(w, r)
+		return
+	}
+	stats, err := h.db.Stats()
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		Size, Free string
+		Msg, Err   string
+	}{formatSize(stats.Size), formatSize(stats.Free), r.URL.Query().Get("msg"), r.URL.Query().Get("err")}
+	render(w, r, data, "database/index")
+}
+
+// CompactDatabase removes expired component data and compacts the database
+// file. Requests wait until it has finished.
+func (h AdminHandler) CompactDatabase(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !currentUser(r).IsAdmin() {
+		forbidden(w, r)
+		return
+	}
+
+	n, err := h.hooks.Expire(time.Now())
+	if err != nil {
+		log.Printf("error removing expired data: %s", err)
+		http.Redirect(w, r, "/database?err="+url.QueryEscape(err.Error()), http.StatusSeeOther)
+		return
+	}
+	start := time.Now()
+	before, after, err := h.db.Compact()
+	if err != nil {
+		log.Printf("error compacting database: %s", err)
+		http.Redirect(w, r, "/database?err="+url.QueryEscape(err.Error()), http.StatusSeeOther)
+		return
+	}
+	log.Printf("Compacted database from %d to %d bytes in %s", before.Size, after.Size, time.Since(start))
+
+	msg := fmt.Sprintf("Removed %d expired entries, the database was compacted from %s to %s.", n, formatSize(before.Size), formatSize(after.Size))
+	http.Redirect(w, r, "/database?msg="+url.QueryEscape(msg), http.StatusSeeOther)
+}
+
+// formatSize returns n bytes in a human readable form.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d bytes", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
 }
 
 // NewHook renders the new hook form.
 func (h AdminHandler) NewHook(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !currentUser(r).IsAdmin() {
+		forbidden(w, r)
+		return
+	}
 	data := struct {
 		ID  string
 		Err string
 	}{r.URL.Query().Get("id"), r.URL.Query().Get("err")}
-	render(w, data, "hooks/new")
+	render(w, r, data, "hooks/new")
 }
 
 // CreateHook handles POST requests from the new hook form.
 func (h AdminHandler) CreateHook(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !currentUser(r).IsAdmin() {
+		forbidden(w, r)
+		return
+	}
+
 	id := r.FormValue("id")
 	hook := Hook{ID: id}
 	if err := h.hooks.Create(hook); err != nil {
@@ -49,6 +141,52 @@ func (h AdminHandler) CreateHook(w http.ResponseWriter, r *http.Request, _ httpr
 	http.Redirect(w, r, fmt.Sprintf("/hooks/edit/%s", hook.ID), http.StatusSeeOther)
 }
 
+// CopyHookForm renders the form to clone or rename a hook.
+func (h AdminHandler) CopyHookForm(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if !currentUser(r).IsAdmin() {
+		forbidden(w, r)
+		return
+	}
+	hook, err := h.hooks.Find(p.ByName("id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	data := struct {
+		Hook *Hook
+		ID   string
+		Err  string
+	}{hook, r.URL.Query().Get("id"), r.URL.Query().Get("err")}
+	render(w, r, data, "hooks/copy")
+}
+
+// CopyHook handles POST requests from the clone or rename form.
+func (h AdminHandler) CopyHook(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if !currentUser(r).IsAdmin() {
+		forbidden(w, r)
+		return
+	}
+
+	id, newID := p.ByName("id"), r.FormValue("id")
+	var err error
+	switch r.FormValue("action") {
+	case "clone":
+		err = h.hooks.Clone(id, newID, r.FormValue("stats") != "")
+	case "rename":
+		err = h.hooks.Rename(id, newID)
+		// deliveries of the hook may have been skipped while it was renamed
+		h.queue.notify()
+	default:
+		err = errors.New("unknown action")
+	}
+	if err != nil {
+		log.Printf("error copying hook %s: %s", id, err)
+		http.Redirect(w, r, fmt.Sprintf("/hooks/edit/%s/copy?id=%s&err=%s", id, url.QueryEscape(newID), url.QueryEscape(err.Error())), http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/hooks/edit/%s", newID), http.StatusSeeOther)
+}
+
 // EditHook renders the edit hook form
 func (h AdminHandler) EditHook(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	hook, err := h.hooks.Find(p.ByName("id"))
@@ -58,28 +196,143 @@ func (h AdminHandler) EditHook(w http.ResponseWriter, r *http.Request, p httprou
 		return
 	}
 
+	dls, err := h.queue.DeadLetters(hook.ID)
+	if err != nil {
+		log.Printf("error loading dead letters: %s", err)
+	}
+	pending, err := h.queue.Pending(hook.ID)
+	if err != nil {
+		log.Printf("error counting queued deliveries: %s", err)
+	}
+	if hook.Count, err = h.hooks.RequestCount(hook.ID); err != nil {
+		log.Printf("error loading request count: %s", err)
+	}
+	counts, err := h.hooks.ComponentCounts(*hook)
+	if err != nil {
+		log.Printf("error loading component counts: %s", err)
+	}
+
 	data := struct {
-		Hook       *Hook
-		Components map[string]Component
-	}{hook, components}
+		Hook            *Hook
+		Components      map[string]Component
+		ComponentCounts map[string]ComponentCount
+		DeadLetters     int
+		Pending         int
+		MaxBody         int64
+		DisabledStatus  int
+	}{hook, components, counts, len(dls), pending, *maxBody, DefaultDisabledStatus}
 
-	render(w, data, "hooks/edit")
+	render(w, r, data, "hooks/edit")
 }
 
 // UpdateHook handles POST requests from the edit page.
 func (h AdminHandler) UpdateHook(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	if r.FormValue("action") == "delete" {
-		if err := h.hooks.Delete(p.ByName("id")); err != nil {
+	switch r.FormValue("action") {
+	case "delete":
+		if !currentUser(r).IsAdmin() {
+			forbidden(w, r)
+			return
+		}
+		if err := h.hooks.Delete(p.ByName("id"), r.FormValue("keep-stats") != ""); err != nil {
 			http.NotFound(w, r)
 			return
 		}
 		http.Redirect(w, r, "/", http.StatusSeeOther)
-		return
+	case "settings":
+		hook, err := h.hooks.Find(p.ByName("id"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if !currentUser(r).CanEdit(hook.ID) {
+			forbidden(w, r)
+			return
+		}
+		settings, err := parseSettings(r, hook.Settings)
+		if err == nil {
+			err = h.hooks.UpdateSettings(hook.ID, settings)
+		}
+		if err != nil {
+			// TODO: show flash message
+			log.Printf("error updating settings: %s", err)
+		}
+		http.Redirect(w, r, fmt.Sprintf("/hooks/edit/%s", hook.ID), http.StatusSeeOther)
+	case "state":
+		hook, err := h.hooks.Find(p.ByName("id"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if !currentUser(r).CanEdit(hook.ID) {
+			forbidden(w, r)
+			return
+		}
+		if err := h.hooks.SetState(hook.ID, State(r.FormValue("state"))); err != nil {
+			log.Printf("error changing state: %s", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// deliveries may have been waiting for the hook to become active
+		h.queue.notify()
+		http.Redirect(w, r, fmt.Sprintf("/hooks/edit/%s", hook.ID), http.StatusSeeOther)
+	case "reorder":
+		hook, err := h.hooks.Find(p.ByName("id"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if !currentUser(r).CanReorder(hook) {
+			forbidden(w, r)
+			return
+		}
+		r.ParseForm()
+		if err := h.hooks.ReorderComponents(hook.ID, r.Form["order"]); err != nil {
+			log.Printf("error reordering components: %s", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/hooks/edit/%s", hook.ID), http.StatusSeeOther)
 	}
 }
 
-// AddComponent renders the component configuration screen, if it has one, or
-// directly redirects to h.CreateComponent.
+// parseSettings returns settings s updated with the values from the settings
+// form in r.
+func parseSettings(r *http.Request, s Settings) (Settings, error) {
+	var err error
+	if v := strings.TrimSpace(r.FormValue("retention-count")); v == "" {
+		s.Retention.Count = 0
+	} else if s.Retention.Count, err = strconv.Atoi(v); err != nil || s.Retention.Count < 0 {
+		return s, errors.New("history count must be a positive number")
+	}
+	if v := strings.TrimSpace(r.FormValue("retention-age")); v == "" {
+		s.Retention.Age = 0
+	} else if s.Retention.Age, err = time.ParseDuration(v); err != nil || s.Retention.Age < 0 {
+		return s, errors.New("history age must be a positive duration")
+	}
+
+	s.Sync = r.FormValue("sync") != ""
+	if v := strings.TrimSpace(r.FormValue("sync-timeout")); v == "" {
+		s.SyncTimeout = 0
+	} else if s.SyncTimeout, err = time.ParseDuration(v); err != nil || s.SyncTimeout < 0 {
+		return s, errors.New("timeout must be a positive duration")
+	}
+
+	if v := strings.TrimSpace(r.FormValue("max-body")); v == "" {
+		s.MaxBodySize = 0
+	} else if s.MaxBodySize, err = strconv.ParseInt(v, 10, 64); err != nil || s.MaxBodySize < 0 {
+		return s, errors.New("maximum body size must be a positive number")
+	}
+
+	if v := strings.TrimSpace(r.FormValue("disabled-status")); v == "" {
+		s.DisabledStatus = 0
+	} else if s.DisabledStatus, err = strconv.Atoi(v); err != nil || s.DisabledStatus < 200 || s.DisabledStatus > 599 {
+		return s, errors.New("response status must be between 200 and 599")
+	}
+	return s, nil
+}
+
+// AddComponent renders the component configuration screen. Components without
+// configuration only show their retry policy.
 func (h AdminHandler) AddComponent(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	hook, err := h.hooks.Find(p.ByName("id"))
 	if err != nil {
@@ -93,20 +346,25 @@ func (h AdminHandler) AddComponent(w http.ResponseWriter, r *http.Request, p htt
 		http.NotFound(w, r)
 		return
 	}
-
-	tpl := c.Template()
-	if tpl == "" {
-		h.CreateComponent(w, r, p)
+	if !currentUser(r).CanConfigure(hook.ID, id) {
+		forbidden(w, r)
 		return
 	}
+
 	data := struct {
 		ID     string
 		Hook   *Hook
 		CID    string
 		Name   string
 		Params map[string]string
-	}{"", hook, id, c.Name(), map[string]string{"interval": ""}}
-	render(w, data, "components/component", "components/"+tpl)
+		Retry  RetryPolicy
+	}{"", hook, id, c.Name(), map[string]string{"interval": ""}, RetryPolicy{}}
+
+	names := []string{"components/component"}
+	if c.Template() != "" {
+		names = append(names, "components/"+c.Template())
+	}
+	render(w, r, data, names...)
 }
 
 // CreateComponent adds a new instance of the selected component to the current
@@ -118,9 +376,22 @@ func (h AdminHandler) CreateComponent(w http.ResponseWriter, r *http.Request, p
 		return
 	}
 
+	if !currentUser(r).CanConfigure(hook.ID, r.FormValue("c")) {
+		forbidden(w, r)
+		return
+	}
+
 	params := filterParams(r)
+	retry, err := parseRetryPolicy(r)
+	if err != nil {
+		// TODO: show flash message
+		log.Printf("could not create component: %s", err)
+		http.Redirect(w, r, fmt.Sprintf("/hooks/edit/%s", hook.ID), http.StatusSeeOther)
+		return
+	}
 
-	if err := h.hooks.AddComponent(*hook, r.FormValue("c"), params); err != nil {
+	hc := HookComponent{Name: r.FormValue("c"), Retry: retry}
+	if _, err := h.hooks.AddComponent(*hook, hc, params); err != nil {
 		// TODO: show flash message
 		log.Printf("could not create component: %s", err)
 	}
@@ -146,23 +417,24 @@ func (h AdminHandler) EditComponent(w http.ResponseWriter, r *http.Request, p ht
 		return
 	}
 
-	var cid string
-	var c Component
-	id := p.ByName("c")
-	for _, hc := range hook.Components {
-		if hc.ID == id {
-			cid = hc.Name
-			c = components[hc.Name]
-			break
-		}
+	i := hook.component(p.ByName("c"))
+	if i < 0 {
+		http.Redirect(w, r, fmt.Sprintf("/hooks/edit/%s", hook.ID), http.StatusSeeOther)
+		return
 	}
+	hc := hook.Components[i]
 
-	if c == nil || c.Template() == "" {
+	c, ok := components[hc.Name]
+	if !ok {
 		http.Redirect(w, r, fmt.Sprintf("/hooks/edit/%s", hook.ID), http.StatusSeeOther)
 		return
 	}
+	if !currentUser(r).CanConfigure(hook.ID, hc.Name) {
+		forbidden(w, r)
+		return
+	}
 
-	params, err := h.hooks.ComponentParams(*hook, cid)
+	params, err := h.hooks.ComponentParams(*hook, hc)
 	if err != nil {
 		log.Printf("error: %s", err)
 		http.Redirect(w, r, fmt.Sprintf("/hooks/edit/%s", hook.ID), http.StatusSeeOther)
@@ -175,8 +447,15 @@ func (h AdminHandler) EditComponent(w http.ResponseWriter, r *http.Request, p ht
 		CID    string
 		Name   string
 		Params map[string]string
-	}{id, hook, id, c.Name(), params}
-	render(w, data, "components/component", "components/"+c.Template())
+		Retry  RetryPolicy
+	}{hc.ID, hook, hc.ID, c.Name(), params, hc.Retry}
+
+	// components without configuration only have their retry policy
+	names := []string{"components/component"}
+	if c.Template() != "" {
+		names = append(names, "components/"+c.Template())
+	}
+	render(w, r, data, names...)
 }
 
 // UpdateComponent handles updates to a component instance. This includes
@@ -191,18 +470,41 @@ func (h AdminHandler) UpdateComponent(w http.ResponseWriter, r *http.Request, p
 	id := r.FormValue("c")
 	action := r.FormValue("action")
 
+	// editors may remove privileged components, but not change them
+	u := currentUser(r)
+	allowed := u.CanEdit(hook.ID)
+	switch i := hook.component(id); {
+	case action == "move-up" || action == "move-down":
+		allowed = u.CanReorder(hook)
+	case i >= 0 && action != "delete":
+		allowed = u.CanConfigure(hook.ID, hook.Components[i].Name)
+	}
+	if !allowed {
+		forbidden(w, r)
+		return
+	}
+
 	switch action {
 	case "delete":
 		if err := h.hooks.DeleteComponent(*hook, id); err != nil {
 			log.Printf("error deleting component: %s", err)
 		}
 	case "move-up":
-		// TODO: implement this
+		if err := h.hooks.MoveComponent(hook.ID, id, -1); err != nil {
+			log.Printf("error moving component: %s", err)
+		}
 	case "move-down":
-		// TODO: implement this
+		if err := h.hooks.MoveComponent(hook.ID, id, 1); err != nil {
+			log.Printf("error moving component: %s", err)
+		}
 	default:
 		params := filterParams(r)
-		if err := h.hooks.UpdateComponent(*hook, id, params); err != nil {
+		retry, err := parseRetryPolicy(r)
+		if err != nil {
+			log.Printf("error updating component: %s", err)
+			break
+		}
+		if err := h.hooks.UpdateComponent(*hook, HookComponent{ID: id, Retry: retry}, params); err != nil {
 			log.Printf("error updating component: %s", err)
 		}
 	}
@@ -210,12 +512,157 @@ func (h AdminHandler) UpdateComponent(w http.ResponseWriter, r *http.Request, p
 	http.Redirect(w, r, fmt.Sprintf("/hooks/edit/%s", hook.ID), http.StatusSeeOther)
 }
 
-func render(w http.ResponseWriter, data interface{}, names ...string) {
+// DeadLetters renders the list of requests that failed to be processed.
+func (h AdminHandler) DeadLetters(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	hook, err := h.hooks.Find(p.ByName("id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	dls, err := h.queue.DeadLetters(hook.ID)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Hook        *Hook
+		Components  map[string]Component
+		DeadLetters []DeadLetter
+	}{hook, components, dls}
+	render(w, r, data, "hooks/failed")
+}
+
+// DeadLetter renders the details of a single failed request.
+func (h AdminHandler) DeadLetter(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	hook, err := h.hooks.Find(p.ByName("id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	id, err := strconv.ParseUint(p.ByName("d"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	dl, err := h.queue.DeadLetter(hook.ID, id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	data := struct {
+		Hook       *Hook
+		Components map[string]Component
+		DeadLetter *DeadLetter
+	}{hook, components, dl}
+	render(w, r, data, "hooks/dead-letter")
+}
+
+// UpdateDeadLetter handles POST requests to delete or re-submit a failed
+// request.
+func (h AdminHandler) UpdateDeadLetter(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	hook, err := h.hooks.Find(p.ByName("id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if !currentUser(r).CanEdit(hook.ID) {
+		forbidden(w, r)
+		return
+	}
+
+	id, err := strconv.ParseUint(p.ByName("d"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "delete":
+		err = h.queue.DeleteDeadLetter(hook.ID, id)
+	case "retry":
+		err = h.queue.Redrive(hook.ID, id, false)
+	case "resume":
+		err = h.queue.Redrive(hook.ID, id, true)
+	default:
+		err = fmt.Errorf("unknown action %q", r.FormValue("action"))
+	}
+	if err != nil {
+		// TODO: show flash message
+		log.Printf("error updating dead letter %d: %s", id, err)
+	}
+	http.Redirect(w, r, fmt.Sprintf("/hooks/edit/%s/failed", hook.ID), http.StatusSeeOther)
+}
+
+// History renders the most recent deliveries of a hook.
+func (h AdminHandler) History(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	hook, err := h.hooks.Find(p.ByName("id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	records, err := h.queue.History(hook.ID, 100)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Hook    *Hook
+		Records []Record
+	}{hook, records}
+	render(w, r, data, "hooks/history")
+}
+
+// Delivery renders the details and execution trace of a single delivery.
+func (h AdminHandler) Delivery(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	hook, err := h.hooks.Find(p.ByName("id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	id, err := strconv.ParseUint(p.ByName("d"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	record, err := h.queue.Record(hook.ID, id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	data := struct {
+		Hook       *Hook
+		Components map[string]Component
+		Record     *Record
+	}{hook, components, record}
+	render(w, r, data, "hooks/delivery")
+}
+
+func render(w http.ResponseWriter, r *http.Request, data interface{}, names ...string) {
 	files := append([]string{"layout"}, names...)
 	for i := range files {
 		files[i] = fmt.Sprintf("views/%s.html", files[i])
 	}
-	t, err := template.New("layout").ParseFiles(files...)
+	funcs := template.FuncMap{
+		"user": func() *User { return currentUser(r) },
+		"csrf": func() template.HTML {
+			return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`, CSRFField, template.HTMLEscapeString(csrfToken(r))))
+		},
+		"latencyLabels": latencyLabels,
+	}
+	t, err := template.New("layout").Funcs(funcs).ParseFiles(files...)
 	if err != nil {
 		log.Printf("error loading template %v: %s", names, err)
 		http.Error(w, "error", http.StatusInternalServerError)
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func init() {
+	RegisterComponent("test-privileged-action", testPrivilegedAction{})
+}
+
+// testPrivilegedAction is a test action that only admins may configure.
+type testPrivilegedAction struct{ testAction }
+
+func (testPrivilegedAction) Privileged() bool { return true }
+
+func TestComponentOrderPermissions(t *testing.T) {
+	admin := &User{Name: "admin", Role: RoleAdmin}
+	editor := &User{Name: "editor", Role: RoleEditor, Hooks: []string{"hook"}}
+	viewer := &User{Name: "viewer", Role: RoleViewer}
+
+	tests := []struct {
+		user       *User
+		privileged bool
+		action     string
+		status     int
+	}{
+		{admin, true, "move-up", http.StatusSeeOther},
+		{admin, true, "reorder", http.StatusSeeOther},
+		{editor, false, "move-up", http.StatusSeeOther},
+		{editor, false, "move-down", http.StatusSeeOther},
+		{editor, false, "reorder", http.StatusSeeOther},
+		{editor, true, "move-up", http.StatusForbidden},
+		{editor, true, "move-down", http.StatusForbidden},
+		{editor, true, "reorder", http.StatusForbidden},
+		{editor, true, "delete", http.StatusSeeOther},
+		{viewer, false, "move-up", http.StatusForbidden},
+		{viewer, false, "reorder", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		db := testDB(t)
+		s := &HookStore{db}
+		ah := AdminHandler{s, NewQueue(db), db}
+		router := httprouter.New()
+		router.POST("/hooks/edit/:id", ah.UpdateHook)
+		router.POST("/hooks/edit/:id/update/:c", ah.UpdateComponent)
+
+		// the component that is moved is never privileged itself
+		h, ids := testHook(t, s, "hook", "a")
+		name := "test-action"
+		if tt.privileged {
+			name = "test-privileged-action"
+		}
+		pid, err := s.AddComponent(*h, HookComponent{Name: name}, map[string]string{"name": "p"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		form := url.Values{"action": {tt.action}, "c": {ids["a"]}}
+		path := "/hooks/edit/hook/update/" + ids["a"]
+		if tt.action == "reorder" {
+			form = url.Values{"action": {tt.action}, "order": {pid, ids["a"]}}
+			path = "/hooks/edit/hook"
+		}
+		r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r = r.WithContext(context.WithValue(r.Context(), userKey, tt.user))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Code != tt.status {
+			t.Errorf("%s %s with privileged component %t: status %d, want %d", tt.user.Role, tt.action, tt.privileged, w.Code, tt.status)
+		}
+	}
+}
+
+func TestCreateComponentPermissions(t *testing.T) {
+	admin := &User{Name: "admin", Role: RoleAdmin}
+	editor := &User{Name: "editor", Role: RoleEditor, Hooks: []string{"hook"}}
+	other := &User{Name: "other", Role: RoleEditor, Hooks: []string{"other"}}
+	viewer := &User{Name: "viewer", Role: RoleViewer}
+
+	tests := []struct {
+		user      *User
+		component string
+		status    int
+	}{
+		{admin, "test-action", http.StatusSeeOther},
+		{admin, "test-privileged-action", http.StatusSeeOther},
+		{editor, "test-action", http.StatusSeeOther},
+		{editor, "test-privileged-action", http.StatusForbidden},
+		{other, "test-action", http.StatusForbidden},
+		{viewer, "test-action", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		db, s, q := testStores(t)
+		ah := AdminHandler{s, q, db}
+		testHook(t, s, "hook")
+
+		form := url.Values{"c": {tt.component}, "param-name": {"a"}}
+		r := httptest.NewRequest("POST", "/hooks/edit/hook/create", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r = r.WithContext(context.WithValue(r.Context(), userKey, tt.user))
+		w := httptest.NewRecorder()
+		ah.CreateComponent(w, r, httprouter.Params{{Key: "id", Value: "hook"}})
+
+		if w.Code != tt.status {
+			t.Errorf("%s adds %s: status %d, want %d", tt.user.Name, tt.component, w.Code, tt.status)
+		}
+		h, err := s.Find("hook")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if added := len(h.Components) == 1; added != (tt.status == http.StatusSeeOther) {
+			t.Errorf("%s adds %s: %d components", tt.user.Name, tt.component, len(h.Components))
+		}
+	}
+}
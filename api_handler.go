@@ -0,0 +1,455 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// APIHandler handles requests for the JSON API. Requests are authenticated
+// with API tokens by AuthHandler.Require and are subject to the same
+// permissions as the admin interface.
+type APIHandler struct {
+	hooks *HookStore
+	queue *Queue
+}
+
+// apiHook is the JSON representation of a hook.
+type apiHook struct {
+	ID         string         `json:"id"`
+	Stats      *apiStats      `json:"stats,omitempty"`
+	Components []apiComponent `json:"components,omitempty"`
+}
+
+// apiStats is the JSON representation of the request counts of a hook.
+type apiStats struct {
+	Recent    []int      `json:"recent"`
+	Daily     []int      `json:"daily"`
+	Monthly   []int      `json:"monthly"`
+	Total     int        `json:"total"`
+	Succeeded int        `json:"succeeded"`
+	Filtered  int        `json:"filtered"`
+	Failed    int        `json:"failed"`
+	Rejected  int        `json:"rejected"`
+	Latency   apiLatency `json:"latency"`
+}
+
+// apiLatency is the JSON representation of a latency histogram. Bounds are the
+// upper bounds of the buckets in seconds, the last count has no upper bound.
+type apiLatency struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []int     `json:"counts"`
+	Sum    float64   `json:"sum"`
+}
+
+// apiComponent is the JSON representation of a component instance. Params are
+// only included for users that may configure the component.
+type apiComponent struct {
+	ID     string            `json:"id,omitempty"`
+	Name   string            `json:"name"`
+	Retry  *retryConfig      `json:"retry,omitempty"`
+	Params map[string]string `json:"params,omitempty"`
+}
+
+// apiComponentType describes a component that can be added to hooks.
+type apiComponentType struct {
+	Name       string   `json:"name"`
+	Title      string   `json:"title"`
+	Params     []string `json:"params"`
+	Privileged bool     `json:"privileged"`
+}
+
+// apiDelivery is the JSON representation of a queued delivery.
+type apiDelivery struct {
+	ID   uint64 `json:"id"`
+	Hook string `json:"hook"`
+}
+
+// apiError is the JSON response for failed requests.
+type apiError struct {
+	Error  string       `json:"error"`
+	Errors []ParamError `json:"errors,omitempty"`
+}
+
+// MarshalJSON encodes a parameter validation error.
+func (e ParamError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Param   string `json:"param"`
+		Message string `json:"message"`
+	}{e.Param, e.Message})
+}
+
+func newAPIStats(c Count) *apiStats {
+	l := apiLatency{Counts: c.Latency.Counts, Sum: c.Latency.Sum.Seconds()}
+	for _, d := range LatencyBuckets {
+		l.Bounds = append(l.Bounds, d.Seconds())
+	}
+	return &apiStats{c.Recent, c.Daily, c.Monthly, c.Total, c.Succeeded, c.Filtered, c.Failed, c.Rejected, l}
+}
+
+// Hooks lists all hooks and their request counts.
+func (h *APIHandler) Hooks(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	hooks, err := h.hooks.List()
+	if err != nil {
+		h.internalError(w, err)
+		return
+	}
+
+	resp := make([]apiHook, 0, len(hooks))
+	for _, hook := range hooks {
+		resp = append(resp, apiHook{ID: hook.ID, Stats: newAPIStats(hook.Count)})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Hook returns a single hook and its components.
+func (h *APIHandler) Hook(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	hook, ok := h.findHook(w, p.ByName("id"))
+	if !ok {
+		return
+	}
+	resp, err := h.hook(r, hook)
+	if err != nil {
+		h.internalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// CreateHook creates a new hook.
+func (h *APIHandler) CreateHook(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !currentUser(r).IsAdmin() {
+		writeAPIError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	var req struct {
+		ID string `json:"id"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if err := h.hooks.Create(Hook{ID: req.ID}); err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, apiHook{ID: req.ID})
+}
+
+// DeleteHook deletes a hook and its data. The request counts are kept if the
+// keep_stats query parameter is true.
+func (h *APIHandler) DeleteHook(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if !currentUser(r).IsAdmin() {
+		writeAPIError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	hook, ok := h.findHook(w, p.ByName("id"))
+	if !ok {
+		return
+	}
+	keep, _ := strconv.ParseBool(r.URL.Query().Get("keep_stats"))
+	if err := h.hooks.Delete(hook.ID, keep); err != nil {
+		h.internalError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Stats returns the request counts of a hook.
+func (h *APIHandler) Stats(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	hook, ok := h.findHook(w, p.ByName("id"))
+	if !ok {
+		return
+	}
+	c, err := h.hooks.RequestCount(hook.ID)
+	if err != nil {
+		h.internalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIStats(c))
+}
+
+// Export returns the configuration of all hooks in the format of the -config
+// file.
+func (h *APIHandler) Export(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !currentUser(r).IsAdmin() {
+		writeAPIError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	c, err := h.hooks.Export()
+	if err != nil {
+		h.internalError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+// Components lists the components that can be added to hooks.
+func (h *APIHandler) Components(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	resp := make([]apiComponentType, 0, len(components))
+	for name, c := range components {
+		params := c.Parameters()
+		if params == nil {
+			params = []string{}
+		}
+		resp = append(resp, apiComponentType{name, c.Name(), params, isPrivileged(name)})
+	}
+	sort.Slice(resp, func(i, j int) bool { return resp[i].Name < resp[j].Name })
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// AddComponent appends a component to the chain of a hook.
+func (h *APIHandler) AddComponent(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	hook, ok := h.findHook(w, p.ByName("id"))
+	if !ok {
+		return
+	}
+
+	var req apiComponent
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if _, ok := components[req.Name]; !ok {
+		writeAPIError(w, http.StatusUnprocessableEntity, fmt.Sprintf("unknown component %q", req.Name))
+		return
+	}
+	if !currentUser(r).CanConfigure(hook.ID, req.Name) {
+		writeAPIError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	hc := HookComponent{Name: req.Name}
+	if req.Retry != nil {
+		var err error
+		if hc.Retry, err = req.Retry.policy(); err != nil {
+			writeAPIError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+	}
+	if !validParams(w, req.Name, req.Params) {
+		return
+	}
+
+	id, err := h.hooks.AddComponent(*hook, hc, req.Params)
+	if err != nil {
+		writeInitError(w, err)
+		return
+	}
+	h.writeComponent(w, r, hook.ID, id, http.StatusCreated)
+}
+
+// UpdateComponent reconfigures a component of a hook. The retry policy is
+// left unchanged if the request does not contain one.
+func (h *APIHandler) UpdateComponent(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	hook, ok := h.findHook(w, p.ByName("id"))
+	if !ok {
+		return
+	}
+	i := hook.component(p.ByName("c"))
+	if i < 0 {
+		writeAPIError(w, http.StatusNotFound, "component does not exist")
+		return
+	}
+	hc := hook.Components[i]
+	if !currentUser(r).CanConfigure(hook.ID, hc.Name) {
+		writeAPIError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	var req apiComponent
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Retry != nil {
+		var err error
+		if hc.Retry, err = req.Retry.policy(); err != nil {
+			writeAPIError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+	}
+	if !validParams(w, hc.Name, req.Params) {
+		return
+	}
+
+	if err := h.hooks.UpdateComponent(*hook, hc, req.Params); err != nil {
+		writeInitError(w, err)
+		return
+	}
+	h.writeComponent(w, r, hook.ID, hc.ID, http.StatusOK)
+}
+
+// DeleteComponent removes a component from the chain of a hook.
+func (h *APIHandler) DeleteComponent(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	hook, ok := h.findHook(w, p.ByName("id"))
+	if !ok {
+		return
+	}
+	if !currentUser(r).CanEdit(hook.ID) {
+		writeAPIError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+	if hook.component(p.ByName("c")) < 0 {
+		writeAPIError(w, http.StatusNotFound, "component does not exist")
+		return
+	}
+	if err := h.hooks.DeleteComponent(*hook, p.ByName("c")); err != nil {
+		h.internalError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ReorderComponents changes the processing order of the components of a hook.
+// The request contains the component identifiers in their new order.
+func (h *APIHandler) ReorderComponents(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	hook, ok := h.findHook(w, p.ByName("id"))
+	if !ok {
+		return
+	}
+	if !currentUser(r).CanReorder(hook) {
+		writeAPIError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	var req struct {
+		Order []string `json:"order"`
+	}
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if err := h.hooks.ReorderComponents(hook.ID, req.Order); err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	h.Hook(w, r, p)
+}
+
+// Replay queues the request of a previous delivery again and returns the new
+// delivery.
+func (h *APIHandler) Replay(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id, err := strconv.ParseUint(p.ByName("id"), 10, 64)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "delivery does not exist")
+		return
+	}
+	rec, err := h.queue.FindRecord(id)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if !currentUser(r).CanEdit(rec.Hook) {
+		writeAPIError(w, http.StatusForbidden, "forbidden")
+		return
+	}
+
+	d, err := h.queue.Replay(rec.Hook, rec.ID)
+	if err != nil {
+		writeAPIError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, apiDelivery{d.ID, d.Hook})
+}
+
+// hook returns the JSON representation of hook, as seen by the user of r.
+func (h *APIHandler) hook(r *http.Request, hook *Hook) (apiHook, error) {
+	resp := apiHook{ID: hook.ID, Components: make([]apiComponent, 0, len(hook.Components))}
+	for _, hc := range hook.Components {
+		c := apiComponent{ID: hc.ID, Name: hc.Name, Retry: newRetryConfig(hc.Retry)}
+		if currentUser(r).CanConfigure(hook.ID, hc.Name) {
+			params, err := h.hooks.ComponentParams(*hook, hc)
+			if err != nil {
+				return resp, err
+			}
+			c.Params = params
+		}
+		resp.Components = append(resp.Components, c)
+	}
+	return resp, nil
+}
+
+// writeComponent responds with the component identified by cid of the hook
+// with the given id.
+func (h *APIHandler) writeComponent(w http.ResponseWriter, r *http.Request, id, cid string, status int) {
+	hook, ok := h.findHook(w, id)
+	if !ok {
+		return
+	}
+	resp, err := h.hook(r, hook)
+	if err != nil {
+		h.internalError(w, err)
+		return
+	}
+	for _, c := range resp.Components {
+		if c.ID == cid {
+			writeJSON(w, status, c)
+			return
+		}
+	}
+	writeAPIError(w, http.StatusNotFound, "component does not exist")
+}
+
+// findHook returns the hook with the given id, or responds with an error if it
+// does not exist.
+func (h *APIHandler) findHook(w http.ResponseWriter, id string) (*Hook, bool) {
+	hook, err := h.hooks.Find(id)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, err.Error())
+		return nil, false
+	}
+	return hook, true
+}
+
+func (h *APIHandler) internalError(w http.ResponseWriter, err error) {
+	log.Printf("api error: %s", err)
+	writeAPIError(w, http.StatusInternalServerError, "internal error")
+}
+
+// validParams responds with a validation error if params contains parameters
+// the component registered as name does not accept.
+func validParams(w http.ResponseWriter, name string, params map[string]string) bool {
+	errs := unknownParams(name, params)
+	if len(errs) == 0 {
+		return true
+	}
+	writeJSON(w, http.StatusUnprocessableEntity, apiError{"invalid parameters", errs})
+	return false
+}
+
+// writeInitError responds with the error returned when initializing a
+// component.
+func writeInitError(w http.ResponseWriter, err error) {
+	resp := apiError{Error: err.Error()}
+	if pe, ok := err.(*ParamError); ok {
+		resp.Error = "invalid parameters"
+		resp.Errors = []ParamError{*pe}
+	}
+	writeJSON(w, http.StatusUnprocessableEntity, resp)
+}
+
+// readJSON decodes the request body into v, or responds with an error.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(v); err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %s", err))
+		return false
+	}
+	return true
+}
+
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, apiError{Error: msg})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		log.Printf("error writing response: %s", err)
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// SessionCookie is the name of the cookie containing the session token.
+	SessionCookie = "rehook_session"
+
+	// CSRFCookie is the name of the cookie containing the CSRF token of
+	// visitors that are not logged in yet.
+	CSRFCookie = "rehook_csrf"
+
+	// CSRFField is the name of the form field containing the CSRF token.
+	CSRFField = "csrf_token"
+)
+
+type contextKey int
+
+const (
+	userKey contextKey = iota
+	csrfKey
+)
+
+// AuthHandler handles logging in and out of the admin interface and the
+// management of users.
+type AuthHandler struct {
+	users *UserStore
+	hooks *HookStore
+}
+
+// Require wraps handler next so that it can only be accessed by logged in
+// users. Visitors are redirected to the login page, or to the setup page if no
+// users exist yet. Requests that change state must contain the CSRF token of
+// the session. API requests and requests for metrics are authenticated with an
+// API token instead. Health checks are available to everyone.
+func (h *AuthHandler) Require(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/public/") || r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if strings.HasPrefix(r.URL.Path, "/api/") || r.URL.Path == "/metrics" {
+			secret := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			u, err := h.users.TokenUser(secret)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="rehook"`)
+				writeAPIError(w, http.StatusUnauthorized, "valid API token required")
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey, u)))
+			return
+		}
+
+		if r.URL.Path == "/login" || r.URL.Path == "/setup" {
+			token, err := h.visitorToken(w, r)
+			if err != nil {
+				log.Printf("error creating CSRF token: %s", err)
+				http.Error(w, "error", http.StatusInternalServerError)
+				return
+			}
+			if !validCSRF(r, token) {
+				forbidden(w, r)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), csrfKey, token)))
+			return
+		}
+
+		if c, err := r.Cookie(SessionCookie); err == nil {
+			if s, u, err := h.users.Session(c.Value); err == nil {
+				if !validCSRF(r, s.CSRF) {
+					forbidden(w, r)
+					return
+				}
+				ctx := context.WithValue(r.Context(), userKey, u)
+				next.ServeHTTP(w, r.WithContext(context.WithValue(ctx, csrfKey, s.CSRF)))
+				return
+			}
+		}
+
+		if n, err := h.users.Count(); err != nil {
+			log.Print(err)
+			http.Error(w, "error", http.StatusInternalServerError)
+			return
+		} else if n == 0 {
+			http.Redirect(w, r, "/setup", http.StatusSeeOther)
+			return
+		}
+
+		if r.Method != "GET" {
+			http.Error(w, "login required", http.StatusUnauthorized)
+			return
+		}
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+	})
+}
+
+// currentUser returns the logged in user of request r, or nil.
+func currentUser(r *http.Request) *User {
+	u, _ := r.Context().Value(userKey).(*User)
+	return u
+}
+
+// csrfToken returns the CSRF token that forms in the response to r must
+// include.
+func csrfToken(r *http.Request) string {
+	token, _ := r.Context().Value(csrfKey).(string)
+	return token
+}
+
+// validCSRF returns true if r is a safe request or if it contains token.
+func validCSRF(r *http.Request, token string) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	v := r.Header.Get("X-CSRF-Token")
+	if v == "" {
+		v = r.PostFormValue(CSRFField)
+	}
+	return token != "" && hmac.Equal([]byte(v), []byte(token))
+}
+
+// visitorToken returns the CSRF token of a visitor that is not logged in,
+// setting a new one if the request does not contain it.
+func (h *AuthHandler) visitorToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	if c, err := r.Cookie(CSRFCookie); err == nil && c.Value != "" {
+		return c.Value, nil
+	}
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token, nil
+}
+
+// forbidden responds to requests the current user is not allowed to make.
+func forbidden(w http.ResponseWriter, r *http.Request) {
+	log.Printf("denied %s %s for %q", r.Method, r.URL.Path, currentUser(r).name())
+	http.Error(w, "forbidden", http.StatusForbidden)
+}
+
+// LoginForm renders the login page.
+func (h *AuthHandler) LoginForm(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	data := struct {
+		Name string
+		Next string
+		Err  string
+	}{r.URL.Query().Get("name"), r.URL.Query().Get("next"), r.URL.Query().Get("err")}
+	render(w, r, data, "auth/login")
+}
+
+// Login handles POST requests from the login form.
+func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	name, next := r.FormValue("name"), r.FormValue("next")
+	if _, err := h.users.Authenticate(name, r.FormValue("password")); err != nil {
+		log.Printf("failed login for %q from %s", name, r.RemoteAddr)
+		http.Redirect(w, r, fmt.Sprintf("/login?name=%s&next=%s&err=%s", url.QueryEscape(name), url.QueryEscape(next), url.QueryEscape(err.Error())), http.StatusSeeOther)
+		return
+	}
+	h.startSession(w, r, name, next)
+}
+
+// Logout ends the current session.
+func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if c, err := r.Cookie(SessionCookie); err == nil {
+		if err := h.users.DeleteSession(c.Value); err != nil {
+			log.Printf("error deleting session: %s", err)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{Name: SessionCookie, Path: "/", MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// SetupForm renders the form to create the first user. It is only available
+// as long as no users exist.
+func (h *AuthHandler) SetupForm(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !h.needsSetup(w, r) {
+		return
+	}
+	data := struct {
+		Name string
+		Err  string
+	}{r.URL.Query().Get("name"), r.URL.Query().Get("err")}
+	render(w, r, data, "auth/setup")
+}
+
+// Setup handles POST requests from the setup form.
+func (h *AuthHandler) Setup(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !h.needsSetup(w, r) {
+		return
+	}
+	name := r.FormValue("name")
+	if err := h.createUser(r, User{Name: name, Role: RoleAdmin}, h.users.CreateFirst); err == ErrSetupDone {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		http.Redirect(w, r, fmt.Sprintf("/setup?name=%s&err=%s", url.QueryEscape(name), url.QueryEscape(err.Error())), http.StatusSeeOther)
+		return
+	}
+	log.Printf("created initial user %q", name)
+	h.startSession(w, r, name, "/")
+}
+
+// Users renders the user management page.
+func (h *AuthHandler) Users(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !currentUser(r).IsAdmin() {
+		forbidden(w, r)
+		return
+	}
+
+	users, err := h.users.List()
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	hooks, err := h.hooks.List()
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+
+	type userRow struct {
+		User
+		Form roleForm
+	}
+	rows := make([]userRow, len(users))
+	for i, u := range users {
+		rows[i] = userRow{u, newRoleForm(hooks, u)}
+	}
+
+	data := struct {
+		Users []userRow
+		Form  roleForm
+		Name  string
+		Err   string
+	}{rows, newRoleForm(hooks, User{Role: RoleViewer}), r.URL.Query().Get("name"), r.URL.Query().Get("err")}
+	render(w, r, data, "users/index")
+}
+
+// roleForm contains the data to render the role fields of a user form.
+type roleForm struct {
+	Roles    []Role
+	Hooks    []Hook
+	Role     Role
+	Selected map[string]bool
+}
+
+func newRoleForm(hooks []Hook, u User) roleForm {
+	f := roleForm{Roles, hooks, u.Role, make(map[string]bool)}
+	for _, id := range u.Hooks {
+		f.Selected[id] = true
+	}
+	return f
+}
+
+// CreateUser handles POST requests from the new user form.
+func (h *AuthHandler) CreateUser(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !currentUser(r).IsAdmin() {
+		forbidden(w, r)
+		return
+	}
+
+	name := r.FormValue("name")
+	r.ParseForm()
+	u := User{Name: name, Role: Role(r.FormValue("role")), Hooks: r.Form["hooks"]}
+	if err := h.createUser(r, u, h.users.Create); err != nil {
+		http.Redirect(w, r, fmt.Sprintf("/users?name=%s&err=%s", url.QueryEscape(name), url.QueryEscape(err.Error())), http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/users", http.StatusSeeOther)
+}
+
+// UpdateUser handles POST requests to change the password or role of a user
+// or to delete it.
+func (h *AuthHandler) UpdateUser(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if !currentUser(r).IsAdmin() {
+		forbidden(w, r)
+		return
+	}
+
+	name := p.ByName("name")
+
+	var err error
+	switch r.FormValue("action") {
+	case "delete":
+		if u := currentUser(r); u != nil && u.Name == name {
+			err = fmt.Errorf("cannot delete yourself")
+			break
+		}
+		err = h.users.Delete(name)
+	case "password":
+		if r.FormValue("password") != r.FormValue("confirm") {
+			err = fmt.Errorf("passwords do not match")
+			break
+		}
+		if err = h.users.SetPassword(name, r.FormValue("password")); err == nil && currentUser(r).Name == name {
+			// changing the password ended the current session as well
+			h.startSession(w, r, name, "/users")
+			return
+		}
+	case "role":
+		r.ParseForm()
+		err = h.users.SetRole(name, Role(r.FormValue("role")), r.Form["hooks"])
+	default:
+		err = fmt.Errorf("unknown action %q", r.FormValue("action"))
+	}
+	if err != nil {
+		log.Printf("error updating user %q: %s", name, err)
+		http.Redirect(w, r, "/users?err="+url.QueryEscape(err.Error()), http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/users", http.StatusSeeOther)
+}
+
+// Tokens renders the API tokens of the current user.
+func (h *AuthHandler) Tokens(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	h.renderTokens(w, r, "", r.URL.Query().Get("err"))
+}
+
+// CreateToken handles POST requests from the new token form. The secret token
+// is shown only once, in a response that must not be stored by the browser.
+func (h *AuthHandler) CreateToken(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	secret, err := h.users.CreateToken(currentUser(r).name(), r.FormValue("name"))
+	if err != nil {
+		http.Redirect(w, r, "/tokens?err="+url.QueryEscape(err.Error()), http.StatusSeeOther)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	h.renderTokens(w, r, secret, "")
+}
+
+// DeleteToken handles POST requests to revoke an API token.
+func (h *AuthHandler) DeleteToken(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	id, err := strconv.ParseUint(p.ByName("token"), 10, 64)
+	if err == nil {
+		err = h.users.DeleteToken(currentUser(r).name(), id)
+	}
+	if err != nil {
+		log.Printf("error deleting token: %s", err)
+		http.Redirect(w, r, "/tokens?err="+url.QueryEscape(err.Error()), http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/tokens", http.StatusSeeOther)
+}
+
+func (h *AuthHandler) renderTokens(w http.ResponseWriter, r *http.Request, secret, msg string) {
+	tokens, err := h.users.Tokens(currentUser(r).name())
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		Tokens []APIToken
+		Secret string
+		Err    string
+	}{tokens, secret, msg}
+	render(w, r, data, "users/tokens")
+}
+
+// createUser creates user u with the password from the form in r using
+// create.
+func (h *AuthHandler) createUser(r *http.Request, u User, create func(User, string) error) error {
+	if r.FormValue("password") != r.FormValue("confirm") {
+		return fmt.Errorf("passwords do not match")
+	}
+	if u.Role != RoleEditor {
+		u.Hooks = nil
+	}
+	return create(u, r.FormValue("password"))
+}
+
+// needsSetup returns true if no users exist yet, otherwise it redirects to the
+// login page.
+func (h *AuthHandler) needsSetup(w http.ResponseWriter, r *http.Request) bool {
+	n, err := h.users.Count()
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return false
+	}
+	if n > 0 {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return false
+	}
+	return true
+}
+
+// startSession logs in the user called name and redirects to next.
+func (h *AuthHandler) startSession(w http.ResponseWriter, r *http.Request, name, next string) {
+	token, err := h.users.CreateSession(name)
+	if err != nil {
+		log.Printf("error creating session: %s", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(SessionLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	// only redirect to local pages
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		next = "/"
+	}
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
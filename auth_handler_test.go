@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRequire(t *testing.T) {
+	users := &UserStore{testDB(t)}
+	auth := &AuthHandler{users: users}
+	if err := users.Create(User{Name: "admin", Role: RoleAdmin}, "password"); err != nil {
+		t.Fatal(err)
+	}
+	token, err := users.CreateSession("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, _, err := users.Session(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := users.CreateToken("admin", "ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		session  string
+		csrf     string // sent in the X-CSRF-Token header
+		bearer   string // sent in the Authorization header
+		form     url.Values
+		status   int
+		location string
+	}{
+		{"public file", "GET", "/public/css/rehook.css", "", "", "", nil, http.StatusOK, ""},
+		{"health check", "GET", "/healthz", "", "", "", nil, http.StatusOK, ""},
+		{"no session", "GET", "/hooks/edit/x?y=1", "", "", "", nil, http.StatusSeeOther, "/login?next=%2Fhooks%2Fedit%2Fx%3Fy%3D1"},
+		{"no session post", "POST", "/hooks", "", "", "", nil, http.StatusUnauthorized, ""},
+		{"invalid session", "GET", "/", "invalid", "", "", nil, http.StatusSeeOther, "/login?next=%2F"},
+		{"session", "GET", "/", token, "", "", nil, http.StatusOK, ""},
+		{"post without token", "POST", "/hooks", token, "", "", nil, http.StatusForbidden, ""},
+		{"post with wrong token", "POST", "/hooks", token, "wrong", "", nil, http.StatusForbidden, ""},
+		{"post with header token", "POST", "/hooks", token, session.CSRF, "", nil, http.StatusOK, ""},
+		{"post with form token", "POST", "/hooks", token, "", "", url.Values{CSRFField: {session.CSRF}}, http.StatusOK, ""},
+		{"post with empty form token", "POST", "/hooks", token, "", "", url.Values{CSRFField: {""}}, http.StatusForbidden, ""},
+		{"login", "GET", "/login", "", "", "", nil, http.StatusOK, ""},
+		{"login post without token", "POST", "/login", "", "", "", nil, http.StatusForbidden, ""},
+		{"api without token", "GET", "/api/v1/hooks", "", "", "", nil, http.StatusUnauthorized, ""},
+		{"api with session", "GET", "/api/v1/hooks", token, "", "", nil, http.StatusUnauthorized, ""},
+		{"api with invalid token", "GET", "/api/v1/hooks", "", "", "invalid", nil, http.StatusUnauthorized, ""},
+		{"api with token", "GET", "/api/v1/hooks", "", "", secret, nil, http.StatusOK, ""},
+		{"api post with token", "POST", "/api/v1/hooks", "", "", secret, nil, http.StatusOK, ""},
+		{"metrics without token", "GET", "/metrics", "", "", "", nil, http.StatusUnauthorized, ""},
+		{"metrics with token", "GET", "/metrics", "", "", secret, nil, http.StatusOK, ""},
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.form.Encode()))
+		if tt.form != nil {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if tt.session != "" {
+			r.AddCookie(&http.Cookie{Name: SessionCookie, Value: tt.session})
+		}
+		if tt.csrf != "" {
+			r.Header.Set("X-CSRF-Token", tt.csrf)
+		}
+		if tt.bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.bearer)
+		}
+		w := httptest.NewRecorder()
+		auth.Require(next).ServeHTTP(w, r)
+
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.status)
+		}
+		if loc := w.Header().Get("Location"); loc != tt.location {
+			t.Errorf("%s: redirected to %q, want %q", tt.name, loc, tt.location)
+		}
+	}
+}
+
+func TestRequireSetup(t *testing.T) {
+	auth := &AuthHandler{users: &UserStore{testDB(t)}}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	w := httptest.NewRecorder()
+	auth.Require(next).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if loc := w.Header().Get("Location"); w.Code != http.StatusSeeOther || loc != "/setup" {
+		t.Errorf("without users: status %d, redirected to %q, want %d and %q", w.Code, loc, http.StatusSeeOther, "/setup")
+	}
+}
+
+func TestCreateToken(t *testing.T) {
+	users := &UserStore{testDB(t)}
+	auth := &AuthHandler{users: users}
+	if err := users.Create(User{Name: "admin", Role: RoleAdmin}, "password"); err != nil {
+		t.Fatal(err)
+	}
+	u, err := users.Find("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("POST", "/tokens", strings.NewReader("name=ci"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r = r.WithContext(context.WithValue(r.Context(), userKey, u))
+	w := httptest.NewRecorder()
+	auth.CreateToken(w, r, nil)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("Cache-Control = %q, want %q", cc, "no-store")
+	}
+	i := strings.Index(w.Body.String(), "<pre>")
+	j := strings.Index(w.Body.String(), "</pre>")
+	if i < 0 || j < i {
+		t.Fatal("secret not shown")
+	}
+	if _, err := users.TokenUser(w.Body.String()[i+len("<pre>") : j]); err != nil {
+		t.Errorf("shown secret is not valid: %s", err)
+	}
+}
+
+func TestVisitorCSRF(t *testing.T) {
+	auth := &AuthHandler{users: &UserStore{testDB(t)}}
+	var got string
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { got = csrfToken(r) })
+
+	w := httptest.NewRecorder()
+	auth.Require(next).ServeHTTP(w, httptest.NewRequest("GET", "/login", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != CSRFCookie || cookies[0].SameSite != http.SameSiteStrictMode || !cookies[0].HttpOnly {
+		t.Fatalf("cookies = %+v, want a strict same-site CSRF cookie", cookies)
+	}
+	if got == "" || got != cookies[0].Value {
+		t.Errorf("token for forms = %q, want the value of the cookie", got)
+	}
+
+	for _, token := range []string{"", "wrong", cookies[0].Value} {
+		got = ""
+		r := httptest.NewRequest("POST", "/login", strings.NewReader(url.Values{CSRFField: {token}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(cookies[0])
+		w := httptest.NewRecorder()
+		auth.Require(next).ServeHTTP(w, r)
+		if valid := token == cookies[0].Value; (w.Code == http.StatusForbidden) == valid || (got != "") != valid {
+			t.Errorf("login with token %q: status %d", token, w.Code)
+		}
+	}
+}
+
+// TestFormsIncludeCSRF checks that every form that is posted includes the CSRF
+// token, as requests without it are refused.
+func TestFormsIncludeCSRF(t *testing.T) {
+	form := regexp.MustCompile(`(?is)<form[^>]*method="post".*?</form>`)
+	files, err := filepath.Glob("views/*/*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files = append(files, "views/layout.html")
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range form.FindAll(b, -1) {
+			if !bytes.Contains(f, []byte("{{csrf}}")) {
+				t.Errorf("%s: form without CSRF token: %.80s", file, f)
+			}
+		}
+	}
+}
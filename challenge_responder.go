@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+func init() {
+	RegisterComponent("challenge-responder", ChallengeResponder{})
+}
+
+// challenges contains the supported providers and the function that answers
+// their challenge requests.
+var challenges = map[string]func(r Request, token []byte) *Response{
+	"slack":    slackChallenge,
+	"facebook": facebookChallenge,
+	"twitter":  twitterChallenge,
+	"msgraph":  graphChallenge,
+}
+
+// ChallengeResponder answers the verification requests some providers send
+// to confirm they are allowed to deliver events to the endpoint. All other
+// requests pass through unchanged.
+type ChallengeResponder struct{}
+
+// Name returns the name of this component.
+func (ChallengeResponder) Name() string { return "Challenge responder" }
+
+// Template returns the HTML template name of this component.
+func (ChallengeResponder) Template() string { return "challenge-responder" }
+
+// Parameters returns the names of the configuration parameters.
+func (ChallengeResponder) Parameters() []string {
+	return []string{"provider", "token"}
+}
+
+// Params returns the currently stored configuration parameters from bucket b.
+func (c ChallengeResponder) Params(h Hook, b *bolt.Bucket) map[string]string {
+	m := make(map[string]string)
+	for _, k := range c.Parameters() {
+		m[k] = string(b.Get([]byte(k)))
+	}
+	return m
+}
+
+// Init initializes this component. It requires a supported provider to be
+// present. Depending on the provider, the token is the verification token or
+// the secret used to sign the response.
+func (ChallengeResponder) Init(h Hook, params map[string]string, b *bolt.Bucket) error {
+	provider, ok := params["provider"]
+	if !ok {
+		return invalidParam("provider", "provider is required")
+	}
+	if _, ok := challenges[provider]; !ok {
+		return invalidParam("provider", "unsupported provider: %s", provider)
+	}
+
+	token := params["token"]
+	if token == "" && (provider == "facebook" || provider == "twitter") {
+		return invalidParam("token", "token is required for %s", provider)
+	}
+
+	if err := b.Put([]byte("provider"), []byte(provider)); err != nil {
+		return err
+	}
+	return b.Put([]byte("token"), []byte(token))
+}
+
+// Respond answers request r if it is a challenge of the configured provider.
+func (ChallengeResponder) Respond(h Hook, r Request, b *bolt.Bucket) (*Response, error) {
+	fn, ok := challenges[string(b.Get([]byte("provider")))]
+	if !ok {
+		return nil, errors.New("challenge responder not initialized")
+	}
+	return fn(r, b.Get([]byte("token"))), nil
+}
+
+// Process passes all requests, challenges have already been answered.
+func (ChallengeResponder) Process(h Hook, r Request, b *bolt.Bucket) error {
+	return nil
+}
+
+// slackChallenge answers the url_verification event of the Slack Events API.
+func slackChallenge(r Request, token []byte) *Response {
+	if r.Method != "POST" || !strings.HasPrefix(r.Headers["Content-Type"], "application/json") {
+		return nil
+	}
+
+	var event struct {
+		Type      string `json:"type"`
+		Token     string `json:"token"`
+		Challenge string `json:"challenge"`
+	}
+	if err := json.Unmarshal(r.Body, &event); err != nil || event.Type != "url_verification" {
+		return nil
+	}
+	if len(token) > 0 && !hmac.Equal([]byte(event.Token), token) {
+		return &Response{Status: http.StatusForbidden}
+	}
+	return &Response{http.StatusOK, "text/plain", []byte(event.Challenge)}
+}
+
+// facebookChallenge answers the subscription verification of Facebook/Meta
+// webhooks.
+func facebookChallenge(r Request, token []byte) *Response {
+	if r.Method != "GET" || r.Query.Get("hub.mode") != "subscribe" {
+		return nil
+	}
+	if !hmac.Equal([]byte(r.Query.Get("hub.verify_token")), token) {
+		return &Response{Status: http.StatusForbidden}
+	}
+	return &Response{http.StatusOK, "text/plain", []byte(r.Query.Get("hub.challenge"))}
+}
+
+// twitterChallenge answers the challenge-response check (CRC) of the Twitter
+// Account Activity API, signing the CRC token with the consumer secret.
+func twitterChallenge(r Request, secret []byte) *Response {
+	crc := r.Query.Get("crc_token")
+	if r.Method != "GET" || crc == "" {
+		return nil
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(crc))
+	body, err := json.Marshal(map[string]string{
+		"response_token": "sha256=" + base64.StdEncoding.EncodeToString(mac.Sum(nil)),
+	})
+	if err != nil {
+		return &Response{Status: http.StatusInternalServerError}
+	}
+	return &Response{http.StatusOK, "application/json", body}
+}
+
+// graphChallenge answers the subscription validation of Microsoft Graph change
+// notifications.
+func graphChallenge(r Request, token []byte) *Response {
+	v, ok := r.Query["validationToken"]
+	if !ok || len(v) == 0 {
+		return nil
+	}
+	return &Response{http.StatusOK, "text/plain", []byte(v[0])}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestChallengeResponder(t *testing.T) {
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("crc"))
+	twitter := `{"response_token":"sha256=` + base64.StdEncoding.EncodeToString(mac.Sum(nil)) + `"}`
+
+	tests := []struct {
+		provider, token string
+		method, target  string
+		body            string
+		status          int
+		response        string // empty if the request is queued instead
+	}{
+		{"slack", "verify", "POST", "/h/hook", `{"type":"url_verification","token":"verify","challenge":"abc"}`, http.StatusOK, "abc"},
+		{"slack", "verify", "POST", "/h/hook", `{"type":"url_verification","token":"wrong","challenge":"abc"}`, http.StatusForbidden, ""},
+		{"slack", "", "POST", "/h/hook", `{"type":"url_verification","challenge":"abc"}`, http.StatusOK, "abc"},
+		{"slack", "verify", "POST", "/h/hook", `{"type":"event_callback"}`, http.StatusOK, ""},
+		{"facebook", "verify", "GET", "/h/hook?hub.mode=subscribe&hub.verify_token=verify&hub.challenge=abc", "", http.StatusOK, "abc"},
+		{"facebook", "verify", "GET", "/h/hook?hub.mode=subscribe&hub.verify_token=wrong&hub.challenge=abc", "", http.StatusForbidden, ""},
+		{"facebook", "verify", "POST", "/h/hook", `{"object":"page"}`, http.StatusOK, ""},
+		{"twitter", "secret", "GET", "/h/hook?crc_token=crc", "", http.StatusOK, twitter},
+		{"msgraph", "", "POST", "/h/hook?validationToken=abc", "", http.StatusOK, "abc"},
+		{"msgraph", "", "POST", "/h/hook", `{"value":[]}`, http.StatusOK, ""},
+	}
+	for i, tt := range tests {
+		db, s, q := testStores(t)
+		hh := &HookHandler{s, db, q}
+		h, _ := testHook(t, s, "hook")
+		if _, err := s.AddComponent(*h, HookComponent{Name: "challenge-responder"}, map[string]string{"provider": tt.provider, "token": tt.token}); err != nil {
+			t.Fatal(err)
+		}
+
+		r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+		r.Header.Set("Content-Type", "application/json")
+		w := receive(hh, h.ID, r)
+		if w.Code != tt.status || w.Body.String() != tt.response {
+			t.Errorf("%d %s: response = %d %q, want %d %q", i, tt.provider, w.Code, w.Body, tt.status, tt.response)
+		}
+
+		// only requests that are not answered by the responder are queued
+		n, err := q.Pending(h.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if queued := tt.status == http.StatusOK && tt.response == ""; (n == 1) != queued {
+			t.Errorf("%d %s: %d queued, want queued %t", i, tt.provider, n, queued)
+		}
+	}
+}
+
+func TestChallengeResponderInit(t *testing.T) {
+	tests := []struct {
+		params map[string]string
+		valid  bool
+	}{
+		{map[string]string{"provider": "slack"}, true},
+		{map[string]string{"provider": "msgraph"}, true},
+		{map[string]string{"provider": "facebook"}, false},
+		{map[string]string{"provider": "facebook", "token": "verify"}, true},
+		{map[string]string{"provider": "twitter"}, false},
+		{map[string]string{"provider": "github"}, false},
+		{map[string]string{}, false},
+	}
+	for _, tt := range tests {
+		_, s, _ := testStores(t)
+		h, _ := testHook(t, s, "hook")
+		_, err := s.AddComponent(*h, HookComponent{Name: "challenge-responder"}, tt.params)
+		if (err == nil) != tt.valid {
+			t.Errorf("AddComponent(%v) = %v, want valid %t", tt.params, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// TokenEnv is the environment variable containing the API token used by
+// commands when the database is in use by a running rehook.
+const TokenEnv = "REHOOK_TOKEN"
+
+// command is a subcommand of the rehook binary.
+type command struct {
+	name string // words selecting the command
+	args string // description of the arguments
+	min  int    // minimum number of arguments
+	max  int    // maximum number of arguments, -1 means unlimited
+	run  func(c client, args []string) error
+}
+
+var commands = []command{
+	{"hooks list", "", 0, 0, cmdHooksList},
+	{"hooks create", "<id>", 1, 1, cmdHooksCreate},
+	{"components add", "<hook> <component> [key=value...]", 2, -1, cmdComponentsAdd},
+	{"stats", "<hook>", 1, 1, cmdStats},
+	{"replay", "<delivery-id>", 1, 1, cmdReplay},
+}
+
+// client performs the commands, either directly on the database or through
+// the JSON API of a running rehook.
+type client interface {
+	Hooks() ([]apiHook, error)
+	CreateHook(id string) error
+	AddComponent(hook, name string, params map[string]string) (string, error)
+	Stats(hook string) (*apiStats, error)
+	Replay(id uint64) (*apiDelivery, error)
+	Close() error
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] [command]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Without a command, rehook starts the server. Commands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %s\n", strings.TrimSpace(c.name+" "+c.args))
+	}
+	fmt.Fprintf(os.Stderr, "\nCommands use the -db file directly, or the admin interface on the -admin\n")
+	fmt.Fprintf(os.Stderr, "address with the API token in $%s if the server is running.\n\nFlags:\n", TokenEnv)
+	flag.PrintDefaults()
+}
+
+// runCommand runs the command given on the command line.
+func runCommand(args []string) error {
+	for _, cmd := range commands {
+		words := strings.Fields(cmd.name)
+		if len(args) < len(words) || strings.Join(args[:len(words)], " ") != cmd.name {
+			continue
+		}
+		args = args[len(words):]
+		if len(args) < cmd.min || (cmd.max >= 0 && len(args) > cmd.max) {
+			return fmt.Errorf("usage: rehook %s", strings.TrimSpace(cmd.name+" "+cmd.args))
+		}
+
+		c, err := newClient()
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		return cmd.run(c, args)
+	}
+	flag.Usage()
+	return fmt.Errorf("unknown command %q", strings.Join(args, " "))
+}
+
+func cmdHooksList(c client, args []string) error {
+	hooks, err := c.Hooks()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tLAST 24H\tTOTAL\tSUCCEEDED\tFILTERED\tFAILED\tREJECTED")
+	for _, h := range hooks {
+		s := h.Stats
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\n", h.ID, s.recent(24), s.Total, s.Succeeded, s.Filtered, s.Failed, s.Rejected)
+	}
+	return w.Flush()
+}
+
+func cmdHooksCreate(c client, args []string) error {
+	if err := c.CreateHook(args[0]); err != nil {
+		return err
+	}
+	fmt.Printf("Created hook %s\n", args[0])
+	return nil
+}
+
+func cmdComponentsAdd(c client, args []string) error {
+	params := make(map[string]string)
+	for _, arg := range args[2:] {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid parameter %q, expected key=value", arg)
+		}
+		params[kv[0]] = kv[1]
+	}
+
+	id, err := c.AddComponent(args[0], args[1], params)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Added %s to hook %s as component %s\n", args[1], args[0], id)
+	return nil
+}
+
+func cmdStats(c client, args []string) error {
+	s, err := c.Stats(args[0])
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Last 24 hours:\t%d\n", s.recent(24))
+	fmt.Fprintf(w, "Last 48 hours:\t%d\n", s.recent(48))
+	fmt.Fprintf(w, "Total:\t%d\n", s.Total)
+	fmt.Fprintf(w, "Succeeded:\t%d\n", s.Succeeded)
+	fmt.Fprintf(w, "Filtered:\t%d\n", s.Filtered)
+	fmt.Fprintf(w, "Failed:\t%d\n", s.Failed)
+	fmt.Fprintf(w, "Rejected:\t%d\n", s.Rejected)
+
+	fmt.Fprintf(w, "\nProcessing time:\tRequests\n")
+	for i, n := range s.Latency.Counts {
+		if i < len(s.Latency.Bounds) {
+			fmt.Fprintf(w, "  ≤ %s\t%d\n", seconds(s.Latency.Bounds[i]), n)
+		} else if i > 0 {
+			fmt.Fprintf(w, "  > %s\t%d\n", seconds(s.Latency.Bounds[i-1]), n)
+		}
+	}
+	return w.Flush()
+}
+
+func cmdReplay(c client, args []string) error {
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid delivery id %q", args[0])
+	}
+	d, err := c.Replay(id)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Queued delivery %d for hook %s\n", d.ID, d.Hook)
+	return nil
+}
+
+// seconds formats a number of seconds as a duration.
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// recent returns the number of requests in the last n hours.
+func (s apiStats) recent(n int) (total int) {
+	if n > len(s.Recent) {
+		n = len(s.Recent)
+	}
+	for _, c := range s.Recent[len(s.Recent)-n:] {
+		total += c
+	}
+	return total
+}
+
+// newClient opens the database. If it is locked by a running rehook, the admin
+// interface of that server is used instead.
+func newClient() (client, error) {
+	db, err := openDB(*database, 100*time.Millisecond)
+	if err == bolt.ErrTimeout {
+		return newAPIClient()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open database: %s", err)
+	}
+	return &dbClient{&HookStore{db}, NewQueue(db)}, nil
+}
+
+// dbClient performs commands directly on the database.
+type dbClient struct {
+	hooks *HookStore
+	queue *Queue
+}
+
+func (c *dbClient) Hooks() ([]apiHook, error) {
+	hooks, err := c.hooks.List()
+	if err != nil {
+		return nil, err
+	}
+	resp := make([]apiHook, 0, len(hooks))
+	for _, h := range hooks {
+		resp = append(resp, apiHook{ID: h.ID, Stats: newAPIStats(h.Count)})
+	}
+	return resp, nil
+}
+
+func (c *dbClient) CreateHook(id string) error {
+	return c.hooks.Create(Hook{ID: id})
+}
+
+func (c *dbClient) AddComponent(hook, name string, params map[string]string) (string, error) {
+	h, err := c.hooks.Find(hook)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := components[name]; !ok {
+		return "", fmt.Errorf("unknown component %q", name)
+	}
+	if errs := unknownParams(name, params); len(errs) > 0 {
+		return "", paramErrors(errs)
+	}
+	id, err := c.hooks.AddComponent(*h, HookComponent{Name: name}, params)
+	if pe, ok := err.(*ParamError); ok {
+		return "", paramErrors([]ParamError{*pe})
+	}
+	return id, err
+}
+
+func (c *dbClient) Stats(hook string) (*apiStats, error) {
+	if _, err := c.hooks.Find(hook); err != nil {
+		return nil, err
+	}
+	count, err := c.hooks.RequestCount(hook)
+	if err != nil {
+		return nil, err
+	}
+	return newAPIStats(count), nil
+}
+
+func (c *dbClient) Replay(id uint64) (*apiDelivery, error) {
+	r, err := c.queue.FindRecord(id)
+	if err != nil {
+		return nil, err
+	}
+	d, err := c.queue.Replay(r.Hook, r.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &apiDelivery{d.ID, d.Hook}, nil
+}
+
+func (c *dbClient) Close() error {
+	return c.hooks.db.Close()
+}
+
+// apiClient performs commands through the JSON API.
+type apiClient struct {
+	url   string // base URL of the admin interface
+	token string
+}
+
+func newAPIClient() (*apiClient, error) {
+	host, port, err := net.SplitHostPort(*adminAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid admin address: %s", err)
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	c := &apiClient{"http://" + net.JoinHostPort(host, port), os.Getenv(TokenEnv)}
+	if c.token == "" {
+		return nil, fmt.Errorf("database %s is in use, set %s to an API token to use the admin interface at %s", *database, TokenEnv, c.url)
+	}
+	return c, nil
+}
+
+func (c *apiClient) Hooks() (hooks []apiHook, err error) {
+	return hooks, c.do("GET", "/hooks", nil, &hooks)
+}
+
+func (c *apiClient) CreateHook(id string) error {
+	return c.do("POST", "/hooks", map[string]string{"id": id}, nil)
+}
+
+func (c *apiClient) AddComponent(hook, name string, params map[string]string) (string, error) {
+	var resp apiComponent
+	err := c.do("POST", "/hooks/"+url.PathEscape(hook)+"/components", apiComponent{Name: name, Params: params}, &resp)
+	return resp.ID, err
+}
+
+func (c *apiClient) Stats(hook string) (s *apiStats, err error) {
+	return s, c.do("GET", "/hooks/"+url.PathEscape(hook)+"/stats", nil, &s)
+}
+
+func (c *apiClient) Replay(id uint64) (d *apiDelivery, err error) {
+	return d, c.do("POST", fmt.Sprintf("/deliveries/%d/replay", id), nil, &d)
+}
+
+func (c *apiClient) Close() error {
+	return nil
+}
+
+// do sends a request to the API endpoint at path with req encoded as the JSON
+// body, and decodes the response into resp.
+func (c *apiClient) do(method, path string, req, resp interface{}) error {
+	var body io.Reader
+	if req != nil {
+		b, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	r, err := http.NewRequest(method, c.url+"/api/v1"+path, body)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Authorization", "Bearer "+c.token)
+	r.Header.Set("User-Agent", UserAgent)
+	if req != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		var e struct {
+			Error  string `json:"error"`
+			Errors []ParamError
+		}
+		if err := json.NewDecoder(res.Body).Decode(&e); err != nil || e.Error == "" {
+			return fmt.Errorf("%s %s: %s", method, path, res.Status)
+		}
+		if len(e.Errors) > 0 {
+			return paramErrors(e.Errors)
+		}
+		return errors.New(e.Error)
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
+
+// paramErrors combines parameter errors into a single error.
+func paramErrors(errs []ParamError) error {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = fmt.Sprintf("%s: %s", e.Param, e.Message)
+	}
+	return fmt.Errorf("invalid parameters: %s", strings.Join(msgs, "; "))
+}
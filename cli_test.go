@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCommandDB points the -db flag to a new database file for the duration
+// of the test and returns its path.
+func testCommandDB(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rehook.db")
+	old := *database
+	*database = path
+	t.Cleanup(func() { *database = old })
+	return path
+}
+
+func TestRunCommand(t *testing.T) {
+	path := testCommandDB(t)
+
+	tests := []struct {
+		args  string
+		valid bool
+	}{
+		{"hooks create foo", true},
+		{"hooks create foo", false},
+		{"hooks create", false},
+		{"hooks create foo bar", false},
+		{"hooks list", true},
+		{"components add foo forward-request-action url=http://example.com", true},
+		{"components add foo forward-request-action url", false},
+		{"components add foo forward-request-action uri=http://example.com", false},
+		{"components add foo unknown-action", false},
+		{"components add bar log-action", false},
+		{"stats foo", true},
+		{"stats bar", false},
+		{"replay 1", false},
+		{"replay one", false},
+		{"hooks remove foo", false},
+	}
+	for _, tt := range tests {
+		if err := runCommand(strings.Fields(tt.args)); (err == nil) != tt.valid {
+			t.Errorf("rehook %s = %v, want valid %t", tt.args, err, tt.valid)
+		}
+	}
+
+	// commands close the database, so it can be used again
+	db, err := openDB(path, 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("database still in use: %s", err)
+	}
+	defer db.Close()
+	h, err := (&HookStore{db}).Find("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Components) != 1 || h.Components[0].Name != "forward-request-action" {
+		t.Errorf("components = %+v, want the forward action", h.Components)
+	}
+}
+
+func TestRunCommandServerRunning(t *testing.T) {
+	path := testCommandDB(t)
+	db, err := openDB(path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		switch r.URL.Path {
+		case "/api/v1/hooks":
+			writeJSON(w, http.StatusOK, []apiHook{{ID: "foo", Stats: newAPIStats(Count{})}})
+		default:
+			writeAPIError(w, http.StatusNotFound, "hook does not exist")
+		}
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+	oldAddr := *adminAddr
+	*adminAddr = ":" + port
+	defer func() { *adminAddr = oldAddr }()
+
+	os.Unsetenv(TokenEnv)
+	if err := runCommand([]string{"hooks", "list"}); err == nil || !strings.Contains(err.Error(), TokenEnv) {
+		t.Errorf("without token: %v, want an error about %s", err, TokenEnv)
+	}
+
+	os.Setenv(TokenEnv, "secret")
+	defer os.Unsetenv(TokenEnv)
+	if err := runCommand([]string{"hooks", "list"}); err != nil {
+		t.Errorf("hooks list through the API: %s", err)
+	}
+	if auth != "Bearer secret" {
+		t.Errorf("Authorization = %q, want the token", auth)
+	}
+	if err := runCommand([]string{"stats", "bar"}); err == nil || err.Error() != "hook does not exist" {
+		t.Errorf("stats of a missing hook through the API: %v, want the API error", err)
+	}
+}
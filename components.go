@@ -1,8 +1,15 @@
 package main
 
 import (
+	"crypto/tls"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
@@ -22,23 +29,111 @@ func RegisterComponent(name string, c Component) {
 
 // HookComponent is a component that belongs to an existing hook.
 type HookComponent struct {
-	ID   string
-	Name string
+	ID    string      // unique instance identifier
+	Name  string      // registered component name
+	Retry RetryPolicy // retry policy used when processing fails
+}
+
+// bucket returns the storage bucket of this component instance in tx, or nil
+// if it does not exist.
+func (hc HookComponent) bucket(tx *bolt.Tx) *bolt.Bucket {
+	b := tx.Bucket(BucketComponents).Bucket([]byte(hc.Name))
+	if b == nil {
+		return nil
+	}
+	return b.Bucket([]byte(hc.ID))
+}
+
+// createBucket returns the storage bucket of this component instance in tx,
+// creating it if necessary.
+func (hc HookComponent) createBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	b, err := tx.Bucket(BucketComponents).CreateBucketIfNotExists([]byte(hc.Name))
+	if err != nil {
+		return nil, err
+	}
+	return b.CreateBucketIfNotExists([]byte(hc.ID))
 }
 
 // Request represents an incoming request that may be processed by components.
 type Request struct {
-	Method  string
-	Headers map[string]string
-	Body    []byte
+	Method       string
+	Host         string            // host requested by the client
+	Path         string            // path following the hook identifier, if any
+	RawQuery     string            // encoded query string, without the '?'
+	Query        url.Values        // parsed query string
+	Headers      map[string]string // first value of every header
+	Header       http.Header       // all header values
+	RemoteAddr   string            // network address of the client
+	ForwardedFor []string          // addresses from the X-Forwarded-For header
+	TLS          *TLSInfo          // TLS connection details, nil for plain HTTP
+	Body         []byte
+}
+
+// TLSInfo describes the TLS connection a request was received on.
+type TLSInfo struct {
+	Version     string
+	CipherSuite string
+	ServerName  string
 }
 
-func loadRequest(req *http.Request) (r Request, err error) {
+// URI returns the path and query string of r, relative to the hook URL.
+func (r Request) URI() string {
+	if r.RawQuery == "" {
+		return r.Path
+	}
+	return r.Path + "?" + r.RawQuery
+}
+
+// AllHeaders returns all header values of r. Requests stored by older
+// versions only have the first value of each header.
+func (r Request) AllHeaders() http.Header {
+	if r.Header != nil {
+		return r.Header
+	}
+	h := make(http.Header)
+	for k, v := range r.Headers {
+		h.Set(k, v)
+	}
+	return h
+}
+
+// RemoteIP returns the IP address of the client that sent r.
+func (r Request) RemoteIP() string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// loadRequest reads the incoming request req. The path is the part of the URL
+// following the hook identifier.
+func loadRequest(req *http.Request, path string) (r Request, err error) {
 	r.Method = req.Method
+	r.Host = req.Host
+	r.Path = path
+	r.RawQuery = req.URL.RawQuery
+	r.Query = req.URL.Query()
+	r.Header = req.Header
 	r.Headers = make(map[string]string)
 	for k := range req.Header {
 		r.Headers[k] = req.Header.Get(k)
 	}
+	r.RemoteAddr = req.RemoteAddr
+	for _, v := range req.Header["X-Forwarded-For"] {
+		for _, addr := range strings.Split(v, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				r.ForwardedFor = append(r.ForwardedFor, addr)
+			}
+		}
+	}
+	if req.TLS != nil {
+		r.TLS = &TLSInfo{
+			Version:     tls.VersionName(req.TLS.Version),
+			CipherSuite: tls.CipherSuiteName(req.TLS.CipherSuite),
+			ServerName:  req.TLS.ServerName,
+		}
+	}
 	r.Body, err = ioutil.ReadAll(req.Body)
 	return r, err
 }
@@ -53,20 +148,173 @@ type Component interface {
 	// component. An empty string indicates no configuration is needed.
 	Template() string
 
-	// Params returns the currently stored configuration parameters for hook h
-	// from bucket b.
+	// Parameters returns the names of the configuration parameters accepted
+	// by Init.
+	Parameters() []string
+
+	// Params returns the currently stored configuration parameters from bucket
+	// b of this component instance in hook h.
 	Params(h Hook, b *bolt.Bucket) map[string]string
 
 	// Init is called when this component is added to a hook. Params contains a
 	// map of user configured settings. If this component could not be
-	// initialized, a descriptive error should be returned. The bucket b can be
-	// used to store data. Note that the bucket is shared between all instances
-	// of this component.
+	// initialized, a descriptive error should be returned, preferably a
+	// ParamError identifying the parameter at fault. The bucket b can be
+	// used to store data. Every instance of a component has its own bucket, so
+	// a hook may contain the same component more than once.
 	Init(h Hook, params map[string]string, b *bolt.Bucket) error
 
 	// Process is called whenever an incoming request r passes through this
 	// component for an existing hook h. Bucket b is provided to fetch or store
 	// data. If this request cannot be processed, a descriptive error should be
-	// returned.
+	// returned. Components that intentionally drop a request, for example
+	// because validation failed, should return a FilteredError instead.
 	Process(h Hook, r Request, b *bolt.Bucket) error
 }
+
+// Response is an HTTP response written by a component in reply to an incoming
+// request.
+type Response struct {
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// Responder is implemented by components that may answer an incoming request
+// directly, for example to complete the handshake some services perform
+// before they start sending events. Respond is called before the request is
+// queued. If it returns a non-nil response, that response is written and the
+// request is not processed any further.
+type Responder interface {
+	Respond(h Hook, r Request, b *bolt.Bucket) (*Response, error)
+}
+
+// ParamError is returned by Init when a configuration parameter is missing or
+// invalid.
+type ParamError struct {
+	Param   string // name of the parameter
+	Message string
+}
+
+func (e *ParamError) Error() string {
+	return e.Message
+}
+
+// invalidParam returns a ParamError for param, the message is formatted
+// according to format.
+func invalidParam(param, format string, a ...interface{}) error {
+	return &ParamError{param, fmt.Sprintf(format, a...)}
+}
+
+// unknownParams returns an error for every parameter in params that the
+// component registered as name does not accept, sorted by parameter name.
+func unknownParams(name string, params map[string]string) (errs []ParamError) {
+	known := make(map[string]bool)
+	for _, k := range components[name].Parameters() {
+		known[k] = true
+	}
+	for k := range params {
+		if !known[k] {
+			errs = append(errs, ParamError{k, fmt.Sprintf("unknown parameter %s", k)})
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Param < errs[j].Param })
+	return errs
+}
+
+// Sender is implemented by components that pass requests on to other systems,
+// which may take a long time. Send is called instead of Process, outside of any
+// database transaction, with the stored params of the component instance. This
+// way a slow system does not keep other requests from being stored.
+type Sender interface {
+	Send(h Hook, r Request, params map[string]string) error
+}
+
+// upstreamClient returns the HTTP client that components use for outgoing
+// requests, which fail once they take longer than -upstream-timeout.
+func upstreamClient() *http.Client {
+	return &http.Client{Timeout: *upstreamTimeout}
+}
+
+// Privileged is implemented by components that can affect the system Rehook
+// runs on, such as running commands or writing files. Only admins may add or
+// configure them.
+type Privileged interface {
+	Privileged() bool
+}
+
+// Expirer is implemented by components that store data which expires, such as
+// the identifiers used for replay protection. Expire is called periodically
+// with the bucket b of a component instance and removes the data that expired
+// before now. It returns the number of removed entries.
+type Expirer interface {
+	Expire(h Hook, b *bolt.Bucket, now time.Time) (int, error)
+}
+
+// isPrivileged returns true if the component registered as name is
+// privileged.
+func isPrivileged(name string) bool {
+	p, ok := components[name].(Privileged)
+	return ok && p.Privileged()
+}
+
+// FilteredError is returned by components that intentionally drop a request.
+// Unlike other errors, it does not indicate a failure to process the request.
+type FilteredError struct {
+	Reason     string
+	Status     int           // HTTP status code for synchronous hooks, 403 if 0
+	RetryAfter time.Duration // time after which the request may be sent again
+}
+
+func (e *FilteredError) Error() string {
+	return e.Reason
+}
+
+// StatusCode returns the HTTP status code to respond with when a hook is
+// processed synchronously.
+func (e *FilteredError) StatusCode() int {
+	if e.Status == 0 {
+		return http.StatusForbidden
+	}
+	return e.Status
+}
+
+// Filter returns a FilteredError with the reason formatted according to
+// format.
+func Filter(format string, a ...interface{}) error {
+	return &FilteredError{Reason: fmt.Sprintf(format, a...)}
+}
+
+// FilterStatus returns a FilteredError with the given HTTP status code and
+// the reason formatted according to format.
+func FilterStatus(status int, format string, a ...interface{}) error {
+	return &FilteredError{Reason: fmt.Sprintf(format, a...), Status: status}
+}
+
+// isFiltered returns true if err indicates a request was dropped on purpose.
+func isFiltered(err error) bool {
+	_, ok := err.(*FilteredError)
+	return ok
+}
+
+// UpstreamError is returned by components that failed because a remote
+// service could not be reached or returned an error.
+type UpstreamError struct {
+	Err error
+}
+
+func (e *UpstreamError) Error() string {
+	return e.Err.Error()
+}
+
+// StatusCode returns the HTTP status code to respond with when a hook is
+// processed synchronously.
+func (e *UpstreamError) StatusCode() int {
+	return http.StatusBadGateway
+}
+
+// statusCoder is implemented by errors that determine the HTTP response of
+// synchronously processed hooks.
+type statusCoder interface {
+	StatusCode() int
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Config describes hooks and their components. It is read from the file given
+// with the -config flag and is the format of the admin export.
+type Config struct {
+	Hooks []HookConfig `json:"hooks"`
+}
+
+// HookConfig describes a single hook.
+type HookConfig struct {
+	ID         string            `json:"id"`
+	Settings   SettingsConfig    `json:"settings"`
+	Components []ComponentConfig `json:"components"`
+}
+
+// SettingsConfig describes the settings of a hook. Durations are formatted
+// like "1m30s", omitted values use the defaults.
+type SettingsConfig struct {
+	HistoryCount int    `json:"history_count,omitempty"`
+	HistoryAge   string `json:"history_age,omitempty"`
+	Sync         bool   `json:"sync,omitempty"`
+	SyncTimeout  string `json:"sync_timeout,omitempty"`
+	MaxBodySize  int64  `json:"max_body_size,omitempty"`
+
+	State          State `json:"state,omitempty"`
+	DisabledStatus int   `json:"disabled_status,omitempty"`
+}
+
+// ComponentConfig describes a component in the chain of a hook. The optional
+// ID refers to an existing component instance, so its stored data is kept
+// when the configuration is applied.
+type ComponentConfig struct {
+	ID     string            `json:"id,omitempty"`
+	Name   string            `json:"name"`
+	Params map[string]string `json:"params,omitempty"`
+	Retry  *retryConfig      `json:"retry,omitempty"`
+}
+
+// loadConfig reads the configuration file at path.
+func loadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var c Config
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", path, err)
+	}
+	return &c, nil
+}
+
+func newSettingsConfig(s Settings) SettingsConfig {
+	c := SettingsConfig{HistoryCount: s.Retention.Count, Sync: s.Sync, MaxBodySize: s.MaxBodySize, DisabledStatus: s.DisabledStatus}
+	if s.State != StateActive {
+		c.State = s.State
+	}
+	if s.Retention.Age > 0 {
+		c.HistoryAge = s.Retention.Age.String()
+	}
+	if s.SyncTimeout > 0 {
+		c.SyncTimeout = s.SyncTimeout.String()
+	}
+	return c
+}
+
+// settings returns the hook settings described by c.
+func (c SettingsConfig) settings() (s Settings, err error) {
+	s = Settings{
+		Retention:      Retention{Count: c.HistoryCount},
+		Sync:           c.Sync,
+		MaxBodySize:    c.MaxBodySize,
+		State:          c.State,
+		DisabledStatus: c.DisabledStatus,
+	}
+	if c.HistoryCount < 0 {
+		return s, errors.New("history count cannot be negative")
+	}
+	if c.MaxBodySize < 0 {
+		return s, errors.New("maximum body size cannot be negative")
+	}
+	if !c.State.valid() {
+		return s, fmt.Errorf("invalid state %q", c.State)
+	}
+	if c.DisabledStatus != 0 && (c.DisabledStatus < 200 || c.DisabledStatus > 599) {
+		return s, errors.New("disabled status must be between 200 and 599")
+	}
+	if c.HistoryAge != "" {
+		if s.Retention.Age, err = time.ParseDuration(c.HistoryAge); err != nil {
+			return s, fmt.Errorf("invalid history age: %s", err)
+		}
+	}
+	if c.SyncTimeout != "" {
+		if s.SyncTimeout, err = time.ParseDuration(c.SyncTimeout); err != nil {
+			return s, fmt.Errorf("invalid sync timeout: %s", err)
+		}
+	}
+	return s, nil
+}
+
+// Apply makes the stored hooks match configuration c in a single transaction.
+// Hooks are created or updated and their component chains replaced. Existing
+// component instances are reused where possible, matched by ID or else by
+// name in order of appearance, the data of components that are not reused is
+// removed. If prune is true, hooks not in c are deleted.
+func (s *HookStore) Apply(c *Config, prune bool) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		seen := make(map[string]bool)
+		for _, hc := range c.Hooks {
+			if seen[hc.ID] {
+				return fmt.Errorf("hook %s: defined more than once", hc.ID)
+			}
+			seen[hc.ID] = true
+
+			if err := s.applyHook(tx, hc); err != nil {
+				return fmt.Errorf("hook %s: %s", hc.ID, err)
+			}
+		}
+
+		if !prune {
+			return nil
+		}
+
+		var stale []string
+		if err := tx.Bucket(BucketHooks).ForEach(func(k, v []byte) error {
+			if !seen[string(k)] {
+				stale = append(stale, string(k))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, id := range stale {
+			if err := deleteHook(tx, id, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *HookStore) applyHook(tx *bolt.Tx, c HookConfig) error {
+	if err := validHookID(c.ID); err != nil {
+		return err
+	}
+
+	settings, err := c.Settings.settings()
+	if err != nil {
+		return err
+	}
+	v, err := gobEncode(settings)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(BucketSettings).Put([]byte(c.ID), v); err != nil {
+		return err
+	}
+
+	h := &Hook{ID: c.ID, Settings: settings}
+	if tx.Bucket(BucketHooks).Get([]byte(c.ID)) != nil {
+		if h, err = s.components(tx, c.ID); err != nil {
+			return err
+		}
+		h.Settings = settings
+	}
+
+	used := make([]bool, len(h.Components))
+	reuse := func(cc ComponentConfig) (HookComponent, bool) {
+		for i, hc := range h.Components {
+			if !used[i] && hc.Name == cc.Name && (cc.ID == "" || cc.ID == hc.ID) {
+				used[i] = true
+				return hc, true
+			}
+		}
+		return HookComponent{}, false
+	}
+
+	hcs := make([]HookComponent, 0, len(c.Components))
+	for i, cc := range c.Components {
+		hc, err := s.applyComponent(tx, *h, cc, reuse)
+		if err != nil {
+			return fmt.Errorf("component %d (%s): %s", i+1, cc.Name, err)
+		}
+		hcs = append(hcs, hc)
+	}
+
+	// remove the data of components that are no longer in the chain
+	for i, hc := range h.Components {
+		if !used[i] {
+			if err := deleteComponent(tx, hc); err != nil {
+				return err
+			}
+		}
+	}
+	return s.putComponents(tx, c.ID, hcs)
+}
+
+func (s *HookStore) applyComponent(tx *bolt.Tx, h Hook, c ComponentConfig, reuse func(ComponentConfig) (HookComponent, bool)) (HookComponent, error) {
+	cmp, ok := components[c.Name]
+	if !ok {
+		return HookComponent{}, errors.New("unknown component")
+	}
+	if errs := unknownParams(c.Name, c.Params); len(errs) > 0 {
+		return HookComponent{}, &errs[0]
+	}
+
+	hc, ok := reuse(c)
+	if !ok {
+		id, err := tx.Bucket(BucketComponents).NextSequence()
+		if err != nil {
+			return hc, err
+		}
+		hc = HookComponent{ID: strconv.FormatUint(id, 10), Name: c.Name}
+	}
+
+	hc.Retry = RetryPolicy{}
+	if c.Retry != nil {
+		var err error
+		if hc.Retry, err = c.Retry.policy(); err != nil {
+			return hc, err
+		}
+	}
+
+	b, err := hc.createBucket(tx)
+	if err != nil {
+		return hc, err
+	}
+	params := c.Params
+	if params == nil {
+		params = make(map[string]string)
+	}
+	return hc, cmp.Init(h, params, b)
+}
+
+// Export returns the configuration of all hooks.
+func (s *HookStore) Export() (*Config, error) {
+	c := &Config{Hooks: []HookConfig{}}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BucketHooks).ForEach(func(k, v []byte) error {
+			h, err := s.components(tx, string(k))
+			if err != nil {
+				return err
+			}
+			if err := gobDecode(tx.Bucket(BucketSettings).Get(k), &h.Settings); err != nil {
+				return err
+			}
+
+			hc := HookConfig{ID: h.ID, Settings: newSettingsConfig(h.Settings), Components: []ComponentConfig{}}
+			for _, cmp := range h.Components {
+				cc := ComponentConfig{ID: cmp.ID, Name: cmp.Name}
+				if cmp.Retry.MaxAttempts > 0 {
+					cc.Retry = newRetryConfig(cmp.Retry)
+				}
+				if c, ok := components[cmp.Name]; ok {
+					if b := cmp.bucket(tx); b != nil {
+						cc.Params = c.Params(*h, b)
+					}
+				}
+				hc.Components = append(hc.Components, cc)
+			}
+			c.Hooks = append(c.Hooks, hc)
+			return nil
+		})
+	})
+	return c, err
+}
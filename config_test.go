@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		data string
+		want *Config
+	}{
+		{`{"hooks": [{"id": "foo", "settings": {"sync": true}, "components": [{"name": "log-action"}]}]}`, &Config{Hooks: []HookConfig{
+			{ID: "foo", Settings: SettingsConfig{Sync: true}, Components: []ComponentConfig{{Name: "log-action"}}},
+		}}},
+		{`{"hooks": [{"id": "foo", "setings": {"sync": true}}]}`, nil},
+		{`{"hooks": [`, nil},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "rehook.json")
+		if err := ioutil.WriteFile(path, []byte(tt.data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		c, err := loadConfig(path)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("loadConfig(%s) = %+v, want error", tt.data, c)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("loadConfig(%s): %s", tt.data, err)
+			continue
+		}
+		if !reflect.DeepEqual(c, tt.want) {
+			t.Errorf("loadConfig(%s) = %+v, want %+v", tt.data, c, tt.want)
+		}
+	}
+
+	if _, err := loadConfig(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("loadConfig of a missing file succeeded")
+	}
+}
+
+func TestApply(t *testing.T) {
+	for _, prune := range []bool{false, true} {
+		db, s, _ := testStores(t)
+		foo, ids := testHook(t, s, "foo", "a", "b")
+		testHook(t, s, "stale")
+
+		c := &Config{Hooks: []HookConfig{
+			{ID: "foo", Settings: SettingsConfig{Sync: true, HistoryAge: "1h"}, Components: []ComponentConfig{
+				{ID: ids["b"], Name: "test-action", Params: map[string]string{"name": "b2"}},
+				{Name: "log-action"},
+			}},
+			{ID: "bar", Components: []ComponentConfig{{Name: "test-action", Params: map[string]string{"name": "d"}}}},
+		}}
+		if err := s.Apply(c, prune); err != nil {
+			t.Fatalf("Apply: %s", err)
+		}
+
+		h, err := s.Find("foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := (Settings{Sync: true, Retention: Retention{Age: time.Hour}}); h.Settings != want {
+			t.Errorf("prune %t: settings = %+v, want %+v", prune, h.Settings, want)
+		}
+		if len(h.Components) != 2 || h.Components[0].ID != ids["b"] || h.Components[1].Name != "log-action" {
+			t.Fatalf("prune %t: components = %+v, want b to be kept and a log action after it", prune, h.Components)
+		}
+		if params, _ := s.ComponentParams(*h, h.Components[0]); params["name"] != "b2" {
+			t.Errorf("prune %t: params of b = %v, want the new name", prune, params)
+		}
+		db.View(func(tx *bolt.Tx) error {
+			if foo.Components[0].bucket(tx) != nil {
+				t.Errorf("prune %t: data of removed component a left behind", prune)
+			}
+			return nil
+		})
+
+		if _, err := s.Find("bar"); err != nil {
+			t.Errorf("prune %t: new hook not created: %s", prune, err)
+		}
+		if _, err := s.Find("stale"); (err == nil) == prune {
+			t.Errorf("prune %t: Find(stale) = %v", prune, err)
+		}
+	}
+}
+
+func TestApplyInvalid(t *testing.T) {
+	_, s, _ := testStores(t)
+	testHook(t, s, "foo", "a")
+	before, err := s.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []*Config{
+		{Hooks: []HookConfig{{ID: "foo"}, {ID: "foo"}}},
+		{Hooks: []HookConfig{{ID: "Foo!"}}},
+		{Hooks: []HookConfig{{ID: "bar", Settings: SettingsConfig{State: "stopped"}}}},
+		{Hooks: []HookConfig{{ID: "bar", Settings: SettingsConfig{HistoryAge: "forever"}}}},
+		{Hooks: []HookConfig{{ID: "bar", Components: []ComponentConfig{{Name: "unknown-action"}}}}},
+		{Hooks: []HookConfig{{ID: "bar", Components: []ComponentConfig{{Name: "test-action", Params: map[string]string{"unknown": "x"}}}}}},
+	}
+	for _, c := range tests {
+		if err := s.Apply(c, true); err == nil {
+			t.Errorf("Apply(%+v) succeeded", c.Hooks)
+		}
+		// nothing is changed by an invalid configuration
+		after, err := s.Export()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(after, before) {
+			t.Errorf("Apply(%+v) changed the hooks to %+v", c.Hooks, after)
+		}
+	}
+}
+
+func TestExportApply(t *testing.T) {
+	_, s, _ := testStores(t)
+	testHook(t, s, "foo", "a", "b")
+	testHook(t, s, "bar", "c")
+	if err := s.UpdateSettings("foo", Settings{Sync: true, SyncTimeout: time.Second, State: StatePaused}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := s.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Apply(c, true); err != nil {
+		t.Fatalf("Apply of the export: %s", err)
+	}
+	got, err := s.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, c) {
+		t.Errorf("export after applying it = %+v, want %+v", got, c)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// errDBClosed is returned by the transactions of a database that could not be
+// reopened after compaction.
+var errDBClosed = errors.New("database is not open")
+
+// openBolt opens the bolt database file, tests replace it to make opening fail.
+var openBolt = bolt.Open
+
+// DB is the database rehook stores everything in. It wraps a bolt database,
+// so that it can be replaced by a compacted copy while rehook is running.
+type DB struct {
+	mu         sync.RWMutex
+	bolt       *bolt.DB
+	timeout    time.Duration
+	compacting int32 // 1 while Compact is running, accessed atomically
+}
+
+// openDB opens the database at path, waiting at most timeout for another
+// process to release it, and brings it up to date.
+func openDB(path string, timeout time.Duration) (*DB, error) {
+	b, err := openBolt(path, 0600, &bolt.Options{Timeout: timeout})
+	if err != nil {
+		return nil, err
+	}
+	if err := b.Update(initBuckets); err != nil {
+		b.Close()
+		return nil, err
+	}
+	if err := b.Update(migrate); err != nil {
+		b.Close()
+		return nil, err
+	}
+	return &DB{bolt: b, timeout: timeout}, nil
+}
+
+// View executes fn in a read-only transaction. Transactions must not be
+// nested, as a pending compaction would block the inner one forever.
+func (db *DB) View(fn func(*bolt.Tx) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.bolt == nil {
+		return errDBClosed
+	}
+	return db.bolt.View(fn)
+}
+
+// Update executes fn in a read-write transaction.
+func (db *DB) Update(fn func(*bolt.Tx) error) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.bolt == nil {
+		return errDBClosed
+	}
+	return db.bolt.Update(fn)
+}
+
+// Ping returns an error if the database cannot be used right now.
+func (db *DB) Ping() error {
+	if atomic.LoadInt32(&db.compacting) == 1 {
+		return errors.New("database is being compacted")
+	}
+	return db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(BucketHooks) == nil {
+			return errors.New("database is not initialized")
+		}
+		return nil
+	})
+}
+
+// Close closes the database.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.bolt == nil {
+		return nil
+	}
+	return db.bolt.Close()
+}
+
+// DBStats describes the size of the database file.
+type DBStats struct {
+	Size int64 // size of the database file in bytes
+	Free int64 // bytes in pages that are no longer used
+}
+
+// Stats returns the size of the database file.
+func (db *DB) Stats() (s DBStats, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.bolt == nil {
+		return s, errDBClosed
+	}
+	err = db.bolt.View(func(tx *bolt.Tx) error {
+		s.Size = tx.Size()
+		return nil
+	})
+	s.Free = int64(db.bolt.Stats().FreeAlloc)
+	return s, err
+}
+
+// BoltStats returns the statistics of the bolt database, which start at zero
+// when it is opened.
+func (db *DB) BoltStats() bolt.Stats {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.bolt == nil {
+		return bolt.Stats{}
+	}
+	return db.bolt.Stats()
+}
+
+// Compact rewrites the database to a new file that contains no unused pages
+// and replaces the current file with it. Bolt never shrinks its file by
+// itself. All transactions wait until compaction has finished. If the file
+// cannot be opened again afterwards, transactions fail with errDBClosed from
+// then on.
+func (db *DB) Compact() (before, after DBStats, err error) {
+	if before, err = db.Stats(); err != nil {
+		return before, after, err
+	}
+
+	atomic.StoreInt32(&db.compacting, 1)
+	defer atomic.StoreInt32(&db.compacting, 0)
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.bolt == nil {
+		return before, after, errDBClosed
+	}
+
+	path := db.bolt.Path()
+	tmp := path + ".compact"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return before, after, err
+	}
+	dst, err := bolt.Open(tmp, 0600, nil)
+	if err != nil {
+		return before, after, err
+	}
+	err = db.bolt.View(func(src *bolt.Tx) error {
+		return dst.Update(func(tx *bolt.Tx) error {
+			return src.ForEach(func(name []byte, b *bolt.Bucket) error {
+				nb, err := tx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return compactBucket(b, nb)
+			})
+		})
+	})
+	if err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return before, after, err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return before, after, err
+	}
+
+	if err := db.bolt.Close(); err != nil {
+		return before, after, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		// keep using the old file
+		os.Remove(tmp)
+		var oerr error
+		if db.bolt, oerr = openBolt(path, 0600, &bolt.Options{Timeout: db.timeout}); oerr != nil {
+			log.Printf("error reopening database after failed compaction: %s", oerr)
+			return before, after, fmt.Errorf("%s, and reopening the database failed: %s", err, oerr)
+		}
+		return before, after, err
+	}
+	if db.bolt, err = openBolt(path, 0600, &bolt.Options{Timeout: db.timeout}); err != nil {
+		log.Printf("error reopening database after compaction: %s", err)
+		return before, after, err
+	}
+
+	err = db.bolt.View(func(tx *bolt.Tx) error {
+		after.Size = tx.Size()
+		return nil
+	})
+	return before, after, err
+}
+
+// compactBucket copies the contents of bucket src to dst, including nested
+// buckets and sequences. Keys are copied in order, so pages are filled up
+// completely.
+func compactBucket(src, dst *bolt.Bucket) error {
+	dst.FillPercent = 1.0
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+		nb, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return compactBucket(src.Bucket(k), nb)
+	})
+}
+
+// bucketKeys returns the keys of bucket b for which fn returns true. Bolt does
+// not allow changing a bucket while iterating over it, so callers collect the
+// keys first and change the bucket afterwards. The keys are copied, since those
+// passed to fn are only valid during the iteration.
+func bucketKeys(b *bolt.Bucket, fn func(k, v []byte) (bool, error)) (keys [][]byte, err error) {
+	err = b.ForEach(func(k, v []byte) error {
+		ok, err := fn(k, v)
+		if ok {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		return err
+	})
+	return keys, err
+}
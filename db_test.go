@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestBucketKeys(t *testing.T) {
+	db := testDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BucketSettings)
+		for _, k := range []string{"a", "b", "c", "d"} {
+			if err := b.Put([]byte(k), []byte(k)); err != nil {
+				return err
+			}
+		}
+
+		keys, err := bucketKeys(b, func(k, v []byte) (bool, error) { return string(v) != "b", nil })
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		errStop := errors.New("stop")
+		if _, err := bucketKeys(b, func(k, v []byte) (bool, error) { return true, errStop }); err != errStop {
+			t.Errorf("bucketKeys returned %v, want the error of fn", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BucketSettings).ForEach(func(k, v []byte) error {
+			got = append(got, string(k))
+			return nil
+		})
+	})
+	if want := []string{"b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keys left = %q, want %q", got, want)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	db := testDB(t)
+	s := &HookStore{db}
+	h, ids := testHook(t, s, "hook", "a", "b")
+
+	// create free pages by removing a lot of data
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("garbage"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 1000; i++ {
+			if err := b.Put(itob(uint64(i)), make([]byte, 1024)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error { return tx.DeleteBucket([]byte("garbage")) }); err != nil {
+		t.Fatal(err)
+	}
+
+	before, after, err := db.Compact()
+	if err != nil {
+		t.Fatalf("Compact: %s", err)
+	}
+	if after.Size >= before.Size {
+		t.Errorf("Compact did not shrink the database: %d bytes before, %d after", before.Size, after.Size)
+	}
+	if err := db.Ping(); err != nil {
+		t.Errorf("Ping after Compact: %s", err)
+	}
+
+	got, err := s.Find(h.ID)
+	if err != nil {
+		t.Fatalf("Find after Compact: %s", err)
+	}
+	if !reflect.DeepEqual(got.Components, h.Components) {
+		t.Errorf("components after Compact = %+v, want %+v", got.Components, h.Components)
+	}
+	id, err := s.AddComponent(*got, HookComponent{Name: "test-action"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, _ := strconv.ParseUint(ids["b"], 10, 64)
+	if n, err := strconv.ParseUint(id, 10, 64); err != nil || n <= last {
+		t.Errorf("component id after Compact = %s, want sequence to continue after %s", id, ids["b"])
+	}
+}
+
+func TestCompactReopenFails(t *testing.T) {
+	db := testDB(t)
+	errOpen := errors.New("open failed")
+	openBolt = func(path string, mode os.FileMode, options *bolt.Options) (*bolt.DB, error) {
+		return nil, errOpen
+	}
+	defer func() { openBolt = bolt.Open }()
+
+	if _, _, err := db.Compact(); err != errOpen {
+		t.Fatalf("Compact = %v, want %v", err, errOpen)
+	}
+
+	// the database is unusable, but does not bring the process down
+	if err := db.View(func(tx *bolt.Tx) error { return nil }); err != errDBClosed {
+		t.Errorf("View = %v, want %v", err, errDBClosed)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error { return nil }); err != errDBClosed {
+		t.Errorf("Update = %v, want %v", err, errDBClosed)
+	}
+	if err := db.Ping(); err == nil {
+		t.Error("Ping succeeded after the database could not be reopened")
+	}
+	if _, err := db.Stats(); err != errDBClosed {
+		t.Errorf("Stats = %v, want %v", err, errDBClosed)
+	}
+	if _, _, err := db.Compact(); err != errDBClosed {
+		t.Errorf("second Compact = %v, want %v", err, errDBClosed)
+	}
+	if _, err := (&HookStore{db}).Find("hook"); err == nil {
+		t.Error("Find succeeded after the database could not be reopened")
+	}
+	if err := db.Close(); err != nil {
+		t.Errorf("Close = %v", err)
+	}
+}
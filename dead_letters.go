@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// DeadLetter is a delivery whose processing failed after all attempts.
+type DeadLetter struct {
+	ID        uint64        // identifier of the failed delivery
+	Hook      string        // hook identifier
+	Request   Request       // the incoming request
+	Component HookComponent // the component that failed
+	Error     string        // error returned by the failed component
+	Attempts  int           // number of attempts made
+	Received  time.Time     // time the request was received
+	Failed    time.Time     // time of the last failed attempt
+}
+
+// Bury removes delivery d from the queue and stores it as a dead letter for
+// component hc, which failed with err. If the hook of d was deleted in the
+// meantime, d is only removed.
+func (q *Queue) Bury(d *Delivery, hc HookComponent, err error) error {
+	dl := DeadLetter{
+		ID:        d.ID,
+		Hook:      d.Hook,
+		Request:   d.Request,
+		Component: hc,
+		Error:     err.Error(),
+		Attempts:  d.Attempts,
+		Received:  d.Received,
+		Failed:    time.Now(),
+	}
+
+	return q.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(BucketHooks).Get([]byte(d.Hook)) == nil {
+			return tx.Bucket(BucketQueue).Delete(itob(d.ID))
+		}
+		b, err := tx.Bucket(BucketDeadLetters).CreateBucketIfNotExists([]byte(d.Hook))
+		if err != nil {
+			return err
+		}
+		v, err := gobEncode(dl)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(itob(dl.ID), v); err != nil {
+			return err
+		}
+		if err := q.record(tx, d, StatusFailed); err != nil {
+			return err
+		}
+		return tx.Bucket(BucketQueue).Delete(itob(d.ID))
+	})
+}
+
+// DeadLetters returns the dead letters of the given hook, most recent first.
+func (q *Queue) DeadLetters(hook string) (dls []DeadLetter, err error) {
+	err = q.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BucketDeadLetters).Bucket([]byte(hook))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var dl DeadLetter
+			if err := gobDecode(v, &dl); err != nil {
+				return err
+			}
+			dls = append(dls, dl)
+		}
+		return nil
+	})
+	return dls, err
+}
+
+// DeadLetter returns the dead letter with the given id for hook.
+func (q *Queue) DeadLetter(hook string, id uint64) (dl *DeadLetter, err error) {
+	err = q.db.View(func(tx *bolt.Tx) error {
+		v := deadLetterGet(tx, hook, id)
+		if v == nil {
+			return errors.New("dead letter does not exist")
+		}
+		dl = &DeadLetter{}
+		return gobDecode(v, dl)
+	})
+	return dl, err
+}
+
+// DeleteDeadLetter deletes the dead letter with the given id for hook.
+func (q *Queue) DeleteDeadLetter(hook string, id uint64) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		if deadLetterGet(tx, hook, id) == nil {
+			return errors.New("dead letter does not exist")
+		}
+		return tx.Bucket(BucketDeadLetters).Bucket([]byte(hook)).Delete(itob(id))
+	})
+}
+
+// Redrive moves the dead letter with the given id for hook back into the
+// queue. If resume is true processing continues at the component that failed,
+// otherwise the request passes through the entire chain again.
+func (q *Queue) Redrive(hook string, id uint64, resume bool) error {
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		v := deadLetterGet(tx, hook, id)
+		if v == nil {
+			return errors.New("dead letter does not exist")
+		}
+		var dl DeadLetter
+		if err := gobDecode(v, &dl); err != nil {
+			return err
+		}
+
+		qid, err := tx.Bucket(BucketQueue).NextSequence()
+		if err != nil {
+			return err
+		}
+		d := &Delivery{ID: qid, Hook: dl.Hook, Request: dl.Request, Received: dl.Received}
+		if resume {
+			h := Hook{ID: dl.Hook}
+			if err := gobDecode(tx.Bucket(BucketHooks).Get([]byte(dl.Hook)), &h.Components); err != nil {
+				return err
+			}
+			if h.component(dl.Component.ID) < 0 {
+				return errors.New("the failed component is no longer part of the hook")
+			}
+			d.Next = dl.Component.ID
+		}
+		if err := q.put(tx, d); err != nil {
+			return err
+		}
+		return tx.Bucket(BucketDeadLetters).Bucket([]byte(hook)).Delete(itob(id))
+	})
+	if err == nil {
+		q.notify()
+	}
+	return err
+}
+
+func deadLetterGet(tx *bolt.Tx, hook string, id uint64) []byte {
+	b := tx.Bucket(BucketDeadLetters).Bucket([]byte(hook))
+	if b == nil {
+		return nil
+	}
+	return b.Get(itob(id))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestRedrive(t *testing.T) {
+	tests := []struct {
+		name   string
+		resume bool
+		change func(s *HookStore, h *Hook, ids map[string]string) error
+		err    bool
+		want   []string // components run after redriving
+	}{
+		{
+			name: "from the start",
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name:   "resume",
+			resume: true,
+			want:   []string{"b", "c"},
+		},
+		{
+			name:   "resume after reorder",
+			resume: true,
+			change: func(s *HookStore, h *Hook, ids map[string]string) error {
+				return s.ReorderComponents(h.ID, []string{ids["b"], ids["c"], ids["a"]})
+			},
+			want: []string{"b", "c", "a"},
+		},
+		{
+			name:   "resume after removing an earlier component",
+			resume: true,
+			change: func(s *HookStore, h *Hook, ids map[string]string) error {
+				return s.DeleteComponent(*h, ids["a"])
+			},
+			want: []string{"b", "c"},
+		},
+		{
+			name:   "resume after removing the failed component",
+			resume: true,
+			change: func(s *HookStore, h *Hook, ids map[string]string) error {
+				return s.DeleteComponent(*h, ids["b"])
+			},
+			err: true,
+		},
+		{
+			name: "restart after removing the failed component",
+			change: func(s *HookStore, h *Hook, ids map[string]string) error {
+				return s.DeleteComponent(*h, ids["b"])
+			},
+			want: []string{"a", "c"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, s, q := testStores(t)
+			hh := &HookHandler{s, db, q}
+			h, ids := testHook(t, s, "hook", "a", "b", "c")
+
+			// fail at b until the delivery is buried
+			processed, failing = nil, map[string]bool{"b": true}
+			d := &Delivery{Hook: h.ID}
+			if err := q.Push(d); err != nil {
+				t.Fatal(err)
+			}
+			for hh.processRequest(d).Status == StatusPending {
+			}
+			dls, err := q.DeadLetters(h.ID)
+			if err != nil || len(dls) != 1 {
+				t.Fatalf("DeadLetters = %+v, %v, want one dead letter", dls, err)
+			}
+
+			if tt.change != nil {
+				h, _ = s.Find(h.ID)
+				if err := tt.change(s, h, ids); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = q.Redrive(h.ID, dls[0].ID, tt.resume)
+			if tt.err {
+				if err == nil {
+					t.Fatal("Redrive succeeded, want error")
+				}
+				if dls, _ := q.DeadLetters(h.ID); len(dls) != 1 {
+					t.Errorf("dead letter removed after failed redrive")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Redrive: %s", err)
+			}
+
+			var ds []*Delivery
+			db.View(func(tx *bolt.Tx) error {
+				return tx.Bucket(BucketQueue).ForEach(func(k, v []byte) error {
+					d := &Delivery{}
+					ds = append(ds, d)
+					return gobDecode(v, d)
+				})
+			})
+			if len(ds) != 1 {
+				t.Fatalf("queued %d deliveries after redrive, want 1", len(ds))
+			}
+
+			processed, failing = nil, nil
+			if res := hh.processRequest(ds[0]); res.Status != StatusDone {
+				t.Errorf("status = %q, want %q", res.Status, StatusDone)
+			}
+			if !reflect.DeepEqual(processed, tt.want) {
+				t.Errorf("processed %q, want %q", processed, tt.want)
+			}
+			if dls, _ := q.DeadLetters(h.ID); len(dls) != 0 {
+				t.Errorf("%d dead letters left after redrive, want 0", len(dls))
+			}
+		})
+	}
+}
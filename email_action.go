@@ -28,12 +28,16 @@ func (EmailAction) Name() string { return "Send email (using Mailgun)" }
 // Template returns the HTML template name of this component.
 func (EmailAction) Template() string { return "email-action" }
 
-// Params returns the currently stored configuration parameters for hook h
-// from bucket b.
-func (EmailAction) Params(h Hook, b *bolt.Bucket) map[string]string {
+// Parameters returns the names of the configuration parameters.
+func (EmailAction) Parameters() []string {
+	return []string{"token", "domain", "address", "subject", "template"}
+}
+
+// Params returns the currently stored configuration parameters from bucket b.
+func (c EmailAction) Params(h Hook, b *bolt.Bucket) map[string]string {
 	m := make(map[string]string)
-	for _, k := range []string{"token", "domain", "address", "subject", "template"} {
-		m[k] = string(b.Get([]byte(fmt.Sprintf("%s-%s", h.ID, k))))
+	for _, k := range c.Parameters() {
+		m[k] = string(b.Get([]byte(k)))
 	}
 	return m
 }
@@ -44,61 +48,63 @@ func (EmailAction) Init(h Hook, params map[string]string, b *bolt.Bucket) error
 	// TODO: refactor the following
 	token, ok := params["token"]
 	if !ok {
-		return errors.New("token is required")
+		return invalidParam("token", "token is required")
 	}
 
 	domain, ok := params["domain"]
 	if !ok {
-		return errors.New("domain is required")
+		return invalidParam("domain", "domain is required")
 	}
 
 	address, ok := params["address"]
 	if !ok {
-		return errors.New("address is required")
+		return invalidParam("address", "address is required")
 	}
 
 	subject, ok := params["subject"]
 	if !ok {
-		return errors.New("subject is required")
+		return invalidParam("subject", "subject is required")
 	}
 
 	tpl, ok := params["template"]
 	if !ok {
-		return errors.New("template is required")
+		return invalidParam("template", "template is required")
 	}
 
 	if _, err := template.New("email").Parse(string(tpl)); err != nil {
-		return fmt.Errorf("invalid template: %s", err)
+		return invalidParam("template", "invalid template: %s", err)
 	}
 
-	if err := b.Put([]byte(fmt.Sprintf("%s-token", h.ID)), []byte(token)); err != nil {
+	if err := b.Put([]byte("token"), []byte(token)); err != nil {
 		return err
 	}
-	if err := b.Put([]byte(fmt.Sprintf("%s-domain", h.ID)), []byte(domain)); err != nil {
+	if err := b.Put([]byte("domain"), []byte(domain)); err != nil {
 		return err
 	}
-	if err := b.Put([]byte(fmt.Sprintf("%s-address", h.ID)), []byte(address)); err != nil {
+	if err := b.Put([]byte("address"), []byte(address)); err != nil {
 		return err
 	}
-	if err := b.Put([]byte(fmt.Sprintf("%s-subject", h.ID)), []byte(subject)); err != nil {
+	if err := b.Put([]byte("subject"), []byte(subject)); err != nil {
 		return err
 	}
-	return b.Put([]byte(fmt.Sprintf("%s-template", h.ID)), []byte(tpl))
+	return b.Put([]byte("template"), []byte(tpl))
+}
+
+// Process sends an email using the params stored in bucket b.
+func (c EmailAction) Process(h Hook, r Request, b *bolt.Bucket) error {
+	return c.Send(h, r, c.Params(h, b))
 }
 
-// Process sends an email to the configured address using the template as email
+// Send sends an email to the configured address using the template as email
 // body.
-func (EmailAction) Process(h Hook, r Request, b *bolt.Bucket) error {
-	token := b.Get([]byte(fmt.Sprintf("%s-token", h.ID)))
-	domain := b.Get([]byte(fmt.Sprintf("%s-domain", h.ID)))
-	address := b.Get([]byte(fmt.Sprintf("%s-address", h.ID)))
-	subject := b.Get([]byte(fmt.Sprintf("%s-subject", h.ID)))
-	tpl := b.Get([]byte(fmt.Sprintf("%s-template", h.ID)))
-	if token == nil || domain == nil || address == nil || subject == nil || tpl == nil {
+func (EmailAction) Send(h Hook, r Request, params map[string]string) error {
+	token, domain, address := params["token"], params["domain"], params["address"]
+	subject, tpl := params["subject"], params["template"]
+	if token == "" || domain == "" || address == "" {
 		return errors.New("email action not initialized")
 	}
 
-	t, err := template.New("email").Parse(string(tpl))
+	t, err := template.New("email").Parse(tpl)
 	if err != nil {
 		return fmt.Errorf("could not parse template: %s", err)
 	}
@@ -112,7 +118,10 @@ func (EmailAction) Process(h Hook, r Request, b *bolt.Bucket) error {
 	if err = t.Execute(&buf, data); err != nil {
 		return fmt.Errorf("could not execute template: %s", err)
 	}
-	return sendMail(string(token), string(domain), string(address), string(subject), buf.String())
+	if err := sendMail(token, domain, address, subject, buf.String()); err != nil {
+		return &UpstreamError{err}
+	}
+	return nil
 }
 
 func sendMail(token, domain, address, subject, text string) error {
@@ -131,7 +140,7 @@ func sendMail(token, domain, address, subject, text string) error {
 	req.Header.Set("User-Agent", UserAgent)
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := upstreamClient().Do(req)
 	if err != nil {
 		return err
 	}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"errors"
-	"fmt"
 	"log"
 	"os/exec"
 
@@ -23,12 +22,19 @@ func (ExecuteAction) Name() string { return "Execute Command" }
 // Template returns the HTML template name of this component.
 func (ExecuteAction) Template() string { return "execute-action" }
 
-// Params returns the currently stored configuration parameters for hook h
-// from bucket b.
-func (ExecuteAction) Params(h Hook, b *bolt.Bucket) map[string]string {
+// Privileged returns true, running commands requires admin access.
+func (ExecuteAction) Privileged() bool { return true }
+
+// Parameters returns the names of the configuration parameters.
+func (ExecuteAction) Parameters() []string {
+	return []string{"command"}
+}
+
+// Params returns the currently stored configuration parameters from bucket b.
+func (c ExecuteAction) Params(h Hook, b *bolt.Bucket) map[string]string {
 	m := make(map[string]string)
-	for _, k := range []string{"command"} {
-		m[k] = string(b.Get([]byte(fmt.Sprintf("%s-%s", h.ID, k))))
+	for _, k := range c.Parameters() {
+		m[k] = string(b.Get([]byte(k)))
 	}
 	return m
 }
@@ -37,20 +43,25 @@ func (ExecuteAction) Params(h Hook, b *bolt.Bucket) map[string]string {
 func (ExecuteAction) Init(h Hook, params map[string]string, b *bolt.Bucket) error {
 	command, ok := params["command"]
 	if !ok {
-		return errors.New("command is required")
+		return invalidParam("command", "command is required")
 	}
 
-	return b.Put([]byte(fmt.Sprintf("%s-command", h.ID)), []byte(command))
+	return b.Put([]byte("command"), []byte(command))
+}
+
+// Process executes the command stored in bucket b.
+func (c ExecuteAction) Process(h Hook, r Request, b *bolt.Bucket) error {
+	return c.Send(h, r, c.Params(h, b))
 }
 
-// Process executes command and logs the output and errors
-func (ExecuteAction) Process(h Hook, r Request, b *bolt.Bucket) error {
-	command := b.Get([]byte(fmt.Sprintf("%s-command", h.ID)))
-	if command == nil {
-		return errors.New("forward request action not initialized")
+// Send executes command and logs the output and errors
+func (ExecuteAction) Send(h Hook, r Request, params map[string]string) error {
+	command := params["command"]
+	if command == "" {
+		return errors.New("execute action not initialized")
 	}
 
-	out, err := exec.Command("sh", "-c", string(command)).CombinedOutput()
+	out, err := exec.Command("sh", "-c", command).CombinedOutput()
 	log.Printf("[command-action][%s] executing command: %s\n --- STARTOUTPUT --- \n %s \n --- ENDOUTPUT ---", h.ID, command, out)
 	if err != nil {
 		log.Printf("[command-action][%s] error: %s", h.ID, err)
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func init() {
+	RegisterComponent("test-action", testAction{})
+}
+
+// testAction is a component that records the name of every instance that
+// processes a request in processed, and fails if its name is in failing.
+type testAction struct{}
+
+var (
+	processed []string
+	failing   = make(map[string]bool)
+)
+
+func (testAction) Name() string         { return "Test" }
+func (testAction) Template() string     { return "" }
+func (testAction) Parameters() []string { return []string{"name"} }
+
+func (testAction) Params(h Hook, b *bolt.Bucket) map[string]string {
+	return map[string]string{"name": string(b.Get([]byte("name")))}
+}
+
+func (testAction) Init(h Hook, params map[string]string, b *bolt.Bucket) error {
+	return b.Put([]byte("name"), []byte(params["name"]))
+}
+
+func (testAction) Process(h Hook, r Request, b *bolt.Bucket) error {
+	name := string(b.Get([]byte("name")))
+	processed = append(processed, name)
+	if failing[name] {
+		return errors.New(name + " failed")
+	}
+	return nil
+}
+
+// testHook creates hook id with a test action for every name, which are
+// retried up to 3 times, and returns it with the ids of its components by
+// name.
+func testHook(t *testing.T, s *HookStore, id string, names ...string) (*Hook, map[string]string) {
+	t.Helper()
+	if err := s.Create(Hook{ID: id}); err != nil {
+		t.Fatalf("Create: %s", err)
+	}
+	ids := make(map[string]string)
+	for _, name := range names {
+		h, err := s.Find(id)
+		if err != nil {
+			t.Fatalf("Find: %s", err)
+		}
+		hc := HookComponent{Name: "test-action", Retry: RetryPolicy{MaxAttempts: 3}}
+		if ids[name], err = s.AddComponent(*h, hc, map[string]string{"name": name}); err != nil {
+			t.Fatalf("AddComponent: %s", err)
+		}
+	}
+	h, err := s.Find(id)
+	if err != nil {
+		t.Fatalf("Find: %s", err)
+	}
+	return h, ids
+}
+
+// queued returns delivery id as stored in the queue, or nil if it is not
+// queued.
+func queued(t *testing.T, db *DB, id uint64) (d *Delivery) {
+	t.Helper()
+	err := db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(BucketQueue).Get(itob(id))
+		if v == nil {
+			return nil
+		}
+		d = &Delivery{}
+		return gobDecode(v, d)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// testDB returns a new database in a temporary directory that is closed when
+// the test finishes.
+func testDB(t *testing.T) *DB {
+	t.Helper()
+	db, err := openDB(filepath.Join(t.TempDir(), "rehook.db"), time.Second)
+	if err != nil {
+		t.Fatalf("openDB: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// testStores returns a new database with the hook store and queue that use
+// it.
+func testStores(t *testing.T) (*DB, *HookStore, *Queue) {
+	t.Helper()
+	db := testDB(t)
+	return db, &HookStore{db}, NewQueue(db)
+}
@@ -6,6 +6,9 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"path"
+	"strconv"
+	"strings"
 
 	"github.com/boltdb/bolt"
 )
@@ -25,66 +28,152 @@ func (ForwardRequestAction) Name() string { return "Forward request" }
 // Template returns the HTML template name of this component.
 func (ForwardRequestAction) Template() string { return "request-forward-action" }
 
-// Params returns the currently stored configuration parameters for hook h
-// from bucket b.
-func (ForwardRequestAction) Params(h Hook, b *bolt.Bucket) map[string]string {
+// Parameters returns the names of the configuration parameters.
+func (ForwardRequestAction) Parameters() []string {
+	return []string{"url", "passthrough"}
+}
+
+// Params returns the currently stored configuration parameters from bucket b.
+func (c ForwardRequestAction) Params(h Hook, b *bolt.Bucket) map[string]string {
 	m := make(map[string]string)
-	for _, k := range []string{"url"} {
-		m[k] = string(b.Get([]byte(fmt.Sprintf("%s-%s", h.ID, k))))
+	for _, k := range c.Parameters() {
+		m[k] = string(b.Get([]byte(k)))
 	}
 	return m
 }
 
 // Init initializes this component. It requires a valid url parameter to be
-// present.
+// present. The optional passthrough parameter enables appending the path and
+// query string of the incoming request to the url.
 func (ForwardRequestAction) Init(h Hook, params map[string]string, b *bolt.Bucket) error {
 	uri, ok := params["url"]
 	if !ok {
-		return errors.New("url is required")
+		return invalidParam("url", "url is required")
 	}
 
 	if _, err := url.Parse(uri); err != nil {
-		return fmt.Errorf("url is not valid: %s", err)
+		return invalidParam("url", "url is not valid: %s", err)
+	}
+
+	var passthrough bool
+	if v := params["passthrough"]; v != "" {
+		var err error
+		if passthrough, err = strconv.ParseBool(v); err != nil {
+			return invalidParam("passthrough", "passthrough must be true or false")
+		}
+	}
+
+	if err := b.Put([]byte("url"), []byte(uri)); err != nil {
+		return err
 	}
+	return b.Put([]byte("passthrough"), []byte(strconv.FormatBool(passthrough)))
+}
+
+// hopHeaders are connection specific headers that are not forwarded.
+var hopHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
 
-	return b.Put([]byte(fmt.Sprintf("%s-url", h.ID)), []byte(uri))
+// Process forwards the incoming request using the params stored in bucket b.
+func (c ForwardRequestAction) Process(h Hook, r Request, b *bolt.Bucket) error {
+	return c.Send(h, r, c.Params(h, b))
 }
 
-// Process forwards the incoming request to the configured URL.
-func (ForwardRequestAction) Process(h Hook, r Request, b *bolt.Bucket) error {
-	uri := b.Get([]byte(fmt.Sprintf("%s-url", h.ID)))
-	if uri == nil {
+// Send forwards the incoming request to the configured URL. If passthrough is
+// enabled, the path and query string following the hook URL are appended to
+// the configured URL. All headers are copied except those specific to the
+// incoming connection.
+func (ForwardRequestAction) Send(h Hook, r Request, params map[string]string) error {
+	target := params["url"]
+	if target == "" {
 		return errors.New("forward request action not initialized")
 	}
 
-	req, err := http.NewRequest(r.Method, string(uri), bytes.NewReader(r.Body))
+	if params["passthrough"] == "true" {
+		var err error
+		if target, err = forwardURL(target, r); err != nil {
+			return fmt.Errorf("could not create forward url: %s", err)
+		}
+	}
+
+	req, err := http.NewRequest(r.Method, target, bytes.NewReader(r.Body))
 	if err != nil {
 		return fmt.Errorf("could not create new request: %s", err)
 	}
 
-	for k, v := range r.Headers {
+	for k, vs := range r.AllHeaders() {
 		// special handling for some headers
-		switch k {
-		case "Connection":
+		switch {
+		case hopHeaders[k], k == "X-Forwarded-For":
 			// skip
 			continue
-		case "User-Agent":
+		case k == "User-Agent":
 			// rename header, we will set our own user agent
 			k = "X-Forwarded-User-Agent"
 		}
-		req.Header.Set(k, v)
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
 	}
 
 	req.Header.Set("User-Agent", UserAgent)
 
-	resp, err := http.DefaultClient.Do(req)
+	// let the target know where the request originally came from
+	if ip := r.RemoteIP(); ip != "" {
+		req.Header.Set("X-Forwarded-For", strings.Join(append(r.ForwardedFor, ip), ", "))
+	}
+	if r.Host != "" && req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", r.Host)
+	}
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		if r.TLS != nil {
+			req.Header.Set("X-Forwarded-Proto", "https")
+		} else {
+			req.Header.Set("X-Forwarded-Proto", "http")
+		}
+	}
+
+	resp, err := upstreamClient().Do(req)
 	if err != nil {
-		return fmt.Errorf("request forward error: %s", err)
+		return &UpstreamError{fmt.Errorf("request forward error: %s", err)}
 	}
 	defer resp.Body.Close()
+	forwardResponses.inc(h.ID, strconv.Itoa(resp.StatusCode))
 
 	if resp.StatusCode >= 300 {
-		return fmt.Errorf("request forward unexpected status code received: %d", resp.StatusCode)
+		return &UpstreamError{fmt.Errorf("request forward unexpected status code received: %d", resp.StatusCode)}
 	}
 	return nil
 }
+
+// forwardURL returns the configured uri extended with the path and query
+// string of request r. The path is cleaned first, so dot-dot segments cannot
+// reach outside the configured path.
+func forwardURL(uri string, r Request) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+	if p := path.Clean("/" + r.Path); p != "/" {
+		if strings.HasSuffix(r.Path, "/") {
+			p += "/"
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/") + p
+		u.RawPath = ""
+	}
+	if r.RawQuery != "" {
+		if u.RawQuery != "" {
+			u.RawQuery += "&"
+		}
+		u.RawQuery += r.RawQuery
+	}
+	return u.String(), nil
+}
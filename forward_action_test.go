@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestForwardURL(t *testing.T) {
+	tests := []struct {
+		uri   string
+		path  string
+		query string
+		want  string
+	}{
+		{"http://example.com/hook", "", "", "http://example.com/hook"},
+		{"http://example.com/hook", "/", "", "http://example.com/hook"},
+		{"http://example.com/hook", "/a/b", "", "http://example.com/hook/a/b"},
+		{"http://example.com/hook/", "/a/b/", "", "http://example.com/hook/a/b/"},
+		{"http://example.com/hook", "/a/../b", "", "http://example.com/hook/b"},
+		{"http://example.com/hook", "/../../admin", "", "http://example.com/hook/admin"},
+		{"http://example.com/hook", "/..", "", "http://example.com/hook"},
+		{"http://example.com/hook", "/a b", "", "http://example.com/hook/a%20b"},
+		{"http://example.com/hook", "", "x=1", "http://example.com/hook?x=1"},
+		{"http://example.com/hook?token=s", "/a", "x=1", "http://example.com/hook/a?token=s&x=1"},
+	}
+	for _, tt := range tests {
+		got, err := forwardURL(tt.uri, Request{Path: tt.path, RawQuery: tt.query})
+		if err != nil {
+			t.Errorf("forwardURL(%q, %q, %q) returned error: %s", tt.uri, tt.path, tt.query, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("forwardURL(%q, %q, %q) = %q, want %q", tt.uri, tt.path, tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestForwardRequestActionPassthrough(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.RequestURI()
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		passthrough string
+		want        string
+		err         bool
+	}{
+		{"", "/hook", false},
+		{"false", "/hook", false},
+		{"true", "/hook/a?x=1", false},
+		{"maybe", "", true},
+	}
+	db := testDB(t)
+	for _, tt := range tests {
+		got = ""
+		r := Request{Method: "POST", Path: "/a", RawQuery: "x=1"}
+		err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucketIfNotExists([]byte("forward-test"))
+			if err != nil {
+				return err
+			}
+			params := map[string]string{"url": srv.URL + "/hook", "passthrough": tt.passthrough}
+			if err := (ForwardRequestAction{}).Init(Hook{}, params, b); err != nil {
+				return err
+			}
+			return ForwardRequestAction{}.Process(Hook{ID: "hook"}, r, b)
+		})
+		if tt.err {
+			if err == nil {
+				t.Errorf("passthrough %q: no error, want invalid param", tt.passthrough)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("passthrough %q: %s", tt.passthrough, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("passthrough %q: forwarded to %q, want %q", tt.passthrough, got, tt.want)
+		}
+	}
+}
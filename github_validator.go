@@ -6,7 +6,8 @@ import (
 	"crypto/sha1"
 	"encoding/hex"
 	"errors"
-	"fmt"
+	"net/http"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
@@ -26,33 +27,37 @@ func (GithubValidator) Name() string { return "Github validator" }
 // Template returns the HTML template name of this component.
 func (GithubValidator) Template() string { return "github-validator" }
 
-// Params returns the currently stored configuration parameters for hook h
-// from bucket b.
-func (GithubValidator) Params(h Hook, b *bolt.Bucket) map[string]string {
+// Parameters returns the names of the configuration parameters.
+func (GithubValidator) Parameters() []string {
+	return []string{"secret", "retention"}
+}
+
+// Params returns the currently stored configuration parameters from bucket b.
+func (c GithubValidator) Params(h Hook, b *bolt.Bucket) map[string]string {
 	m := make(map[string]string)
-	for _, k := range []string{"secret"} {
-		m[k] = string(b.Get([]byte(fmt.Sprintf("%s-%s", h.ID, k))))
+	for _, k := range c.Parameters() {
+		m[k] = string(b.Get([]byte(k)))
 	}
 	return m
 }
 
-// Init initializes this component. It requires a secret to be present.
+// Init initializes this component. It requires a secret to be present, the
+// retention of delivery identifiers is optional.
 func (GithubValidator) Init(h Hook, params map[string]string, b *bolt.Bucket) error {
 	secret, ok := params["secret"]
 	if !ok {
-		return errors.New("secret is required")
+		return invalidParam("secret", "secret is required")
 	}
-	if err := b.Put([]byte(fmt.Sprintf("%s-secret", h.ID)), []byte(secret)); err != nil {
+	if err := b.Put([]byte("secret"), []byte(secret)); err != nil {
 		return err
 	}
-	_, err := b.CreateBucketIfNotExists([]byte("deliveries"))
-	return err
+	return initReplayProtection(params, b, "deliveries")
 }
 
 // Process verifies the signature and uniqueness of the delivery identifier.
 func (GithubValidator) Process(h Hook, r Request, b *bolt.Bucket) error {
 	// Check HMAC
-	secret := b.Get([]byte(fmt.Sprintf("%s-secret", h.ID)))
+	secret := b.Get([]byte("secret"))
 	if secret == nil {
 		return errors.New("github validator not initialized")
 	}
@@ -62,14 +67,25 @@ func (GithubValidator) Process(h Hook, r Request, b *bolt.Bucket) error {
 	mac.Write(bytes.TrimSpace(r.Body))
 	expected := append([]byte("sha1="), hex.EncodeToString(mac.Sum(nil))...)
 	if !hmac.Equal(signature, expected) {
-		return errors.New("invalid signature")
+		return FilterStatus(http.StatusUnauthorized, "invalid signature")
 	}
 
 	// Check uniqueness
 	id := []byte(r.Headers["X-Github-Delivery"])
-	deliveries := b.Bucket([]byte("deliveries"))
-	if did := deliveries.Get([]byte(id)); did != nil {
-		return errors.New("duplicate delivery")
+	dup, err := seen(b, "deliveries", id, time.Now(), replayRetention(b, 0))
+	if err != nil {
+		return err
 	}
-	return deliveries.Put([]byte(id), []byte{})
+	if dup {
+		return Filter("duplicate delivery")
+	}
+	return nil
+}
+
+// Expire removes delivery identifiers older than the retention period. GitHub
+// does not sign the time of a delivery, so a replayed delivery can only be
+// recognized by its identifier. They are kept forever unless a retention is
+// configured.
+func (GithubValidator) Expire(h Hook, b *bolt.Bucket, now time.Time) (int, error) {
+	return expireSeen(b, "deliveries", now, replayRetention(b, 0))
 }
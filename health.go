@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// HealthHandler serves the health and readiness checks used by load balancers
+// and process supervisors. They are available without authentication on both
+// the public and the admin listener.
+type HealthHandler struct {
+	db         *DB
+	queue      *Queue
+	maxBacklog int // maximum number of queued requests of active hooks, 0 disables the check
+}
+
+// healthResponse is the JSON response of the health checks.
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+// healthCheck is the outcome of a single readiness check.
+type healthCheck struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+const (
+	healthOK          = "ok"
+	healthUnavailable = "unavailable"
+)
+
+// Health responds with 200 OK as long as the process is able to handle
+// requests.
+func (h *HealthHandler) Health(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	writeJSON(w, http.StatusOK, healthResponse{Status: healthOK})
+}
+
+// Ready responds with 200 OK if the database can be used, the queue workers
+// are running and the backlog of active hooks is below the maximum, and with
+// 503 Service Unavailable otherwise.
+func (h *HealthHandler) Ready(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	resp := healthResponse{Status: healthOK, Checks: make(map[string]healthCheck)}
+	check := func(name, detail string, err error) {
+		c := healthCheck{Status: healthOK, Detail: detail}
+		if err != nil {
+			c = healthCheck{Status: healthUnavailable, Detail: err.Error()}
+			resp.Status = healthUnavailable
+		}
+		resp.Checks[name] = c
+	}
+
+	check("database", "", h.db.Ping())
+
+	var err error
+	n := h.queue.Workers()
+	if n == 0 {
+		err = errors.New("no queue workers running")
+	}
+	check("workers", fmt.Sprintf("%d running", n), err)
+
+	backlog, err := h.queue.Backlog(h.maxBacklog)
+	detail := fmt.Sprintf("%d queued", backlog)
+	if err == nil && h.maxBacklog > 0 {
+		if backlog > h.maxBacklog {
+			err = fmt.Errorf("more than %d queued", h.maxBacklog)
+		} else {
+			detail += fmt.Sprintf(", maximum %d", h.maxBacklog)
+		}
+	}
+	check("backlog", detail, err)
+
+	status := http.StatusOK
+	if resp.Status != healthOK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, resp)
+}
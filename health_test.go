@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// healthStatus calls handler and returns the status code and decoded response.
+func healthStatus(t *testing.T, handler func(http.ResponseWriter, *http.Request, httprouter.Params)) (int, healthResponse) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/readyz", nil), nil)
+	var resp healthResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("invalid response: %s", err)
+	}
+	return w.Code, resp
+}
+
+func TestHealth(t *testing.T) {
+	db, _, q := testStores(t)
+	hh := &HealthHandler{db, q, 1}
+	db.Close()
+
+	// the process is alive even if it is not ready
+	if code, resp := healthStatus(t, hh.Health); code != http.StatusOK || resp.Status != healthOK {
+		t.Errorf("Health = %d %+v, want ok", code, resp)
+	}
+}
+
+func TestReady(t *testing.T) {
+	db, s, q := testStores(t)
+	hh := &HealthHandler{db, q, 1}
+	h, _ := testHook(t, s, "hook", "a")
+
+	check := func(name string, want int, unavailable ...string) {
+		t.Helper()
+		code, resp := healthStatus(t, hh.Ready)
+		if code != want {
+			t.Errorf("%s: status = %d, want %d", name, code, want)
+		}
+		for _, c := range []string{"database", "workers", "backlog"} {
+			failed := false
+			for _, u := range unavailable {
+				failed = failed || u == c
+			}
+			if got := resp.Checks[c].Status; (got == healthUnavailable) != failed {
+				t.Errorf("%s: %s check = %+v", name, c, resp.Checks[c])
+			}
+		}
+	}
+
+	check("no workers", http.StatusServiceUnavailable, "workers")
+
+	// the worker holds on to the first delivery until stop is closed
+	stop := make(chan struct{})
+	defer close(stop)
+	q.Start(1, func(d *Delivery) {
+		<-stop
+		q.Done(d, StatusDone)
+	})
+	for q.Workers() == 0 {
+		runtime.Gosched()
+	}
+	check("ready", http.StatusOK)
+
+	for i := 0; i < 2; i++ {
+		if err := q.Push(&Delivery{Hook: h.ID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check("backlog", http.StatusServiceUnavailable, "backlog")
+
+	// requests for paused hooks are not part of the backlog
+	if err := s.SetState(h.ID, StatePaused); err != nil {
+		t.Fatal(err)
+	}
+	check("paused", http.StatusOK)
+
+	db.Close()
+	check("closed", http.StatusServiceUnavailable, "database", "backlog")
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// DefaultHistoryCount is the number of deliveries kept in the history of
+	// a hook if its retention policy does not specify a count.
+	DefaultHistoryCount = 100
+)
+
+// Outcome is the result of a component processing a request.
+type Outcome string
+
+// Possible component outcomes.
+const (
+	OutcomePassed   Outcome = "passed"
+	OutcomeFiltered Outcome = "filtered"
+	OutcomeErrored  Outcome = "errored"
+)
+
+// Status is the processing state of a delivery.
+type Status string
+
+// Possible delivery states.
+const (
+	StatusPending  Status = "pending"
+	StatusDone     Status = "done"
+	StatusFiltered Status = "filtered"
+	StatusFailed   Status = "failed"
+	StatusRejected Status = "rejected" // not accepted, e.g. because it was too large
+)
+
+// TraceStep describes how a single component handled a request.
+type TraceStep struct {
+	Component HookComponent
+	Outcome   Outcome
+	Started   time.Time
+	Duration  time.Duration
+	Error     string
+}
+
+// Record is an entry in the delivery history of a hook.
+type Record struct {
+	ID       uint64      // delivery identifier
+	Hook     string      // hook identifier
+	Status   Status      // processing state
+	Received time.Time   // time the request was received
+	Updated  time.Time   // time of the last change
+	Request  Request     // the incoming request, its body possibly truncated
+	BodySize int         // size of the original request body
+	Trace    []TraceStep // components the request passed through
+}
+
+// Truncated returns true if the request body was cut off to limit its size.
+func (r Record) Truncated() bool {
+	return len(r.Request.Body) < r.BodySize
+}
+
+// Retention determines how much delivery history is kept for a hook.
+type Retention struct {
+	Count int           // maximum number of deliveries, 0 uses DefaultHistoryCount
+	Age   time.Duration // maximum age of deliveries, 0 keeps them regardless of age
+}
+
+// History returns at most limit records from the delivery history of hook,
+// most recent first.
+func (q *Queue) History(hook string, limit int) (records []Record, err error) {
+	err = q.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BucketHistory).Bucket([]byte(hook))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil && len(records) < limit; k, v = c.Prev() {
+			var r Record
+			if err := gobDecode(v, &r); err != nil {
+				return err
+			}
+			records = append(records, r)
+		}
+		return nil
+	})
+	return records, err
+}
+
+// Record returns the history record of delivery id for hook.
+func (q *Queue) Record(hook string, id uint64) (r *Record, err error) {
+	err = q.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BucketHistory).Bucket([]byte(hook))
+		if b == nil {
+			return errors.New("delivery does not exist")
+		}
+		v := b.Get(itob(id))
+		if v == nil {
+			return errors.New("delivery does not exist")
+		}
+		r = &Record{}
+		return gobDecode(v, r)
+	})
+	return r, err
+}
+
+// FindRecord returns the history record of delivery id, regardless of the hook
+// it belongs to.
+func (q *Queue) FindRecord(id uint64) (r *Record, err error) {
+	err = q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BucketHistory).ForEach(func(k, v []byte) error {
+			b := tx.Bucket(BucketHistory).Bucket(k)
+			if r != nil || b == nil {
+				return nil
+			}
+			if v := b.Get(itob(id)); v != nil {
+				r = &Record{}
+				return gobDecode(v, r)
+			}
+			return nil
+		})
+	})
+	if err == nil && r == nil {
+		err = errors.New("delivery does not exist")
+	}
+	return r, err
+}
+
+// Replay queues the request of delivery id for hook again. The new delivery
+// passes through the entire chain. If the history only contains a truncated
+// body, the request is taken from the dead letters instead.
+func (q *Queue) Replay(hook string, id uint64) (d *Delivery, err error) {
+	err = q.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(BucketHooks).Get([]byte(hook)) == nil {
+			return errors.New("hook does not exist")
+		}
+		b := tx.Bucket(BucketHistory).Bucket([]byte(hook))
+		if b == nil || b.Get(itob(id)) == nil {
+			return errors.New("delivery does not exist")
+		}
+		var r Record
+		if err := gobDecode(b.Get(itob(id)), &r); err != nil {
+			return err
+		}
+		if r.Truncated() {
+			v := deadLetterGet(tx, hook, id)
+			if v == nil {
+				return errors.New("request body was truncated in the history")
+			}
+			var dl DeadLetter
+			if err := gobDecode(v, &dl); err != nil {
+				return err
+			}
+			r.Request = dl.Request
+		}
+
+		qid, err := tx.Bucket(BucketQueue).NextSequence()
+		if err != nil {
+			return err
+		}
+		d = &Delivery{ID: qid, Hook: hook, Request: r.Request, Received: time.Now()}
+		return q.put(tx, d)
+	})
+	if err == nil {
+		q.notify()
+	}
+	return d, err
+}
+
+// record stores the current state of delivery d in the history of its hook
+// and removes records that are no longer retained.
+func (q *Queue) record(tx *bolt.Tx, d *Delivery, status Status) error {
+	if tx.Bucket(BucketHooks).Get([]byte(d.Hook)) == nil {
+		// the hook was deleted while the delivery was being processed
+		return nil
+	}
+	b, err := tx.Bucket(BucketHistory).CreateBucketIfNotExists([]byte(d.Hook))
+	if err != nil {
+		return err
+	}
+
+	r := Record{
+		ID:       d.ID,
+		Hook:     d.Hook,
+		Status:   status,
+		Received: d.Received,
+		Updated:  time.Now(),
+		Request:  d.Request,
+		BodySize: len(d.Request.Body),
+		Trace:    d.Trace,
+	}
+	if len(r.Request.Body) > *historyBody {
+		r.Request.Body = r.Request.Body[:*historyBody]
+	}
+
+	v, err := gobEncode(r)
+	if err != nil {
+		return err
+	}
+	if err := b.Put(itob(d.ID), v); err != nil {
+		return err
+	}
+
+	var s Settings
+	if err := gobDecode(tx.Bucket(BucketSettings).Get([]byte(d.Hook)), &s); err != nil {
+		return err
+	}
+	return pruneHistory(b, s.Retention)
+}
+
+// pruneHistory removes the oldest records from history bucket b that exceed
+// the retention policy. It is called for every record that is stored, so it
+// only visits the records it keeps by count and the ones it removes.
+func pruneHistory(b *bolt.Bucket, rt Retention) error {
+	count := rt.Count
+	if count <= 0 {
+		count = DefaultHistoryCount
+	}
+	// keys are delivery identifiers, the oldest record retained by count is
+	// the count-th key from the end
+	c := b.Cursor()
+	keep, _ := c.Last()
+	for i := 1; i < count && keep != nil; i++ {
+		keep, _ = c.Prev()
+	}
+	if keep != nil {
+		keep = append([]byte(nil), keep...)
+	}
+
+	for k, v := c.First(); k != nil; k, v = c.First() {
+		if keep == nil || bytes.Compare(k, keep) >= 0 {
+			if rt.Age <= 0 {
+				break
+			}
+			var r Record
+			if err := gobDecode(v, &r); err != nil {
+				return err
+			}
+			if time.Since(r.Received) < rt.Age {
+				break
+			}
+		}
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestPruneHistory(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		retention Retention
+		want      []uint64
+	}{
+		{Retention{Count: 10}, []uint64{1, 2, 3, 4, 5}},
+		{Retention{Count: 5}, []uint64{1, 2, 3, 4, 5}},
+		{Retention{Count: 2}, []uint64{4, 5}},
+		{Retention{Count: 1}, []uint64{5}},
+		{Retention{Age: 150 * time.Minute}, []uint64{3, 4, 5}},
+		{Retention{Count: 4, Age: 150 * time.Minute}, []uint64{3, 4, 5}},
+		{Retention{Count: 2, Age: 150 * time.Minute}, []uint64{4, 5}},
+	}
+	for _, tt := range tests {
+		db := testDB(t)
+		var got []uint64
+		err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.Bucket(BucketHistory).CreateBucket([]byte("hook"))
+			if err != nil {
+				return err
+			}
+			// delivery i was received i hours after the first one
+			for i := uint64(1); i <= 5; i++ {
+				v, err := gobEncode(Record{ID: i, Received: now.Add(time.Duration(i-5) * time.Hour)})
+				if err != nil {
+					return err
+				}
+				if err := b.Put(itob(i), v); err != nil {
+					return err
+				}
+			}
+			if err := pruneHistory(b, tt.retention); err != nil {
+				return err
+			}
+			return b.ForEach(func(k, v []byte) error {
+				got = append(got, btoi(k))
+				return nil
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: history = %v, want %v", tt.retention, got, tt.want)
+		}
+	}
+}
@@ -1,70 +1,372 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/julienschmidt/httprouter"
 )
 
+const (
+	// DefaultSyncTimeout is the maximum time a synchronous hook waits for its
+	// components if its settings do not specify a timeout.
+	DefaultSyncTimeout = 10 * time.Second
+)
+
 // HookHandler is the webhook HTTP handler.
 type HookHandler struct {
 	hooks *HookStore
-	db    *bolt.DB
+	db    *DB
+	queue *Queue
+}
+
+// result is the outcome of processing a delivery.
+type result struct {
+	Status Status
+	Err    error // error returned by the last processed component, if any
 }
 
-// ReceiveHook handles incoming webhook HTTP requests.
+// ReceiveHook handles incoming webhook HTTP requests. Requests exceeding the
+// size limits or for disabled hooks are rejected, others are stored in the
+// queue before they are acknowledged. Hooks configured to respond
+// synchronously process the request immediately and respond with a status
+// code based on the outcome, unless they are paused.
 func (h *HookHandler) ReceiveHook(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	id := p.ByName("id")
 
-	hook, err := h.hooks.Find(p.ByName("id"))
+	hook, err := h.hooks.Find(id)
 	if err != nil {
 		log.Printf("no hook configured for %q", id)
 		http.NotFound(w, r)
 		return
 	}
 
-	req, err := loadRequest(r)
+	if hook.Settings.Disabled() {
+		log.Printf("rejected request for %s: hook is disabled", hook.ID)
+		h.inc(hook.ID, StatusRejected)
+		w.WriteHeader(hook.Settings.ResponseStatus())
+		return
+	}
+
+	var headers int
+	for _, v := range r.Header {
+		headers += len(v)
+	}
+	if headers > *maxHeaders {
+		log.Printf("rejected request for %s: too many headers (%d)", hook.ID, headers)
+		h.inc(hook.ID, StatusRejected)
+		w.WriteHeader(http.StatusRequestHeaderFieldsTooLarge)
+		return
+	}
+
+	limit := *maxBody
+	if hook.Settings.MaxBodySize > 0 {
+		limit = hook.Settings.MaxBodySize
+	}
+	if r.ContentLength > limit {
+		log.Printf("rejected request for %s: body too large (%d bytes)", hook.ID, r.ContentLength)
+		h.inc(hook.ID, StatusRejected)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+	req, err := loadRequest(r, p.ByName("path"))
+	if _, ok := err.(*http.MaxBytesError); ok {
+		log.Printf("rejected request for %s: body exceeds %d bytes", hook.ID, limit)
+		h.inc(hook.ID, StatusRejected)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
 		log.Printf("error reading request: %s", err)
 		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := h.challenge(hook, req)
+	if err != nil {
+		log.Printf("error responding to request for %s: %s", hook.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if resp != nil {
+		if resp.ContentType != "" {
+			w.Header().Set("Content-Type", resp.ContentType)
+		}
+		w.WriteHeader(resp.Status)
+		w.Write(resp.Body)
+		return
 	}
 
-	go h.processRequest(hook, req)
-	w.WriteHeader(http.StatusOK)
+	d := &Delivery{Hook: hook.ID, Request: req, Received: time.Now()}
+	if !hook.Settings.Sync || hook.Settings.Paused() {
+		if err := h.queue.Push(d); err != nil {
+			log.Printf("error queueing request for %s: %s", hook.ID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if hook.Settings.Sync {
+			// paused, the outcome is not known yet
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if err := h.queue.PushClaimed(d); err != nil {
+		log.Printf("error queueing request for %s: %s", hook.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		res := h.processRequest(d)
+		h.queue.Release(d.ID)
+		done <- res
+	}()
+
+	timeout := hook.Settings.SyncTimeout
+	if timeout <= 0 {
+		timeout = DefaultSyncTimeout
+	}
+
+	select {
+	case res := <-done:
+		respond(w, res)
+	case <-time.After(timeout):
+		// processing continues in the background
+		w.WriteHeader(http.StatusAccepted)
+	}
 }
 
-func (h *HookHandler) processRequest(hook *Hook, r Request) {
-	for i, c := range hook.Components {
-		// TODO: remove debug logging
-		log.Printf("%d: processing %s", i+1, c.Name)
+// challenge asks the components of hook that implement Responder whether
+// they want to answer request r directly. It returns the response of the
+// first component that does, or nil.
+func (h *HookHandler) challenge(hook *Hook, r Request) (resp *Response, err error) {
+	err = h.db.View(func(tx *bolt.Tx) error {
+		for _, c := range hook.Components {
+			cmp, ok := components[c.Name].(Responder)
+			if !ok {
+				continue
+			}
+			b := c.bucket(tx)
+			if b == nil {
+				continue
+			}
+			if resp, err = cmp.Respond(*hook, r, b); resp != nil || err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return resp, err
+}
+
+// respond writes the HTTP response for a synchronously processed request.
+func respond(w http.ResponseWriter, res result) {
+	switch res.Status {
+	case StatusDone:
+		w.WriteHeader(http.StatusOK)
+	case StatusPending:
+		// a retry has been scheduled
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		code := http.StatusInternalServerError
+		if sc, ok := res.Err.(statusCoder); ok {
+			code = sc.StatusCode()
+		}
+		if fe, ok := res.Err.(*FilteredError); ok && fe.RetryAfter > 0 {
+			secs := int((fe.RetryAfter + time.Second - 1) / time.Second)
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+		}
+		w.WriteHeader(code)
+	}
+}
+
+// processRequest passes delivery d through the components of its hook. Each
+// successfully processed component is recorded in the queue, so an
+// interrupted delivery resumes where it left off. A failing component with a
+// retry policy is scheduled to be tried again later, continuing the chain from
+// that component onwards.
+func (h *HookHandler) processRequest(d *Delivery) result {
+	hook, err := h.hooks.Find(d.Hook)
+	if err != nil {
+		log.Printf("dropping delivery %d for %q: %s", d.ID, d.Hook, err)
+		if err := h.queue.Remove(d.ID); err != nil {
+			log.Printf("error removing delivery %d: %s", d.ID, err)
+		}
+		return result{StatusFailed, err}
+	}
+
+	for !d.Processed {
+		i := 0
+		if d.Next != "" {
+			if i = hook.component(d.Next); i < 0 {
+				// the chain changed while the delivery was queued
+				err := fmt.Errorf("component %s is no longer part of the hook", d.Next)
+				log.Printf("processing stopped: %s", err)
+				h.bury(d, d.component(), err)
+				h.incDelivery(d, StatusFailed)
+				return result{StatusFailed, err}
+			}
+		}
+		if i == len(hook.Components) {
+			break
+		}
+		c := hook.Components[i]
 
 		cmp, ok := components[c.Name]
 		if !ok {
 			log.Printf("skipping unknown component: %s", c.Name)
+			d.advance(hook, i)
 			continue
 		}
 
-		tx, err := h.db.Begin(true)
-		if err != nil {
-			log.Printf("error starting db tx: %s", err)
-			break
+		next, n := d.Next, len(d.Trace)
+		trace := TraceStep{Component: c, Started: time.Now()}
+		err := h.process(hook, c, cmp, d.Request, func(tx *bolt.Tx) error {
+			trace.Outcome, trace.Duration = OutcomePassed, time.Since(trace.Started)
+			d.advance(hook, i)
+			d.Attempts, d.NextAttempt = 0, time.Time{}
+			d.Trace = append(d.Trace, trace)
+			if err := incComponent(tx, trace); err != nil {
+				return err
+			}
+			return h.queue.put(tx, d)
+		})
+		if err == nil {
+			continue
+		}
+		if err == errHookDeleted {
+			log.Printf("dropping delivery %d: hook %s was deleted", d.ID, d.Hook)
+			if err := h.queue.Remove(d.ID); err != nil {
+				log.Printf("error removing delivery %d: %s", d.ID, err)
+			}
+			return result{StatusFailed, err}
 		}
 
-		b := tx.Bucket(BucketComponents).Bucket([]byte(c.Name))
-		if err := cmp.Process(*hook, r, b); err != nil {
-			tx.Rollback()
-			log.Printf("processing stopped: %s", err)
-			break
+		trace.Duration, trace.Error = time.Since(trace.Started), err.Error()
+		if isFiltered(err) {
+			trace.Outcome = OutcomeFiltered
+			d.Trace = append(d.Trace[:n], trace)
+			h.incComponent(trace)
+			log.Printf("request filtered: %s", err)
+			if err := h.queue.Done(d, StatusFiltered); err != nil {
+				log.Printf("error removing delivery %d: %s", d.ID, err)
+			}
+			h.incDelivery(d, StatusFiltered)
+			return result{StatusFiltered, err}
 		}
-		if err := tx.Commit(); err != nil {
-			log.Printf("error committing db tx: %s", err)
-			break
+
+		trace.Outcome = OutcomeErrored
+		d.Next, d.Processed, d.Trace = next, false, append(d.Trace[:n], trace)
+		h.incComponent(trace)
+		d.Attempts++
+		if d.Attempts < c.Retry.MaxAttempts {
+			delay := c.Retry.Delay(d.Attempts)
+			d.NextAttempt = time.Now().Add(delay)
+			log.Printf("processing failed (attempt %d of %d), retrying in %s: %s", d.Attempts, c.Retry.MaxAttempts, delay, err)
+			retries.inc(hook.ID, c.ID, c.Name)
+			if err := h.queue.Retry(d); err != nil {
+				log.Printf("error scheduling retry for delivery %d: %s", d.ID, err)
+			}
+			return result{StatusPending, err}
 		}
+		log.Printf("processing stopped: %s", err)
+		h.bury(d, c, err)
+		h.incDelivery(d, StatusFailed)
+		return result{StatusFailed, err}
 	}
 
-	if err := h.hooks.Inc(hook.ID); err != nil {
-		log.Printf("error incrementing count for %s: %s", hook.ID, err)
+	if err := h.queue.Done(d, StatusDone); err != nil {
+		log.Printf("error removing delivery %d: %s", d.ID, err)
+	}
+	h.incDelivery(d, StatusDone)
+	return result{StatusDone, nil}
+}
+
+// process passes request r to component c of hook, which is implemented by
+// cmp. Once it succeeds, done is called to record the progress of the delivery.
+// Most components are processed in the same transaction as done, so the data
+// they store is only kept along with the progress. A Sender is called outside
+// of any transaction, since it may take a long time and a write transaction
+// blocks all others. If the hook was deleted in the meantime, nothing is
+// stored and errHookDeleted is returned.
+func (h *HookHandler) process(hook *Hook, c HookComponent, cmp Component, r Request, done func(tx *bolt.Tx) error) error {
+	update := func(fn func(tx *bolt.Tx) error) error {
+		return h.db.Update(func(tx *bolt.Tx) error {
+			if tx.Bucket(BucketHooks).Get([]byte(hook.ID)) == nil {
+				return errHookDeleted
+			}
+			return fn(tx)
+		})
+	}
+
+	s, ok := cmp.(Sender)
+	if !ok {
+		return update(func(tx *bolt.Tx) error {
+			b := c.bucket(tx)
+			if b == nil {
+				return errors.New("component is no longer part of the hook")
+			}
+			if err := cmp.Process(*hook, r, b); err != nil {
+				return err
+			}
+			return done(tx)
+		})
+	}
+
+	var params map[string]string
+	if err := h.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(BucketHooks).Get([]byte(hook.ID)) == nil {
+			return errHookDeleted
+		}
+		if b := c.bucket(tx); b != nil {
+			params = cmp.Params(*hook, b)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := s.Send(*hook, r, params); err != nil {
+		return err
+	}
+	return update(done)
+}
+
+func (h *HookHandler) inc(id string, status Status) {
+	if err := h.hooks.Inc(id, status); err != nil {
+		log.Printf("error incrementing count for %s: %s", id, err)
+	}
+}
+
+// bury stores delivery d as a dead letter for component hc, or drops it if
+// that fails.
+func (h *HookHandler) bury(d *Delivery, hc HookComponent, err error) {
+	if err := h.queue.Bury(d, hc, err); err != nil {
+		log.Printf("error storing failed delivery %d: %s", d.ID, err)
+		if err := h.queue.Remove(d.ID); err != nil {
+			log.Printf("error removing delivery %d: %s", d.ID, err)
+		}
+	}
+}
+
+func (h *HookHandler) incDelivery(d *Delivery, status Status) {
+	if err := h.hooks.IncDelivery(d, status); err != nil {
+		log.Printf("error incrementing count for %s: %s", d.Hook, err)
+	}
+}
+
+func (h *HookHandler) incComponent(ts TraceStep) {
+	if err := h.hooks.IncComponent(ts); err != nil {
+		log.Printf("error incrementing count for component %s: %s", ts.Component.ID, err)
 	}
 }
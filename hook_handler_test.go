@@ -0,0 +1,380 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/julienschmidt/httprouter"
+)
+
+func init() {
+	RegisterComponent("test-sender", testSender{})
+	RegisterComponent("test-filter", testFilter{})
+}
+
+// testSender is a component that signals sending on started and then blocks
+// until it receives the error to return from unblock.
+type testSender struct{ testAction }
+
+var (
+	started = make(chan string)
+	unblock = make(chan error)
+)
+
+func (testSender) Process(h Hook, r Request, b *bolt.Bucket) error {
+	panic("Process called on a Sender")
+}
+
+func (testSender) Send(h Hook, r Request, params map[string]string) error {
+	started <- params["name"]
+	return <-unblock
+}
+
+// testFilter is a component that drops every request with a rate limit
+// status.
+type testFilter struct{ testAction }
+
+func (testFilter) Process(h Hook, r Request, b *bolt.Bucket) error {
+	return &FilteredError{Reason: "too many requests", Status: http.StatusTooManyRequests, RetryAfter: 1500 * time.Millisecond}
+}
+
+func TestProcessRequestSender(t *testing.T) {
+	db, s, q := testStores(t)
+	hh := &HookHandler{s, db, q}
+	h, _ := testHook(t, s, "hook", "a")
+	sender, err := s.AddComponent(*h, HookComponent{Name: "test-sender"}, map[string]string{"name": "sender"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	processed = nil
+	d := &Delivery{Hook: h.ID}
+	if err := q.PushClaimed(d); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan result)
+	go func() { done <- hh.processRequest(d) }()
+
+	if name := <-started; name != "sender" {
+		t.Errorf("Send got params of %q, want sender", name)
+	}
+
+	// the database can be written while the request is being sent
+	pushed := make(chan error)
+	go func() { pushed <- q.Push(&Delivery{Hook: h.ID}) }()
+	select {
+	case err := <-pushed:
+		if err != nil {
+			t.Errorf("Push while sending: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Push blocked while sending")
+	}
+	if got := queued(t, db, d.ID); got == nil || got.Next != sender || len(got.Trace) != 1 {
+		t.Errorf("delivery while sending = %+v, want it to continue at the sender", got)
+	}
+
+	unblock <- nil
+	if res := <-done; res.Status != StatusDone {
+		t.Errorf("processRequest = %+v, want done", res)
+	}
+	if len(processed) != 1 || processed[0] != "a" {
+		t.Errorf("processed = %q, want [a]", processed)
+	}
+	if got := queued(t, db, d.ID); got != nil {
+		t.Errorf("delivery still queued after sending: %+v", got)
+	}
+}
+
+func TestProcessRequestHookDeleted(t *testing.T) {
+	for _, sendErr := range []error{nil, errors.New("failed")} {
+		db, s, q := testStores(t)
+		hh := &HookHandler{s, db, q}
+		h, _ := testHook(t, s, "hook", "a")
+		if _, err := s.AddComponent(*h, HookComponent{Name: "test-sender"}, map[string]string{"name": "sender"}); err != nil {
+			t.Fatal(err)
+		}
+		h, _ = s.Find("hook")
+
+		d := &Delivery{Hook: h.ID}
+		if err := q.PushClaimed(d); err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan result)
+		go func() { done <- hh.processRequest(d) }()
+		<-started
+
+		if err := s.Delete(h.ID, false); err != nil {
+			t.Fatal(err)
+		}
+		unblock <- sendErr
+		res := <-done
+		if res.Status != StatusFailed || sendErr == nil && res.Err != errHookDeleted {
+			t.Errorf("send error %v: processRequest = %+v, want failed", sendErr, res)
+		}
+
+		// nothing of the hook is recreated
+		if got := findHookData(t, s, q, h.ID, h.Components); got != (hookData{}) {
+			t.Errorf("send error %v: data after processing = %+v, want none", sendErr, got)
+		}
+		if got := queued(t, db, d.ID); got != nil {
+			t.Errorf("send error %v: delivery still queued: %+v", sendErr, got)
+		}
+		db.View(func(tx *bolt.Tx) error {
+			for _, hc := range h.Components {
+				for _, k := range componentStatsKeys(hc.ID) {
+					if v := tx.Bucket(BucketStats).Bucket(statsComponents).Get(k); v != nil {
+						t.Errorf("send error %v: count %s recreated", sendErr, k)
+					}
+				}
+			}
+			return nil
+		})
+	}
+}
+
+// receive passes request r for hook id to ReceiveHook and returns the
+// response.
+func receive(hh *HookHandler, id string, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	hh.ReceiveHook(w, r, httprouter.Params{{Key: "id", Value: id}})
+	return w
+}
+
+func TestReceiveHookLimits(t *testing.T) {
+	db, s, q := testStores(t)
+	hh := &HookHandler{s, db, q}
+	h, _ := testHook(t, s, "hook", "a")
+	if err := s.UpdateSettings(h.ID, Settings{MaxBodySize: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	manyHeaders := httptest.NewRequest("POST", "/h/hook", strings.NewReader("body"))
+	for i := 0; i <= *maxHeaders; i++ {
+		manyHeaders.Header.Set("X-Header-"+strconv.Itoa(i), "value")
+	}
+	// without a content length the body is only rejected while reading it
+	streamed := httptest.NewRequest("POST", "/h/hook", strings.NewReader("body too large"))
+	streamed.ContentLength = -1
+
+	tests := []struct {
+		name   string
+		r      *http.Request
+		status int
+	}{
+		{"within limits", httptest.NewRequest("POST", "/h/hook", strings.NewReader("body")), http.StatusOK},
+		{"body", httptest.NewRequest("POST", "/h/hook", strings.NewReader("body too large")), http.StatusRequestEntityTooLarge},
+		{"streamed body", streamed, http.StatusRequestEntityTooLarge},
+		{"headers", manyHeaders, http.StatusRequestHeaderFieldsTooLarge},
+	}
+	for _, tt := range tests {
+		if w := receive(hh, h.ID, tt.r); w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.status)
+		}
+	}
+
+	// rejected requests are counted, but not queued
+	c, err := s.RequestCount(h.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Rejected != 3 {
+		t.Errorf("rejected count = %d, want 3", c.Rejected)
+	}
+	if d := queued(t, db, 1); d == nil || string(d.Request.Body) != "body" {
+		t.Errorf("delivery within limits = %+v, want it queued", d)
+	}
+	if d := queued(t, db, 2); d != nil {
+		t.Errorf("rejected request queued: %+v", d)
+	}
+}
+
+func TestReceiveHookSync(t *testing.T) {
+	tests := []struct {
+		name       string
+		component  HookComponent
+		failing    bool
+		state      State
+		status     int
+		retryAfter string
+	}{
+		{"done", HookComponent{Name: "test-action"}, false, StateActive, http.StatusOK, ""},
+		{"failed", HookComponent{Name: "test-action"}, true, StateActive, http.StatusInternalServerError, ""},
+		{"retried", HookComponent{Name: "test-action", Retry: RetryPolicy{MaxAttempts: 3}}, true, StateActive, http.StatusAccepted, ""},
+		{"filtered", HookComponent{Name: "test-filter"}, false, StateActive, http.StatusTooManyRequests, "2"},
+		{"paused", HookComponent{Name: "test-action"}, false, StatePaused, http.StatusAccepted, ""},
+	}
+	for _, tt := range tests {
+		db, s, q := testStores(t)
+		hh := &HookHandler{s, db, q}
+		h, _ := testHook(t, s, "hook")
+		if _, err := s.AddComponent(*h, tt.component, map[string]string{"name": "a"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.UpdateSettings(h.ID, Settings{Sync: true, State: tt.state}); err != nil {
+			t.Fatal(err)
+		}
+
+		processed, failing = nil, map[string]bool{"a": tt.failing}
+		w := receive(hh, h.ID, httptest.NewRequest("POST", "/h/hook", strings.NewReader("body")))
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.status)
+		}
+		if got := w.Header().Get("Retry-After"); got != tt.retryAfter {
+			t.Errorf("%s: Retry-After = %q, want %q", tt.name, got, tt.retryAfter)
+		}
+		if tt.state == StatePaused && len(processed) != 0 {
+			t.Errorf("%s: processed = %q, want nothing", tt.name, processed)
+		}
+	}
+	processed, failing = nil, nil
+}
+
+func TestReceiveHookSyncTimeout(t *testing.T) {
+	db, s, q := testStores(t)
+	hh := &HookHandler{s, db, q}
+	h, _ := testHook(t, s, "hook")
+	if _, err := s.AddComponent(*h, HookComponent{Name: "test-sender"}, map[string]string{"name": "sender"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateSettings(h.ID, Settings{Sync: true, SyncTimeout: 10 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := receive(hh, h.ID, httptest.NewRequest("POST", "/h/hook", strings.NewReader("body")))
+	if w.Code != http.StatusAccepted {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusAccepted)
+	}
+
+	// processing continues after responding
+	<-started
+	unblock <- nil
+	for i := 0; queued(t, db, 1) != nil; i++ {
+		if i == 100 {
+			t.Fatal("delivery not finished after responding")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReceiveHookStates(t *testing.T) {
+	db, s, q := testStores(t)
+	hh := &HookHandler{s, db, q}
+	h, _ := testHook(t, s, "hook", "a")
+
+	tests := []struct {
+		settings Settings
+		status   int
+		queued   bool
+	}{
+		{Settings{State: StateActive}, http.StatusOK, true},
+		{Settings{State: StatePaused}, http.StatusOK, true},
+		{Settings{State: StateDisabled}, DefaultDisabledStatus, false},
+		{Settings{State: StateDisabled, DisabledStatus: http.StatusGone}, http.StatusGone, false},
+	}
+	for i, tt := range tests {
+		if err := s.UpdateSettings(h.ID, tt.settings); err != nil {
+			t.Fatal(err)
+		}
+		w := receive(hh, h.ID, httptest.NewRequest("POST", "/h/hook", strings.NewReader("body")))
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.settings.State, w.Code, tt.status)
+		}
+		n, err := q.Pending(h.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if queued := n > 0; queued != tt.queued {
+			t.Errorf("%s: queued = %t, want %t", tt.settings.State, queued, tt.queued)
+		}
+		if n > 0 {
+			if err := q.Remove(uint64(i + 1)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	c, err := s.RequestCount(h.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Rejected != 2 {
+		t.Errorf("rejected count = %d, want 2", c.Rejected)
+	}
+}
+
+func TestProcessRequestFiltered(t *testing.T) {
+	db, s, q := testStores(t)
+	hh := &HookHandler{s, db, q}
+	h, _ := testHook(t, s, "hook", "a")
+	filter, err := s.AddComponent(*h, HookComponent{Name: "test-filter", Retry: RetryPolicy{MaxAttempts: 3}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _ = s.Find(h.ID)
+	if _, err := s.AddComponent(*h, HookComponent{Name: "test-action"}, map[string]string{"name": "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	processed, failing = nil, nil
+	d := &Delivery{Hook: h.ID}
+	if err := q.PushClaimed(d); err != nil {
+		t.Fatal(err)
+	}
+	if res := hh.processRequest(d); res.Status != StatusFiltered || !isFiltered(res.Err) {
+		t.Fatalf("processRequest = %+v, want filtered", res)
+	}
+
+	// the chain stops without retrying or burying the request
+	if len(processed) != 1 || processed[0] != "a" {
+		t.Errorf("processed = %q, want [a]", processed)
+	}
+	if got := queued(t, db, d.ID); got != nil {
+		t.Errorf("filtered delivery still queued: %+v", got)
+	}
+	if dls, err := q.DeadLetters(h.ID); err != nil || len(dls) != 0 {
+		t.Errorf("dead letters = %d, %v, want none", len(dls), err)
+	}
+	r, err := q.Record(h.ID, d.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(r.Trace); r.Status != StatusFiltered || n != 2 || r.Trace[n-1].Component.ID != filter || r.Trace[n-1].Outcome != OutcomeFiltered {
+		t.Errorf("history record = %+v, want filtered by %s", r, filter)
+	}
+	c, err := s.RequestCount(h.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Filtered != 1 || c.Failed != 0 {
+		t.Errorf("filtered, failed count = %d, %d, want 1, 0", c.Filtered, c.Failed)
+	}
+}
+
+func TestProcessRequestRateLimited(t *testing.T) {
+	db, s, q := testStores(t)
+	hh := &HookHandler{s, db, q}
+	h, _ := testHook(t, s, "hook")
+	if _, err := s.AddComponent(*h, HookComponent{Name: "rate-limit-filter"}, map[string]string{"amount": "1", "interval": "60"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []Status{StatusDone, StatusFiltered} {
+		d := &Delivery{Hook: h.ID}
+		if err := q.PushClaimed(d); err != nil {
+			t.Fatal(err)
+		}
+		res := hh.processRequest(d)
+		if res.Status != want {
+			t.Errorf("request %d: processRequest = %+v, want %s", i+1, res, want)
+		}
+		if fe, ok := res.Err.(*FilteredError); want == StatusFiltered && (!ok || fe.StatusCode() != http.StatusTooManyRequests || fe.RetryAfter <= 0) {
+			t.Errorf("request %d: error = %#v, want a rate limit", i+1, res.Err)
+		}
+	}
+}
@@ -6,7 +6,9 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,29 +19,82 @@ const (
 	// StatsTimeFormat is the time format used to determine the request count
 	// group.
 	StatsTimeFormat = "2006-01-02-15"
+
+	// DefaultDisabledStatus is the response status for requests to a
+	// disabled hook if its settings do not specify one.
+	DefaultDisabledStatus = http.StatusServiceUnavailable
 )
 
 // HookStore is the database that stores hook configuration and data.
 type HookStore struct {
-	db *bolt.DB
+	db *DB
 }
 
 // Hook is the configuration for a single hook.
 type Hook struct {
-	ID         string // unique hook identifier
-	Count      Count  // request counts
+	ID         string   // unique hook identifier
+	Count      Count    // request counts
+	Settings   Settings // hook options
 	Components []HookComponent
 }
 
+// Settings contains the options of a single hook.
+type Settings struct {
+	Retention   Retention     // delivery history retention policy
+	Sync        bool          // process requests before responding
+	SyncTimeout time.Duration // maximum time to wait for synchronous processing
+	MaxBodySize int64         // maximum request body size, 0 uses the global limit
+
+	State          State // whether requests are processed
+	DisabledStatus int   // response status while disabled, 0 uses DefaultDisabledStatus
+}
+
+// State determines whether a hook processes incoming requests. Queued
+// requests are only processed while a hook is active.
+type State string
+
+// Possible hook states, the empty state is active.
+const (
+	StateActive   State = "active"
+	StatePaused   State = "paused"   // requests are accepted and queued
+	StateDisabled State = "disabled" // requests are refused
+)
+
+// Paused returns true if requests are queued without being processed.
+func (s Settings) Paused() bool {
+	return s.State == StatePaused
+}
+
+// Disabled returns true if requests are refused.
+func (s Settings) Disabled() bool {
+	return s.State == StateDisabled
+}
+
+// ResponseStatus returns the response status for requests while disabled.
+func (s Settings) ResponseStatus() int {
+	if s.DisabledStatus == 0 {
+		return DefaultDisabledStatus
+	}
+	return s.DisabledStatus
+}
+
+// valid returns true if st is a known hook state.
+func (st State) valid() bool {
+	return st == "" || st == StateActive || st == StatePaused || st == StateDisabled
+}
+
 // List returns a list of all hooks.
 func (s *HookStore) List() (hooks []Hook, err error) {
 	err = s.db.View(func(tx *bolt.Tx) error {
 		c := tx.Bucket(BucketHooks).Cursor()
 		for k, _ := c.First(); k != nil; k, _ = c.Next() {
 			h := Hook{ID: string(k)}
+			if err := gobDecode(tx.Bucket(BucketSettings).Get(k), &h.Settings); err != nil {
+				return err
+			}
 
 			// preload request count
-			if h.Count, err = s.RequestCount(h.ID); err != nil {
+			if h.Count, err = requestCount(tx, h.ID); err != nil {
 				return err
 			}
 
@@ -58,94 +113,605 @@ func (s *HookStore) Find(id string) (h *Hook, err error) {
 			return errors.New("hook does not exist")
 		}
 		h = &Hook{ID: id}
+		if err := gobDecode(tx.Bucket(BucketSettings).Get([]byte(id)), &h.Settings); err != nil {
+			return err
+		}
 		return gobDecode(v, &h.Components)
 	})
 	return h, err
 }
 
+// UpdateSettings replaces the settings of the hook with the given id.
+func (s *HookStore) UpdateSettings(id string, settings Settings) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(BucketHooks).Get([]byte(id)) == nil {
+			return errors.New("hook does not exist")
+		}
+		v, err := gobEncode(settings)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(BucketSettings).Put([]byte(id), v)
+	})
+}
+
+// SetState changes the state of the hook with the given id.
+func (s *HookStore) SetState(id string, state State) error {
+	if !state.valid() {
+		return fmt.Errorf("invalid state %q", state)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(BucketHooks).Get([]byte(id)) == nil {
+			return errors.New("hook does not exist")
+		}
+		var settings Settings
+		if err := gobDecode(tx.Bucket(BucketSettings).Get([]byte(id)), &settings); err != nil {
+			return err
+		}
+		settings.State = state
+		v, err := gobEncode(settings)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(BucketSettings).Put([]byte(id), v)
+	})
+}
+
 // Create creates hook h.
 func (s *HookStore) Create(h Hook) error {
-	if strings.TrimSpace(h.ID) == "" {
+	if err := validHookID(h.ID); err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BucketHooks)
+		if b.Get([]byte(h.ID)) != nil {
+			return errors.New("a hook with that id already exists")
+		}
+		b.Put([]byte(h.ID), nil)
+		return nil
+	})
+}
+
+// validHookID returns an error if id cannot be used as a hook identifier.
+func validHookID(id string) error {
+	if strings.TrimSpace(id) == "" {
 		return errors.New("hook id is required")
 	}
 
-	if match, err := regexp.MatchString("^[a-z0-9-]+$", h.ID); err != nil || !match {
+	if match, err := regexp.MatchString("^[a-z0-9-]+$", id); err != nil || !match {
 		if err != nil {
 			log.Printf("create hook regexp error: %s", err)
 		}
 		return errors.New("hook id contains invalid characters")
 	}
+	return nil
+}
+
+// Delete deletes the hook with the given id and all of its data. Its request
+// counts are kept if keepStats is true, a new hook with the same id continues
+// counting from there.
+func (s *HookStore) Delete(id string, keepStats bool) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return deleteHook(tx, id, keepStats)
+	})
+}
+
+// Clone creates a hook with id newID that has the settings and component chain
+// of the hook with the given id. Every component is a new instance initialized
+// with the params of the original. If stats is true, the request counts are
+// copied as well. Editors of the original may not manage the clone until an
+// admin assigns it to them, like any other new hook.
+func (s *HookStore) Clone(id, newID string, stats bool) error {
+	if err := validHookID(newID); err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		h, err := s.components(tx, id)
+		if err != nil {
+			return err
+		}
+		if tx.Bucket(BucketHooks).Get([]byte(newID)) != nil {
+			return errors.New("a hook with that id already exists")
+		}
+		if err := gobDecode(tx.Bucket(BucketSettings).Get([]byte(id)), &h.Settings); err != nil {
+			return err
+		}
+
+		clone := Hook{ID: newID, Settings: h.Settings}
+		for _, hc := range h.Components {
+			c, err := cloneComponent(tx, *h, clone, hc)
+			if err != nil {
+				return fmt.Errorf("component %s: %s", hc.Name, err)
+			}
+			if stats {
+				if err := copyComponentStats(tx, hc.ID, c.ID); err != nil {
+					return err
+				}
+			}
+			clone.Components = append(clone.Components, c)
+		}
+		if err := s.putComponents(tx, newID, clone.Components); err != nil {
+			return err
+		}
+
+		v, err := gobEncode(clone.Settings)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(BucketSettings).Put([]byte(newID), v); err != nil {
+			return err
+		}
+		if stats {
+			return copyStats(tx, id, newID, false)
+		}
+		return deleteStats(tx, newID)
+	})
+}
+
+// cloneComponent returns a new instance of component hc of hook from, that is
+// initialized for hook to with the params of hc.
+func cloneComponent(tx *bolt.Tx, from, to Hook, hc HookComponent) (HookComponent, error) {
+	cmp, ok := components[hc.Name]
+	if !ok {
+		return hc, errors.New("unknown component")
+	}
+	params := make(map[string]string)
+	if b := hc.bucket(tx); b != nil {
+		params = cmp.Params(from, b)
+	}
+
+	id, err := tx.Bucket(BucketComponents).NextSequence()
+	if err != nil {
+		return hc, err
+	}
+	hc.ID = strconv.FormatUint(id, 10)
+	b, err := hc.createBucket(tx)
+	if err != nil {
+		return hc, err
+	}
+	return hc, cmp.Init(to, params, b)
+}
+
+// Rename changes the identifier of the hook with the given id to newID. Its
+// components, settings, request counts, history and failed and queued
+// requests are moved along, and its editors continue to manage it. A request that is being processed while the hook
+// is renamed may be dropped, pause the hook first to prevent this.
+func (s *HookStore) Rename(id, newID string) error {
+	if err := validHookID(newID); err != nil {
+		return err
+	}
+	if id == newID {
+		return nil
+	}
 
 	return s.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(BucketHooks)
-		if b.Get([]byte(h.ID)) != nil {
+		if b.Get([]byte(id)) == nil {
+			return errors.New("hook does not exist")
+		}
+		if b.Get([]byte(newID)) != nil {
 			return errors.New("a hook with that id already exists")
 		}
-		b.Put([]byte(h.ID), nil)
+		if err := copyKey(b, id, newID, true); err != nil {
+			return err
+		}
+		if err := tx.Bucket(BucketSettings).Delete([]byte(newID)); err != nil {
+			return err
+		}
+		if err := copyKey(tx.Bucket(BucketSettings), id, newID, true); err != nil {
+			return err
+		}
+		if err := copyStats(tx, id, newID, true); err != nil {
+			return err
+		}
+		if err := reassignHook(tx, id, newID); err != nil {
+			return err
+		}
+
+		err := renameBucket(tx.Bucket(BucketHistory), id, newID, func(v []byte) ([]byte, error) {
+			var r Record
+			if err := gobDecode(v, &r); err != nil {
+				return nil, err
+			}
+			r.Hook = newID
+			return gobEncode(r)
+		})
+		if err != nil {
+			return err
+		}
+		err = renameBucket(tx.Bucket(BucketDeadLetters), id, newID, func(v []byte) ([]byte, error) {
+			var dl DeadLetter
+			if err := gobDecode(v, &dl); err != nil {
+				return nil, err
+			}
+			dl.Hook = newID
+			return gobEncode(dl)
+		})
+		if err != nil {
+			return err
+		}
+
+		// deliveries cannot be updated while iterating
+		q := tx.Bucket(BucketQueue)
+		var queued []*Delivery
+		if err := q.ForEach(func(k, v []byte) error {
+			d := &Delivery{}
+			if err := gobDecode(v, d); err != nil {
+				return err
+			}
+			if d.Hook == id {
+				queued = append(queued, d)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, d := range queued {
+			d.Hook = newID
+			v, err := gobEncode(d)
+			if err != nil {
+				return err
+			}
+			if err := q.Put(itob(d.ID), v); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 }
 
-// Delete deletes the hook with the given id if it exists.
-func (s *HookStore) Delete(id string) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
-		return tx.Bucket(BucketHooks).Delete([]byte(id))
+// copyKey copies the value of key from to key to in bucket b, removing from if
+// move is true. Nothing is copied if from does not exist.
+func copyKey(b *bolt.Bucket, from, to string, move bool) error {
+	v := b.Get([]byte(from))
+	if v == nil {
+		return nil
+	}
+	if err := b.Put([]byte(to), append([]byte(nil), v...)); err != nil {
+		return err
+	}
+	if move {
+		return b.Delete([]byte(from))
+	}
+	return nil
+}
+
+// renameBucket moves nested bucket from of parent to a new bucket named to,
+// passing every value through fn. An existing bucket named to is replaced.
+func renameBucket(parent *bolt.Bucket, from, to string, fn func(v []byte) ([]byte, error)) error {
+	if err := parent.DeleteBucket([]byte(to)); err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+	b := parent.Bucket([]byte(from))
+	if b == nil {
+		return nil
+	}
+	nb, err := parent.CreateBucket([]byte(to))
+	if err != nil {
+		return err
+	}
+	if err := b.ForEach(func(k, v []byte) error {
+		v, err := fn(v)
+		if err != nil {
+			return err
+		}
+		return nb.Put(append([]byte(nil), k...), v)
+	}); err != nil {
+		return err
+	}
+	return parent.DeleteBucket([]byte(from))
+}
+
+// deleteHook deletes the hook with the given id in tx, together with its
+// component instances, settings, history and failed and queued requests, and
+// takes it away from the editors that may manage it. Its request counts are
+// removed unless keepStats is true.
+func deleteHook(tx *bolt.Tx, id string, keepStats bool) error {
+	v := tx.Bucket(BucketHooks).Get([]byte(id))
+	if v == nil {
+		return errors.New("hook does not exist")
+	}
+	var hcs []HookComponent
+	if err := gobDecode(v, &hcs); err != nil {
+		return err
+	}
+	for _, hc := range hcs {
+		if err := deleteComponent(tx, hc); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Bucket(BucketHooks).Delete([]byte(id)); err != nil {
+		return err
+	}
+	if err := tx.Bucket(BucketSettings).Delete([]byte(id)); err != nil {
+		return err
+	}
+	for _, name := range [][]byte{BucketHistory, BucketDeadLetters} {
+		if err := tx.Bucket(name).DeleteBucket([]byte(id)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+	}
+	if err := deleteDeliveries(tx, id); err != nil {
+		return err
+	}
+	if err := reassignHook(tx, id, ""); err != nil {
+		return err
+	}
+	if keepStats {
+		return nil
+	}
+	return deleteStats(tx, id)
+}
+
+// deleteComponent removes the storage bucket of component instance hc, which
+// includes its params and data such as replay protection, and its counts.
+func deleteComponent(tx *bolt.Tx, hc HookComponent) error {
+	b := tx.Bucket(BucketComponents).Bucket([]byte(hc.Name))
+	if b == nil {
+		return nil
+	}
+	if err := b.DeleteBucket([]byte(hc.ID)); err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+	return deleteComponentStats(tx, hc.ID)
+}
+
+// deleteDeliveries removes the queued deliveries of the hook with the given id.
+func deleteDeliveries(tx *bolt.Tx, id string) error {
+	b := tx.Bucket(BucketQueue)
+	keys, err := bucketKeys(b, func(k, v []byte) (bool, error) {
+		var d Delivery
+		err := gobDecode(v, &d)
+		return d.Hook == id, err
 	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Count contains recent and total request counts.
 type Count struct {
-	Recent []int // request count per hour of last 48 hours
-	Total  int   // total count
+	Recent    []int   // request count per hour of last 48 hours
+	Daily     []int   // request count per day of last 30 days
+	Monthly   []int   // request count per month of last 12 months
+	Total     int     // total count
+	Succeeded int     // total number of requests processed by all components
+	Filtered  int     // total number of requests dropped by a component
+	Failed    int     // total number of requests that failed to be processed
+	Rejected  int     // total number of requests that exceeded the limits
+	Latency   Latency // processing time of requests
 }
 
+// outcomes are the final states of a delivery that are counted separately.
+var outcomes = []Status{StatusDone, StatusFiltered, StatusFailed, StatusRejected}
+
 // RequestCount returns the incoming request counts for the given hook id.
 func (s *HookStore) RequestCount(id string) (c Count, err error) {
-	c = Count{Recent: make([]int, 48)}
 	err = s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket(BucketStats)
-
-		// retrieve recent counts
-		ts := time.Now().Add(-time.Duration(len(c.Recent)) * time.Hour)
-		for i := 0; i < len(c.Recent); i++ {
-			ts = ts.Add(1 * time.Hour)
-			k := []byte(fmt.Sprintf("%s-%s", id, ts.Format(StatsTimeFormat)))
-			if err := gobDecode(b.Get(k), &c.Recent[i]); err != nil {
+		c, err = requestCount(tx, id)
+		return err
+	})
+	return c, err
+}
+
+func requestCount(tx *bolt.Tx, id string) (c Count, err error) {
+	if c, err = totalCount(tx, id); err != nil {
+		return c, err
+	}
+	c.Recent, c.Daily, c.Monthly = make([]int, 48), make([]int, 30), make([]int, 12)
+	b := tx.Bucket(BucketStats)
+
+	// retrieve recent counts
+	now := time.Now()
+	ts := now.Add(-time.Duration(len(c.Recent)) * time.Hour)
+	for i := 0; i < len(c.Recent); i++ {
+		ts = ts.Add(1 * time.Hour)
+		k := []byte(fmt.Sprintf("%s-%s", id, ts.Format(StatsTimeFormat)))
+		if err := gobDecode(b.Get(k), &c.Recent[i]); err != nil {
+			return c, err
+		}
+	}
+
+	// retrieve counts per day and month, which include the counts that
+	// have not been rolled up yet
+	y, m, d := now.Date()
+	for i := range c.Daily {
+		day := time.Date(y, m, d-len(c.Daily)+1+i, 0, 0, 0, 0, time.Local)
+		if c.Daily[i], err = sumStats(b, id, day.Format(StatsDayFormat)); err != nil {
+			return c, err
+		}
+	}
+	for i := range c.Monthly {
+		month := time.Date(y, m-time.Month(len(c.Monthly)-1-i), 1, 0, 0, 0, 0, time.Local)
+		if c.Monthly[i], err = sumStats(b, id, month.Format(StatsMonthFormat)); err != nil {
+			return c, err
+		}
+	}
+
+	return c, nil
+}
+
+// totalCount returns the total counts of the hook with the given id, without
+// the counts per period.
+func totalCount(tx *bolt.Tx, id string) (c Count, err error) {
+	b := tx.Bucket(BucketStats)
+
+	// retrieve total count
+	k := []byte(fmt.Sprintf("%s-total", id))
+	if err := gobDecode(b.Get(k), &c.Total); err != nil {
+		return c, err
+	}
+
+	// retrieve totals per outcome
+	for i, v := range []*int{&c.Succeeded, &c.Filtered, &c.Failed, &c.Rejected} {
+		if sb := b.Bucket([]byte(outcomes[i])); sb != nil {
+			if err := gobDecode(sb.Get(k), v); err != nil {
+				return c, err
+			}
+		}
+	}
+
+	c.Latency, err = latency(tx, id)
+	return c, err
+}
+
+// statsBuckets returns the buckets containing request counts in tx.
+func statsBuckets(tx *bolt.Tx) []*bolt.Bucket {
+	b := tx.Bucket(BucketStats)
+	buckets := []*bolt.Bucket{b}
+	for _, status := range outcomes {
+		if sb := b.Bucket([]byte(status)); sb != nil {
+			buckets = append(buckets, sb)
+		}
+	}
+	return buckets
+}
+
+// statsKeys returns the keys of the request counts of the hook with the given
+// id in bucket b. Counts are stored as "<id>-total" and "<id>-<period>", which
+// distinguishes them from the counts of hooks whose id starts with "<id>-".
+func statsKeys(b *bolt.Bucket, id string) (keys [][]byte) {
+	prefix := []byte(id + "-")
+	c := b.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if v == nil {
+			continue
+		}
+		kid, _, _, ok := parseStatsKey(string(k))
+		if string(k[len(prefix):]) == "total" || (ok && kid == id) {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+	}
+	return keys
+}
+
+// copyStats replaces the request counts of hook to with those of hook from,
+// which are removed if move is true.
+func copyStats(tx *bolt.Tx, from, to string, move bool) error {
+	if err := deleteStats(tx, to); err != nil {
+		return err
+	}
+	for _, b := range statsBuckets(tx) {
+		for _, k := range statsKeys(b, from) {
+			nk := append([]byte(to+"-"), k[len(from)+1:]...)
+			if err := copyKey(b, string(k), string(nk), move); err != nil {
 				return err
 			}
 		}
+	}
+
+	// copy the latency histogram
+	lb := tx.Bucket(BucketStats).Bucket(statsLatency)
+	if lb == nil || lb.Bucket([]byte(from)) == nil {
+		return nil
+	}
+	b, err := lb.CreateBucket([]byte(to))
+	if err != nil {
+		return err
+	}
+	if err := lb.Bucket([]byte(from)).ForEach(func(k, v []byte) error {
+		return b.Put(append([]byte(nil), k...), append([]byte(nil), v...))
+	}); err != nil {
+		return err
+	}
+	if move {
+		return lb.DeleteBucket([]byte(from))
+	}
+	return nil
+}
 
-		// retrieve total count
-		k := []byte(fmt.Sprintf("%s-total", id))
-		if err := gobDecode(b.Get(k), &c.Total); err != nil {
+// deleteStats removes the request counts of the hook with the given id.
+func deleteStats(tx *bolt.Tx, id string) error {
+	for _, b := range statsBuckets(tx) {
+		for _, k := range statsKeys(b, id) {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+	}
+	if lb := tx.Bucket(BucketStats).Bucket(statsLatency); lb != nil {
+		if err := lb.DeleteBucket([]byte(id)); err != nil && err != bolt.ErrBucketNotFound {
 			return err
 		}
-		return nil
+	}
+	return nil
+}
+
+// Inc increments the count for the hook with the given id. The outcomes of
+// requests are also counted separately. Nothing is counted for hooks that do
+// not exist.
+func (s *HookStore) Inc(id string, status Status) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(BucketHooks).Get([]byte(id)) == nil {
+			return nil
+		}
+		return inc(tx, id, status)
 	})
-	return c, nil
 }
 
-// Inc increments the count for the hook with the given id.
-func (s *HookStore) Inc(id string) error {
+// IncDelivery increments the count for the hook of delivery d, which was
+// processed with the given outcome, and adds the time its components spent
+// processing it to the latency histogram of the hook.
+func (s *HookStore) IncDelivery(d *Delivery, status Status) error {
 	return s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(BucketStats)
-		// increment; group by date and hour
-		err := increment([]byte(fmt.Sprintf("%s-%s", id, time.Now().Format(StatsTimeFormat))), b)
-		if err != nil {
+		if tx.Bucket(BucketHooks).Get([]byte(d.Hook)) == nil {
+			// the hook was deleted while the delivery was being processed
+			return nil
+		}
+		if err := inc(tx, d.Hook, status); err != nil {
 			return err
 		}
-		return increment([]byte(fmt.Sprintf("%s-total", id)), b)
+		var total time.Duration
+		for _, ts := range d.Trace {
+			total += ts.Duration
+		}
+		return observeLatency(tx, d.Hook, total)
 	})
 }
 
-func increment(key []byte, b *bolt.Bucket) (err error) {
+func inc(tx *bolt.Tx, id string, status Status) error {
+	b := tx.Bucket(BucketStats)
+	// increment; group by date and hour
+	err := increment([]byte(fmt.Sprintf("%s-%s", id, time.Now().Format(StatsTimeFormat))), b)
+	if err != nil {
+		return err
+	}
+	if err := increment([]byte(fmt.Sprintf("%s-total", id)), b); err != nil {
+		return err
+	}
+
+	if status != StatusDone && status != StatusFiltered && status != StatusFailed && status != StatusRejected {
+		return nil
+	}
+	sb, err := b.CreateBucketIfNotExists([]byte(status))
+	if err != nil {
+		return err
+	}
+	return increment([]byte(fmt.Sprintf("%s-total", id)), sb)
+}
+
+func increment(key []byte, b *bolt.Bucket) error {
+	return add(key, b, 1)
+}
+
+// add adds n to the count stored at key in b.
+func add(key []byte, b *bolt.Bucket, n int) (err error) {
 	var count int
 
 	var v []byte
 	if err = gobDecode(b.Get(key), &count); err != nil {
 		return err
 	}
-	count++
+	count += n
 	if v, err = gobEncode(count); err != nil {
 		return err
 	}
@@ -165,87 +731,193 @@ func gobDecode(p []byte, v interface{}) error {
 	return gob.NewDecoder(bytes.NewBuffer(p)).Decode(v)
 }
 
-// AddComponent adds component c to hook h, initializing it with the given
-// params.
-func (s *HookStore) AddComponent(h Hook, c string, params map[string]string) error {
-	cmp, ok := components[c]
+// AddComponent adds component hc to the end of the chain of hook h,
+// initializing it with the given params. The identifier of hc is assigned by
+// the store and returned.
+func (s *HookStore) AddComponent(h Hook, hc HookComponent, params map[string]string) (string, error) {
+	cmp, ok := components[hc.Name]
 	if !ok {
-		return fmt.Errorf("unknown components %s", c)
+		return "", fmt.Errorf("unknown components %s", hc.Name)
 	}
 
-	return s.db.Update(func(tx *bolt.Tx) error {
-		// each component gets their own bucket for storage
-		cb, err := tx.Bucket(BucketComponents).CreateBucketIfNotExists([]byte(c))
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		// the chain may have changed since h was read
+		cur, err := s.components(tx, h.ID)
 		if err != nil {
 			return err
 		}
 
-		if err := cmp.Init(h, params, cb); err != nil {
+		id, err := tx.Bucket(BucketComponents).NextSequence()
+		if err != nil {
 			return err
 		}
+		hc.ID = strconv.FormatUint(id, 10)
 
-		// ok, now add the component to the current hook
-		id := fmt.Sprintf("%d", time.Now().Unix())
-		// TODO: fetch components from database instead of using h.Components
-		hc := append(h.Components, HookComponent{id, c})
-
-		b := tx.Bucket(BucketHooks)
-		v, err := gobEncode(hc)
+		// each component instance gets their own bucket for storage
+		cb, err := hc.createBucket(tx)
 		if err != nil {
 			return err
 		}
-		return b.Put([]byte(h.ID), v)
+
+		if err := cmp.Init(h, params, cb); err != nil {
+			return err
+		}
+		return s.putComponents(tx, h.ID, append(cur.Components, hc))
 	})
+	return hc.ID, err
 }
 
-// DeleteComponent deletes component identified by id from hook h.
+// DeleteComponent deletes component identified by id from hook h, including
+// its stored params and data.
 func (s *HookStore) DeleteComponent(h Hook, id string) error {
 	return s.db.Update(func(tx *bolt.Tx) error {
-		hc := h.Components
-		for i, cmp := range hc {
-			if cmp.ID == id {
-				hc = append(hc[:i], hc[i+1:]...)
-				break
-			}
+		cur, err := s.components(tx, h.ID)
+		if err != nil {
+			return err
 		}
+		i := cur.component(id)
+		if i < 0 {
+			return errors.New("component does not exist")
+		}
+		if err := deleteComponent(tx, cur.Components[i]); err != nil {
+			return err
+		}
+		return s.putComponents(tx, h.ID, append(cur.Components[:i], cur.Components[i+1:]...))
+	})
+}
 
-		b := tx.Bucket(BucketHooks)
-		v, err := gobEncode(hc)
+// UpdateComponent reinitializes the component of hook h identified by hc.ID
+// with params and updates its retry policy.
+func (s *HookStore) UpdateComponent(h Hook, hc HookComponent, params map[string]string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		cur, err := s.components(tx, h.ID)
+		if err != nil {
+			return err
+		}
+		i := cur.component(hc.ID)
+		if i < 0 {
+			return errors.New("component does not exist")
+		}
+
+		cmp, ok := components[cur.Components[i].Name]
+		if !ok {
+			return fmt.Errorf("unknown components %s", cur.Components[i].Name)
+		}
+		cb, err := cur.Components[i].createBucket(tx)
 		if err != nil {
 			return err
 		}
-		return b.Put([]byte(h.ID), v)
+		if err := cmp.Init(h, params, cb); err != nil {
+			return err
+		}
+
+		cur.Components[i].Retry = hc.Retry
+		return s.putComponents(tx, h.ID, cur.Components)
 	})
 }
 
-// UpdateComponent reinitializes component c in hook h with params.
-func (s *HookStore) UpdateComponent(h Hook, c string, params map[string]string) error {
-	cmp, ok := components[c]
-	if !ok {
-		return fmt.Errorf("unknown components %s", c)
-	}
+// MoveComponent moves the component identified by cid of the hook with the
+// given id by offset positions in the processing order. A negative offset moves
+// it towards the start of the chain. Queued deliveries refer to the next
+// component by identifier, so they continue where they left off and follow the
+// new order from there.
+func (s *HookStore) MoveComponent(id, cid string, offset int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		h, err := s.components(tx, id)
+		if err != nil {
+			return err
+		}
 
+		i := h.component(cid)
+		if i < 0 {
+			return errors.New("component does not exist")
+		}
+		j := i + offset
+		if j < 0 {
+			j = 0
+		} else if j >= len(h.Components) {
+			j = len(h.Components) - 1
+		}
+
+		hc := h.Components[i]
+		if j < i {
+			copy(h.Components[j+1:i+1], h.Components[j:i])
+		} else {
+			copy(h.Components[i:j], h.Components[i+1:j+1])
+		}
+		h.Components[j] = hc
+		return s.putComponents(tx, id, h.Components)
+	})
+}
+
+// ReorderComponents changes the processing order of the components of the
+// hook with the given id. Order must contain the identifiers of all its
+// components exactly once. Like MoveComponent, it is safe to use while
+// deliveries are queued.
+func (s *HookStore) ReorderComponents(id string, order []string) error {
 	return s.db.Update(func(tx *bolt.Tx) error {
-		// each component gets their own bucket for storage
-		cb, err := tx.Bucket(BucketComponents).CreateBucketIfNotExists([]byte(c))
+		h, err := s.components(tx, id)
 		if err != nil {
 			return err
 		}
 
-		return cmp.Init(h, params, cb)
+		if len(order) != len(h.Components) {
+			return errors.New("order must contain every component exactly once")
+		}
+		hcs := make([]HookComponent, 0, len(order))
+		seen := make(map[string]bool)
+		for _, cid := range order {
+			i := h.component(cid)
+			if i < 0 || seen[cid] {
+				return errors.New("order must contain every component exactly once")
+			}
+			seen[cid] = true
+			hcs = append(hcs, h.Components[i])
+		}
+		return s.putComponents(tx, id, hcs)
 	})
 }
 
-// ComponentParams returns the stored params for component c id for hook h.
-func (s *HookStore) ComponentParams(h Hook, c string) (map[string]string, error) {
-	cmp, ok := components[c]
+// components returns the hook with the given id and its components as stored
+// in tx.
+func (s *HookStore) components(tx *bolt.Tx, id string) (*Hook, error) {
+	v := tx.Bucket(BucketHooks).Get([]byte(id))
+	if v == nil {
+		return nil, errors.New("hook does not exist")
+	}
+	h := &Hook{ID: id}
+	return h, gobDecode(v, &h.Components)
+}
+
+func (s *HookStore) putComponents(tx *bolt.Tx, id string, hc []HookComponent) error {
+	v, err := gobEncode(hc)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(BucketHooks).Put([]byte(id), v)
+}
+
+// component returns the index of the component identified by id in h, or -1
+// if h has no such component.
+func (h Hook) component(id string) int {
+	for i, hc := range h.Components {
+		if hc.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// ComponentParams returns the stored params for component hc of hook h.
+func (s *HookStore) ComponentParams(h Hook, hc HookComponent) (map[string]string, error) {
+	cmp, ok := components[hc.Name]
 	if !ok {
 		return nil, errors.New("invalid component")
 	}
 
 	var params map[string]string
 	err := s.db.View(func(tx *bolt.Tx) error {
-		if b := tx.Bucket(BucketComponents).Bucket([]byte(c)); b != nil {
+		if b := hc.bucket(tx); b != nil {
 			params = cmp.Params(h, b)
 		}
 		return nil
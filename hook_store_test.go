@@ -0,0 +1,414 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// componentOrder returns the names of the components of hook id in processing
+// order, given their ids by name.
+func componentOrder(t *testing.T, s *HookStore, id string, ids map[string]string) []string {
+	t.Helper()
+	h, err := s.Find(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]string)
+	for name, cid := range ids {
+		names[cid] = name
+	}
+	var got []string
+	for _, hc := range h.Components {
+		got = append(got, names[hc.ID])
+	}
+	return got
+}
+
+func TestMoveComponent(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset int
+		want   []string
+	}{
+		{"a", 1, []string{"b", "a", "c", "d"}},
+		{"a", -1, []string{"a", "b", "c", "d"}},
+		{"b", -1, []string{"b", "a", "c", "d"}},
+		{"b", 2, []string{"a", "c", "d", "b"}},
+		{"b", 10, []string{"a", "c", "d", "b"}},
+		{"d", -2, []string{"a", "d", "b", "c"}},
+		{"d", -10, []string{"d", "a", "b", "c"}},
+		{"c", 0, []string{"a", "b", "c", "d"}},
+	}
+	for _, tt := range tests {
+		s := &HookStore{testDB(t)}
+		_, ids := testHook(t, s, "hook", "a", "b", "c", "d")
+		if err := s.MoveComponent("hook", ids[tt.name], tt.offset); err != nil {
+			t.Errorf("MoveComponent(%s, %d): %s", tt.name, tt.offset, err)
+			continue
+		}
+		if got := componentOrder(t, s, "hook", ids); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("MoveComponent(%s, %d) order = %q, want %q", tt.name, tt.offset, got, tt.want)
+		}
+	}
+
+	s := &HookStore{testDB(t)}
+	testHook(t, s, "hook", "a")
+	if err := s.MoveComponent("hook", "unknown", 1); err == nil {
+		t.Error("MoveComponent of an unknown component succeeded")
+	}
+	if err := s.MoveComponent("unknown", "1", 1); err == nil {
+		t.Error("MoveComponent in an unknown hook succeeded")
+	}
+}
+
+func TestReorderComponents(t *testing.T) {
+	tests := []struct {
+		order []string
+		err   bool
+	}{
+		{[]string{"c", "a", "b"}, false},
+		{[]string{"a", "b", "c"}, false},
+		{[]string{"a", "b"}, true},
+		{[]string{"a", "b", "b"}, true},
+		{[]string{"a", "b", "c", "c"}, true},
+		{[]string{"a", "b", "x"}, true},
+		{nil, true},
+	}
+	for _, tt := range tests {
+		s := &HookStore{testDB(t)}
+		_, ids := testHook(t, s, "hook", "a", "b", "c")
+		var order []string
+		for _, name := range tt.order {
+			id, ok := ids[name]
+			if !ok {
+				id = name
+			}
+			order = append(order, id)
+		}
+
+		err := s.ReorderComponents("hook", order)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ReorderComponents(%q) succeeded, want error", tt.order)
+			}
+			if got, want := componentOrder(t, s, "hook", ids), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("ReorderComponents(%q) failed but changed the order to %q", tt.order, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ReorderComponents(%q): %s", tt.order, err)
+			continue
+		}
+		if got := componentOrder(t, s, "hook", ids); !reflect.DeepEqual(got, tt.order) {
+			t.Errorf("ReorderComponents(%q) order = %q", tt.order, got)
+		}
+	}
+}
+
+// testHookData gives hook id a queued, a processed and a failed delivery and
+// counts a request.
+func testHookData(t *testing.T, s *HookStore, q *Queue, id string) {
+	t.Helper()
+	h, err := s.Find(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, status := range []Status{StatusPending, StatusDone, StatusFailed} {
+		d := &Delivery{Hook: id, Request: Request{Body: []byte(id)}}
+		if err := q.Push(d); err != nil {
+			t.Fatal(err)
+		}
+		switch status {
+		case StatusDone:
+			err = q.Done(d, status)
+		case StatusFailed:
+			err = q.Bury(d, h.Components[0], errors.New("failed"))
+		}
+		if err != nil {
+			t.Fatalf("delivery %d: %s", i, err)
+		}
+	}
+	if err := s.Inc(id, StatusDone); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// hookData describes the data stored for a hook.
+type hookData struct {
+	Exists      bool
+	Components  int // component instances with a storage bucket
+	Queued      int
+	History     int
+	DeadLetters int
+	Total       int // request count
+}
+
+func findHookData(t *testing.T, s *HookStore, q *Queue, id string, hcs []HookComponent) (d hookData) {
+	t.Helper()
+	_, err := s.Find(id)
+	d.Exists = err == nil
+	s.db.View(func(tx *bolt.Tx) error {
+		for _, hc := range hcs {
+			if hc.bucket(tx) != nil {
+				d.Components++
+			}
+		}
+		return nil
+	})
+	var records []Record
+	var dls []DeadLetter
+	var c Count
+	if d.Queued, err = q.Pending(id); err != nil {
+		t.Fatal(err)
+	}
+	if records, err = q.History(id, 100); err != nil {
+		t.Fatal(err)
+	}
+	if dls, err = q.DeadLetters(id); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = s.RequestCount(id); err != nil {
+		t.Fatal(err)
+	}
+	d.History, d.DeadLetters, d.Total = len(records), len(dls), c.Total
+	return d
+}
+
+func TestDelete(t *testing.T) {
+	for _, keepStats := range []bool{false, true} {
+		db, s, q := testStores(t)
+		us := &UserStore{db}
+		foo, _ := testHook(t, s, "foo", "a", "b")
+		testHook(t, s, "foo-bar", "c")
+		testHookData(t, s, q, "foo")
+		testHookData(t, s, q, "foo-bar")
+		testEditors(t, us, map[string][]string{"both": {"foo", "foo-bar"}, "foo": {"foo"}})
+
+		if err := s.Delete("foo", keepStats); err != nil {
+			t.Fatalf("Delete: %s", err)
+		}
+
+		want := hookData{}
+		if keepStats {
+			want.Total = 1
+		}
+		if got := findHookData(t, s, q, "foo", foo.Components); got != want {
+			t.Errorf("keepStats %t: data of deleted hook = %+v, want %+v", keepStats, got, want)
+		}
+		want = hookData{Exists: true, Components: 1, Queued: 1, History: 3, DeadLetters: 1, Total: 1}
+		bar, _ := s.Find("foo-bar")
+		if got := findHookData(t, s, q, "foo-bar", bar.Components); got != want {
+			t.Errorf("keepStats %t: data of other hook = %+v, want %+v", keepStats, got, want)
+		}
+
+		// a new hook with the same id is not managed by the old editors
+		if err := s.Create(Hook{ID: "foo"}); err != nil {
+			t.Fatal(err)
+		}
+		checkEditors(t, us, map[string][]string{"both": {"foo-bar"}, "foo": nil})
+	}
+
+	s := &HookStore{testDB(t)}
+	if err := s.Delete("unknown", false); err == nil {
+		t.Error("Delete of an unknown hook succeeded")
+	}
+}
+
+// testEditors creates an editor for every set of hooks by name.
+func testEditors(t *testing.T, us *UserStore, editors map[string][]string) {
+	t.Helper()
+	for name, hooks := range editors {
+		if err := us.Create(User{Name: name, Role: RoleEditor, Hooks: hooks}, "password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkEditors reports the editors whose hooks differ from want by name.
+func checkEditors(t *testing.T, us *UserStore, want map[string][]string) {
+	t.Helper()
+	for name, hooks := range want {
+		u, err := us.Find(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(u.Hooks, hooks) {
+			t.Errorf("hooks of %s = %q, want %q", name, u.Hooks, hooks)
+		}
+	}
+}
+
+func TestRename(t *testing.T) {
+	db, s, q := testStores(t)
+	us := &UserStore{db}
+	foo, _ := testHook(t, s, "foo", "a", "b")
+	testHook(t, s, "foo-bar", "c")
+	testHookData(t, s, q, "foo")
+	testHookData(t, s, q, "foo-bar")
+	testEditors(t, us, map[string][]string{
+		"both":  {"foo", "foo-bar"},
+		"foo":   {"foo"},
+		"stale": {"baz", "foo"}, // assigned to a hook with the new id before
+	})
+
+	if err := s.Rename("foo", "foo-bar"); err == nil {
+		t.Error("Rename to an existing hook succeeded")
+	}
+	if err := s.Rename("foo", "baz"); err != nil {
+		t.Fatalf("Rename: %s", err)
+	}
+
+	if got, want := findHookData(t, s, q, "foo", nil), (hookData{}); got != want {
+		t.Errorf("data of old id = %+v, want %+v", got, want)
+	}
+	want := hookData{Exists: true, Components: 2, Queued: 1, History: 3, DeadLetters: 1, Total: 1}
+	if got := findHookData(t, s, q, "baz", foo.Components); got != want {
+		t.Errorf("data of new id = %+v, want %+v", got, want)
+	}
+	want = hookData{Exists: true, Components: 1, Queued: 1, History: 3, DeadLetters: 1, Total: 1}
+	bar, _ := s.Find("foo-bar")
+	if got := findHookData(t, s, q, "foo-bar", bar.Components); got != want {
+		t.Errorf("data of other hook = %+v, want %+v", got, want)
+	}
+	records, _ := q.History("baz", 100)
+	dls, _ := q.DeadLetters("baz")
+	if records[0].Hook != "baz" || dls[0].Hook != "baz" {
+		t.Errorf("history and dead letters refer to %q and %q, want baz", records[0].Hook, dls[0].Hook)
+	}
+
+	checkEditors(t, us, map[string][]string{
+		"both":  {"foo-bar", "baz"},
+		"foo":   {"baz"},
+		"stale": {"baz"},
+	})
+}
+
+func TestClone(t *testing.T) {
+	for _, stats := range []bool{false, true} {
+		db, s, q := testStores(t)
+		us := &UserStore{db}
+		foo, _ := testHook(t, s, "foo", "a", "b")
+		testHookData(t, s, q, "foo")
+		testEditors(t, us, map[string][]string{"foo": {"foo"}})
+		if err := s.UpdateSettings("foo", Settings{Sync: true}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Clone("foo", "foo", stats); err == nil {
+			t.Errorf("stats %t: Clone to an existing hook succeeded", stats)
+		}
+		if err := s.Clone("foo", "baz", stats); err != nil {
+			t.Fatalf("stats %t: Clone: %s", stats, err)
+		}
+
+		want := hookData{Exists: true, Components: 2, Queued: 1, History: 3, DeadLetters: 1, Total: 1}
+		if got := findHookData(t, s, q, "foo", foo.Components); got != want {
+			t.Errorf("stats %t: data of original = %+v, want %+v", stats, got, want)
+		}
+		clone, err := s.Find("baz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = hookData{Exists: true, Components: 2}
+		if stats {
+			want.Total = 1
+		}
+		if got := findHookData(t, s, q, "baz", clone.Components); got != want {
+			t.Errorf("stats %t: data of clone = %+v, want %+v", stats, got, want)
+		}
+		if !clone.Settings.Sync {
+			t.Errorf("stats %t: settings not cloned", stats)
+		}
+		for i, hc := range clone.Components {
+			if hc.ID == foo.Components[i].ID || hc.Name != foo.Components[i].Name {
+				t.Errorf("stats %t: component %d of clone = %+v, want a new instance of %+v", stats, i, hc, foo.Components[i])
+			}
+		}
+		params, err := s.ComponentParams(*clone, clone.Components[1])
+		if err != nil || params["name"] != "b" {
+			t.Errorf("stats %t: params of cloned component = %v, %v, want name b", stats, params, err)
+		}
+
+		checkEditors(t, us, map[string][]string{"foo": {"foo"}})
+	}
+}
+
+func TestComponentChangesOnStaleHook(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(s *HookStore, h Hook, ids map[string]string) error
+		err    bool
+		want   []string
+	}{
+		{
+			name: "add",
+			change: func(s *HookStore, h Hook, ids map[string]string) error {
+				var err error
+				ids["d"], err = s.AddComponent(h, HookComponent{Name: "test-action"}, map[string]string{"name": "d"})
+				return err
+			},
+			want: []string{"c", "a", "b", "d"},
+		},
+		{
+			name: "delete",
+			change: func(s *HookStore, h Hook, ids map[string]string) error {
+				return s.DeleteComponent(h, ids["a"])
+			},
+			want: []string{"c", "b"},
+		},
+		{
+			name: "update",
+			change: func(s *HookStore, h Hook, ids map[string]string) error {
+				return s.UpdateComponent(h, HookComponent{ID: ids["a"], Retry: RetryPolicy{MaxAttempts: 5}}, map[string]string{"name": "a"})
+			},
+			want: []string{"c", "a", "b"},
+		},
+		{
+			name: "delete removed component",
+			change: func(s *HookStore, h Hook, ids map[string]string) error {
+				return s.DeleteComponent(h, ids["removed"])
+			},
+			err:  true,
+			want: []string{"c", "a", "b"},
+		},
+		{
+			name: "update removed component",
+			change: func(s *HookStore, h Hook, ids map[string]string) error {
+				return s.UpdateComponent(h, HookComponent{ID: ids["removed"]}, map[string]string{"name": "removed"})
+			},
+			err:  true,
+			want: []string{"c", "a", "b"},
+		},
+	}
+
+	for _, tt := range tests {
+		s := &HookStore{testDB(t)}
+		stale, ids := testHook(t, s, "hook", "a", "b", "c", "removed")
+
+		// another change commits after the hook was read
+		if err := s.DeleteComponent(*stale, ids["removed"]); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.ReorderComponents("hook", []string{ids["c"], ids["a"], ids["b"]}); err != nil {
+			t.Fatal(err)
+		}
+
+		err := tt.change(s, *stale, ids)
+		if tt.err != (err != nil) {
+			t.Errorf("%s: error = %v, want error %t", tt.name, err, tt.err)
+		}
+		if got := componentOrder(t, s, "hook", ids); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: order = %q, want %q", tt.name, got, tt.want)
+		}
+		if tt.name == "update" {
+			h, _ := s.Find("hook")
+			if r := h.Components[h.component(ids["a"])].Retry; r.MaxAttempts != 5 {
+				t.Errorf("%s: retry policy = %+v, want 5 attempts", tt.name, r)
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// JanitorInterval is the time between two runs of the janitor, which
+	// removes expired component data and rolls up request counts.
+	JanitorInterval = 1 * time.Hour
+)
+
+// Expire removes the expired data of all component instances that implement
+// Expirer. Every instance is handled in its own transaction, so requests are
+// not blocked for long. It returns the number of removed entries.
+func (s *HookStore) Expire(now time.Time) (n int, err error) {
+	var hooks []*Hook
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BucketHooks).ForEach(func(k, v []byte) error {
+			h, err := s.components(tx, string(k))
+			if err != nil {
+				return err
+			}
+			hooks = append(hooks, h)
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, h := range hooks {
+		for _, hc := range h.Components {
+			cmp, ok := components[hc.Name].(Expirer)
+			if !ok {
+				continue
+			}
+			err := s.db.Update(func(tx *bolt.Tx) error {
+				b := hc.bucket(tx)
+				if b == nil {
+					// removed in the meantime
+					return nil
+				}
+				m, err := cmp.Expire(*h, b, now)
+				if err != nil {
+					return err
+				}
+				n += m
+				return nil
+			})
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// runJanitor removes expired component data from s and rolls up its request
+// counts according to r every interval.
+func runJanitor(s *HookStore, interval time.Duration, r StatsRetention) {
+	for {
+		n, err := s.Expire(time.Now())
+		if err != nil {
+			log.Printf("error removing expired data: %s", err)
+		} else if n > 0 {
+			log.Printf("Removed %d expired replay protection entries", n)
+		}
+		n, err = s.RollUp(time.Now(), r)
+		if err != nil {
+			log.Printf("error rolling up request counts: %s", err)
+		} else if n > 0 {
+			log.Printf("Rolled up %d request counts", n)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -19,8 +19,12 @@ func (LogAction) Name() string { return "Log" }
 // Template returns the HTML template name of this component.
 func (LogAction) Template() string { return "" }
 
-// Params returns the currently stored configuration parameters for hook h
-// from bucket b.
+// Parameters returns the names of the configuration parameters.
+func (LogAction) Parameters() []string {
+	return nil
+}
+
+// Params returns the currently stored configuration parameters from bucket b.
 func (LogAction) Params(h Hook, b *bolt.Bucket) map[string]string {
 	return nil
 }
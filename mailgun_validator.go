@@ -5,8 +5,10 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
-	"fmt"
+	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
@@ -26,45 +28,48 @@ func (MailgunValidator) Name() string { return "Mailgun validator" }
 // Template returns the HTML template name of this component.
 func (MailgunValidator) Template() string { return "mailgun-validator" }
 
-// Params returns the currently stored configuration parameters for hook h
-// from bucket b.
-func (MailgunValidator) Params(h Hook, b *bolt.Bucket) map[string]string {
+// Parameters returns the names of the configuration parameters.
+func (MailgunValidator) Parameters() []string {
+	return []string{"apikey", "retention"}
+}
+
+// Params returns the currently stored configuration parameters from bucket b.
+func (c MailgunValidator) Params(h Hook, b *bolt.Bucket) map[string]string {
 	m := make(map[string]string)
-	for _, k := range []string{"apikey"} {
-		m[k] = string(b.Get([]byte(fmt.Sprintf("%s-%s", h.ID, k))))
+	for _, k := range c.Parameters() {
+		m[k] = string(b.Get([]byte(k)))
 	}
 	return m
 }
 
 // Init initializes this component. It requires a Mailgun API key to be
-// present.
+// present, the retention of request tokens is optional.
 func (MailgunValidator) Init(h Hook, params map[string]string, b *bolt.Bucket) error {
 	apikey, ok := params["apikey"]
 	if !ok {
-		return errors.New("apikey is required")
+		return invalidParam("apikey", "apikey is required")
 	}
-	if err := b.Put([]byte(fmt.Sprintf("%s-apikey", h.ID)), []byte(apikey)); err != nil {
+	if err := b.Put([]byte("apikey"), []byte(apikey)); err != nil {
 		return err
 	}
-	_, err := b.CreateBucketIfNotExists([]byte("tokens"))
-	return err
+	return initReplayProtection(params, b, "tokens")
 }
 
 // Process verifies the signature and uniqueness of the random roken.
 func (MailgunValidator) Process(h Hook, r Request, b *bolt.Bucket) error {
 	// Check HMAC
-	apikey := b.Get([]byte(fmt.Sprintf("%s-apikey", h.ID)))
+	apikey := b.Get([]byte("apikey"))
 	if apikey == nil {
 		return errors.New("mailgun validator not initialized")
 	}
 
 	if r.Headers["Content-Type"] != "application/x-www-form-urlencoded" {
-		return fmt.Errorf("unexpected Content-Type: %q", r.Headers["Content-Type"])
+		return FilterStatus(http.StatusUnsupportedMediaType, "unexpected Content-Type: %q", r.Headers["Content-Type"])
 	}
 
 	form, err := url.ParseQuery(string(r.Body))
 	if err != nil {
-		return fmt.Errorf("error parsing request body: %s", err)
+		return FilterStatus(http.StatusBadRequest, "error parsing request body: %s", err)
 	}
 
 	timestamp := form.Get("timestamp")
@@ -75,13 +80,30 @@ func (MailgunValidator) Process(h Hook, r Request, b *bolt.Bucket) error {
 	mac.Write([]byte(timestamp + token))
 	expected := []byte(hex.EncodeToString(mac.Sum(nil)))
 	if !hmac.Equal(signature, expected) {
-		return errors.New("invalid signature")
+		return FilterStatus(http.StatusUnauthorized, "invalid signature")
+	}
+
+	// Tokens are forgotten after the retention period, so older requests
+	// cannot be checked for uniqueness anymore
+	now := time.Now()
+	retention := replayRetention(b, DefaultReplayRetention)
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || now.Sub(time.Unix(ts, 0)) >= retention {
+		return Filter("request timestamp is too old")
 	}
 
 	// Check uniqueness
-	tokens := b.Bucket([]byte("tokens"))
-	if p := tokens.Get([]byte(token)); p != nil {
-		return errors.New("duplicate request token received")
+	dup, err := seen(b, "tokens", []byte(token), now, retention)
+	if err != nil {
+		return err
+	}
+	if dup {
+		return Filter("duplicate request token received")
 	}
-	return tokens.Put([]byte(token), []byte{})
+	return nil
+}
+
+// Expire removes request tokens older than the retention period.
+func (MailgunValidator) Expire(h Hook, b *bolt.Bucket, now time.Time) (int, error) {
+	return expireSeen(b, "tokens", now, replayRetention(b, DefaultReplayRetention))
 }
@@ -2,8 +2,10 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -17,68 +19,191 @@ const (
 
 // flags
 var (
-	listenAddr = flag.String("http", ":9000", "Public HTTP listen address for incoming webhooks")
-	adminAddr  = flag.String("admin", ":9001", "Private HTTP listen address for admin interface")
-	database   = flag.String("db", "data.db", "Database file to use")
+	listenAddr  = flag.String("http", ":9000", "Public HTTP listen address for incoming webhooks")
+	adminAddr   = flag.String("admin", ":9001", "Private HTTP listen address for admin interface")
+	database    = flag.String("db", "data.db", "Database file to use")
+	workers     = flag.Int("workers", 4, "Number of workers processing queued requests")
+	historyBody = flag.Int("history-body", 64*1024, "Maximum number of body bytes stored in the delivery history")
+	configFile  = flag.String("config", "", "Configuration file describing hooks to apply at startup")
+	prune       = flag.Bool("prune", false, "Delete hooks that are not in the -config file")
+	metricsAddr = flag.String("metrics", "", "HTTP listen address for Prometheus metrics without authentication, empty disables")
+	maxBacklog  = flag.Int("max-backlog", 1000, "Number of queued requests of active hooks above which /readyz reports not ready, 0 disables")
+
+	maxBody        = flag.Int64("max-body", 10<<20, "Maximum request body size in bytes for incoming webhooks")
+	maxHeaders     = flag.Int("max-headers", 100, "Maximum number of headers in incoming webhook requests")
+	maxHeaderBytes = flag.Int("max-header-bytes", 1<<20, "Maximum size in bytes of the request headers of incoming webhooks")
+	readTimeout    = flag.Duration("read-timeout", 30*time.Second, "Maximum duration for reading an entire incoming webhook request")
+
+	upstreamTimeout = flag.Duration("upstream-timeout", 30*time.Second, "Maximum duration of outgoing HTTP requests made by components")
+
+	statsHourly  = flag.Duration("stats-hourly", 7*24*time.Hour, "Age after which hourly request counts are rolled up into daily counts")
+	statsDaily   = flag.Duration("stats-daily", 90*24*time.Hour, "Age after which daily request counts are rolled up into monthly counts")
+	statsMonthly = flag.Duration("stats-monthly", 0, "Age after which monthly request counts are deleted, 0 keeps them forever")
 )
 
 // Database constants
 var (
-	BucketHooks      = []byte("hooks")
-	BucketComponents = []byte("components")
-	BucketStats      = []byte("stats")
+	BucketHooks       = []byte("hooks")
+	BucketComponents  = []byte("components")
+	BucketStats       = []byte("stats")
+	BucketQueue       = []byte("queue")
+	BucketDeadLetters = []byte("deadletters")
+	BucketHistory     = []byte("history")
+	BucketSettings    = []byte("settings")
+	BucketMeta        = []byte("meta")
+	BucketUsers       = []byte("users")
+	BucketSessions    = []byte("sessions")
+	BucketTokens      = []byte("tokens")
 )
 
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args()); err != nil {
+			fmt.Fprintf(os.Stderr, "rehook: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	statsRetention := StatsRetention{*statsHourly, *statsDaily, *statsMonthly}
+	if err := statsRetention.validate(); err != nil {
+		log.Fatal(err)
+	}
+
 	// initialize database
-	db, err := bolt.Open(*database, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	db, err := openDB(*database, 1*time.Second)
 	if err != nil {
 		log.Fatalf("Could not open database: %s", err)
 	}
 	defer db.Close()
 
-	if err := db.Update(initBuckets); err != nil {
-		log.Fatal(err)
+	hookStore := &HookStore{db}
+
+	if *configFile != "" {
+		c, err := loadConfig(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := hookStore.Apply(c, *prune); err != nil {
+			log.Fatalf("Could not apply %s: %s", *configFile, err)
+		}
+		log.Printf("Applied configuration from %s", *configFile)
 	}
 
-	hookStore := &HookStore{db}
+	go runJanitor(hookStore, JanitorInterval, statsRetention)
 
 	// webhooks
-	hh := &HookHandler{hookStore, db}
+	queue := NewQueue(db)
+	hh := &HookHandler{hookStore, db, queue}
+	queue.Start(*workers, func(d *Delivery) { hh.processRequest(d) })
+
+	health := &HealthHandler{db, queue, *maxBacklog}
+
 	router := httprouter.New()
+	router.GET("/healthz", health.Health)
+	router.GET("/readyz", health.Ready)
 	router.GET("/h/:id", hh.ReceiveHook)
 	router.POST("/h/:id", hh.ReceiveHook)
-
+	router.GET("/h/:id/*path", hh.ReceiveHook)
+	router.POST("/h/:id/*path", hh.ReceiveHook)
+
+	server := &http.Server{
+		Addr:              *listenAddr,
+		Handler:           router,
+		ReadTimeout:       *readTimeout,
+		ReadHeaderTimeout: *readTimeout,
+		IdleTimeout:       2 * time.Minute,
+		MaxHeaderBytes:    *maxHeaderBytes,
+	}
 	go func() {
 		log.Printf("Listening on %s", *listenAddr)
-		log.Print(http.ListenAndServe(*listenAddr, router))
+		log.Print(server.ListenAndServe())
 	}()
 
+	// metrics
+	mh := &MetricsHandler{hookStore, queue, db}
+	if *metricsAddr != "" {
+		mrouter := httprouter.New()
+		mrouter.GET("/metrics", mh.Metrics)
+		go func() {
+			log.Printf("Metrics on %s", *metricsAddr)
+			log.Print(http.ListenAndServe(*metricsAddr, mrouter))
+		}()
+	}
+
 	// admin interface
-	ah := &AdminHandler{hookStore}
+	ah := &AdminHandler{hookStore, queue, db}
+	auth := &AuthHandler{&UserStore{db}, hookStore}
 	arouter := httprouter.New()
 	arouter.Handler("GET", "/public/*path", http.StripPrefix("/public", http.FileServer(http.Dir("public"))))
 	arouter.GET("/", ah.Index)
 	arouter.Handler("GET", "/hooks", http.RedirectHandler("/", http.StatusMovedPermanently))
 
+	arouter.GET("/login", auth.LoginForm)
+	arouter.POST("/login", auth.Login)
+	arouter.POST("/logout", auth.Logout)
+	arouter.GET("/setup", auth.SetupForm)
+	arouter.POST("/setup", auth.Setup)
+
+	arouter.GET("/users", auth.Users)
+	arouter.POST("/users", auth.CreateUser)
+	arouter.POST("/users/:name", auth.UpdateUser)
+
+	arouter.GET("/tokens", auth.Tokens)
+	arouter.POST("/tokens", auth.CreateToken)
+	arouter.POST("/tokens/:token", auth.DeleteToken)
+
+	arouter.GET("/export", ah.Export)
+	arouter.GET("/database", ah.Database)
+	arouter.POST("/database/compact", ah.CompactDatabase)
+
 	arouter.GET("/hooks/new", ah.NewHook)
 	arouter.POST("/hooks", ah.CreateHook)
 	arouter.GET("/hooks/edit/:id", ah.EditHook)
 	arouter.POST("/hooks/edit/:id", ah.UpdateHook)
+	arouter.GET("/hooks/edit/:id/copy", ah.CopyHookForm)
+	arouter.POST("/hooks/edit/:id/copy", ah.CopyHook)
 
 	arouter.GET("/hooks/edit/:id/add", ah.AddComponent)
 	arouter.POST("/hooks/edit/:id/create", ah.CreateComponent)
 	arouter.GET("/hooks/edit/:id/edit/:c", ah.EditComponent)
 	arouter.POST("/hooks/edit/:id/update/:c", ah.UpdateComponent)
 
+	arouter.GET("/hooks/edit/:id/failed", ah.DeadLetters)
+	arouter.GET("/hooks/edit/:id/failed/:d", ah.DeadLetter)
+	arouter.POST("/hooks/edit/:id/failed/:d", ah.UpdateDeadLetter)
+
+	arouter.GET("/hooks/edit/:id/history", ah.History)
+	arouter.GET("/hooks/edit/:id/history/:d", ah.Delivery)
+
+	// JSON API
+	api := &APIHandler{hookStore, queue}
+	arouter.GET("/api/v1/export", api.Export)
+	arouter.GET("/api/v1/components", api.Components)
+	arouter.GET("/api/v1/hooks", api.Hooks)
+	arouter.POST("/api/v1/hooks", api.CreateHook)
+	arouter.GET("/api/v1/hooks/:id", api.Hook)
+	arouter.DELETE("/api/v1/hooks/:id", api.DeleteHook)
+	arouter.GET("/api/v1/hooks/:id/stats", api.Stats)
+	arouter.POST("/api/v1/hooks/:id/components", api.AddComponent)
+	arouter.PUT("/api/v1/hooks/:id/components", api.ReorderComponents)
+	arouter.PUT("/api/v1/hooks/:id/components/:c", api.UpdateComponent)
+	arouter.DELETE("/api/v1/hooks/:id/components/:c", api.DeleteComponent)
+	arouter.POST("/api/v1/deliveries/:id/replay", api.Replay)
+
+	arouter.GET("/metrics", mh.Metrics)
+	arouter.GET("/healthz", health.Health)
+	arouter.GET("/readyz", health.Ready)
+
 	log.Printf("Admin interface on %s", *adminAddr)
-	log.Print(http.ListenAndServe(*adminAddr, arouter))
+	log.Print(http.ListenAndServe(*adminAddr, auth.Require(arouter)))
 }
 
 func initBuckets(t *bolt.Tx) error {
-	for _, name := range [][]byte{BucketHooks, BucketStats, BucketComponents} {
+	for _, name := range [][]byte{BucketHooks, BucketStats, BucketComponents, BucketQueue, BucketDeadLetters, BucketHistory, BucketSettings, BucketMeta, BucketUsers, BucketSessions, BucketTokens} {
 		if _, err := t.CreateBucketIfNotExists(name); err != nil {
 			return err
 		}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/boltdb/bolt"
+	"github.com/julienschmidt/httprouter"
+)
+
+// counterVec is a set of counters that are kept in memory, identified by the
+// values of their labels. They start at zero when rehook starts.
+type counterVec struct {
+	mu     sync.Mutex
+	labels []string
+	values map[string]float64 // by label values joined with \x00
+}
+
+func newCounterVec(labels ...string) *counterVec {
+	return &counterVec{labels: labels, values: make(map[string]float64)}
+}
+
+// inc increments the counter with the given label values.
+func (c *counterVec) inc(values ...string) {
+	c.mu.Lock()
+	c.values[strings.Join(values, "\x00")]++
+	c.mu.Unlock()
+}
+
+// write writes all counters as metric name to mw.
+func (c *counterVec) write(mw *metricWriter, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var labels []string
+		for i, v := range strings.Split(k, "\x00") {
+			labels = append(labels, c.labels[i], v)
+		}
+		mw.value(name, c.values[k], labels...)
+	}
+}
+
+var (
+	// retries counts the retries scheduled after a component failed.
+	retries = newCounterVec("hook", "component", "type")
+
+	// forwardResponses counts the response codes of the targets of the
+	// forward request action.
+	forwardResponses = newCounterVec("hook", "code")
+)
+
+// MetricsHandler serves metrics in the Prometheus text format.
+type MetricsHandler struct {
+	hooks *HookStore
+	queue *Queue
+	db    *DB
+}
+
+// hookMetrics contains the counts of a single hook.
+type hookMetrics struct {
+	hook   *Hook
+	count  Count
+	counts map[string]ComponentCount
+}
+
+// Metrics responds with the request counts of all hooks and their components,
+// the size of the queue and statistics of the database.
+func (h *MetricsHandler) Metrics(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var hooks []hookMetrics
+	err := h.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BucketHooks).ForEach(func(k, v []byte) error {
+			hook, err := h.hooks.components(tx, string(k))
+			if err != nil {
+				return err
+			}
+			hm := hookMetrics{hook: hook, counts: make(map[string]ComponentCount)}
+			if hm.count, err = totalCount(tx, hook.ID); err != nil {
+				return err
+			}
+			for _, hc := range hook.Components {
+				if hm.counts[hc.ID], err = componentCount(tx, hc.ID); err != nil {
+					return err
+				}
+			}
+			hooks = append(hooks, hm)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("error loading metrics: %s", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	depth, err := h.queue.Depth()
+	if err != nil {
+		log.Printf("error loading metrics: %s", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	size, err := h.db.Stats()
+	if err != nil {
+		log.Printf("error loading metrics: %s", err)
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	stats := h.db.BoltStats()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mw := &metricWriter{w: bufio.NewWriter(w)}
+	defer mw.w.Flush()
+
+	mw.help("rehook_requests_total", "counter", "Requests received per hook.")
+	for _, hm := range hooks {
+		mw.value("rehook_requests_total", float64(hm.count.Total), "hook", hm.hook.ID)
+	}
+
+	mw.help("rehook_request_outcomes_total", "counter", "Requests per hook by outcome.")
+	for _, hm := range hooks {
+		c := hm.count
+		for i, n := range []int{c.Succeeded, c.Filtered, c.Failed, c.Rejected} {
+			mw.value("rehook_request_outcomes_total", float64(n), "hook", hm.hook.ID, "outcome", string(outcomes[i]))
+		}
+	}
+
+	mw.help("rehook_processing_duration_seconds", "histogram", "Time the components of a hook spent processing a request, including failed attempts.")
+	for _, hm := range hooks {
+		l := hm.count.Latency
+		var n int
+		for i, c := range l.Counts {
+			n += c
+			le := "+Inf"
+			if i < len(LatencyBuckets) {
+				le = strconv.FormatFloat(LatencyBuckets[i].Seconds(), 'g', -1, 64)
+			}
+			mw.value("rehook_processing_duration_seconds_bucket", float64(n), "hook", hm.hook.ID, "le", le)
+		}
+		mw.value("rehook_processing_duration_seconds_sum", l.Sum.Seconds(), "hook", hm.hook.ID)
+		mw.value("rehook_processing_duration_seconds_count", float64(n), "hook", hm.hook.ID)
+	}
+
+	mw.help("rehook_component_requests_total", "counter", "Requests processed per component by outcome.")
+	for _, hm := range hooks {
+		for _, hc := range hm.hook.Components {
+			c := hm.counts[hc.ID]
+			for _, o := range []struct {
+				outcome Outcome
+				n       int
+			}{{OutcomePassed, c.Passed}, {OutcomeFiltered, c.Filtered}, {OutcomeErrored, c.Errored}} {
+				mw.value("rehook_component_requests_total", float64(o.n), "hook", hm.hook.ID, "component", hc.ID, "type", hc.Name, "outcome", string(o.outcome))
+			}
+		}
+	}
+
+	mw.help("rehook_component_duration_seconds_total", "counter", "Time spent processing requests per component.")
+	for _, hm := range hooks {
+		for _, hc := range hm.hook.Components {
+			mw.value("rehook_component_duration_seconds_total", hm.counts[hc.ID].Duration.Seconds(), "hook", hm.hook.ID, "component", hc.ID, "type", hc.Name)
+		}
+	}
+
+	mw.help("rehook_component_retries_total", "counter", "Retries scheduled after a component failed, since rehook started.")
+	retries.write(mw, "rehook_component_retries_total")
+
+	mw.help("rehook_forward_responses_total", "counter", "Response codes of forwarded requests, since rehook started.")
+	forwardResponses.write(mw, "rehook_forward_responses_total")
+
+	mw.help("rehook_queue_depth", "gauge", "Requests waiting in the queue per hook.")
+	for _, hm := range hooks {
+		mw.value("rehook_queue_depth", float64(depth[hm.hook.ID]), "hook", hm.hook.ID)
+	}
+
+	mw.help("rehook_db_size_bytes", "gauge", "Size of the database file.")
+	mw.value("rehook_db_size_bytes", float64(size.Size))
+	mw.help("rehook_db_free_bytes", "gauge", "Bytes in unused pages of the database file.")
+	mw.value("rehook_db_free_bytes", float64(size.Free))
+	mw.help("rehook_db_free_pages", "gauge", "Free pages in the database file.")
+	mw.value("rehook_db_free_pages", float64(stats.FreePageN))
+	mw.help("rehook_db_pending_pages", "gauge", "Pages that are freed once no read transaction uses them.")
+	mw.value("rehook_db_pending_pages", float64(stats.PendingPageN))
+	mw.help("rehook_db_read_transactions_total", "counter", "Read transactions started since the database was opened.")
+	mw.value("rehook_db_read_transactions_total", float64(stats.TxN))
+	mw.help("rehook_db_open_read_transactions", "gauge", "Read transactions currently open.")
+	mw.value("rehook_db_open_read_transactions", float64(stats.OpenTxN))
+	mw.help("rehook_db_writes_total", "counter", "Page writes since the database was opened.")
+	mw.value("rehook_db_writes_total", float64(stats.TxStats.Write))
+	mw.help("rehook_db_write_seconds_total", "counter", "Time spent writing pages since the database was opened.")
+	mw.value("rehook_db_write_seconds_total", stats.TxStats.WriteTime.Seconds())
+	mw.help("rehook_db_page_allocations_bytes_total", "counter", "Bytes of pages allocated since the database was opened.")
+	mw.value("rehook_db_page_allocations_bytes_total", float64(stats.TxStats.PageAlloc))
+}
+
+// metricWriter writes metrics in the Prometheus text exposition format.
+type metricWriter struct {
+	w *bufio.Writer
+}
+
+// help writes the type and description of metric name.
+func (mw *metricWriter) help(name, typ, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// value writes a sample of metric name. Labels are given as name and value
+// pairs, a name without a value is ignored.
+func (mw *metricWriter) value(name string, v float64, labels ...string) {
+	mw.w.WriteString(name)
+	for i := 0; i+1 < len(labels); i += 2 {
+		sep := ","
+		if i == 0 {
+			sep = "{"
+		}
+		fmt.Fprintf(mw.w, `%s%s="%s"`, sep, labels[i], labelEscaper.Replace(labels[i+1]))
+	}
+	if len(labels) > 1 {
+		mw.w.WriteString("}")
+	}
+	fmt.Fprintf(mw.w, " %s\n", strconv.FormatFloat(v, 'g', -1, 64))
+}
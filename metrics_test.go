@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  float64
+		labels []string
+		want   string
+	}{
+		{"m", 0, nil, "m 0\n"},
+		{"m", 42, nil, "m 42\n"},
+		{"m", 0.25, nil, "m 0.25\n"},
+		{"m", 1234567890, nil, "m 1.23456789e+09\n"},
+		{"m", 1, []string{"hook", "foo"}, `m{hook="foo"} 1` + "\n"},
+		{"m", 1, []string{"hook", "foo", "le", "+Inf"}, `m{hook="foo",le="+Inf"} 1` + "\n"},
+		{"m", 1, []string{"hook", `a"b\c` + "\nd"}, `m{hook="a\"b\\c\nd"} 1` + "\n"},
+		{"m", 1, []string{"hook"}, "m 1\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		mw := &metricWriter{w: bufio.NewWriter(&buf)}
+		mw.value(tt.name, tt.value, tt.labels...)
+		mw.w.Flush()
+		if got := buf.String(); got != tt.want {
+			t.Errorf("value(%q, %v, %q) wrote %q, want %q", tt.name, tt.value, tt.labels, got, tt.want)
+		}
+	}
+
+	var buf bytes.Buffer
+	mw := &metricWriter{w: bufio.NewWriter(&buf)}
+	mw.help("rehook_requests_total", "counter", "Requests received per hook.")
+	mw.w.Flush()
+	want := "# HELP rehook_requests_total Requests received per hook.\n# TYPE rehook_requests_total counter\n"
+	if got := buf.String(); got != want {
+		t.Errorf("help wrote %q, want %q", got, want)
+	}
+}
+
+func TestCounterVec(t *testing.T) {
+	c := newCounterVec("hook", "code")
+	c.inc("foo", "500")
+	c.inc("bar", "200")
+	c.inc("foo", "200")
+	c.inc("foo", "500")
+
+	var buf bytes.Buffer
+	mw := &metricWriter{w: bufio.NewWriter(&buf)}
+	c.write(mw, "m")
+	mw.w.Flush()
+	want := `m{hook="bar",code="200"} 1
+m{hook="foo",code="200"} 1
+m{hook="foo",code="500"} 2
+`
+	if got := buf.String(); got != want {
+		t.Errorf("write wrote\n%s\nwant\n%s", got, want)
+	}
+}
+
+// sampleLine matches a sample in the Prometheus text format.
+var sampleLine = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*"(?:,[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*")*\})? (\S+)$`)
+
+func TestMetrics(t *testing.T) {
+	db, s, q := testStores(t)
+	h, ids := testHook(t, s, "hook", "a")
+
+	d := &Delivery{Hook: h.ID, Trace: []TraceStep{{Component: h.Components[0], Outcome: OutcomePassed, Duration: 30 * time.Millisecond}}}
+	for _, status := range []Status{StatusDone, StatusDone, StatusFailed} {
+		if err := s.IncDelivery(d, status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Inc(h.ID, StatusRejected); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.IncComponent(d.Trace[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Push(&Delivery{Hook: h.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	mh := &MetricsHandler{s, q, db}
+	mh.Metrics(w, httptest.NewRequest("GET", "/metrics", nil), nil)
+
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q, want text/plain; version=0.0.4", ct)
+	}
+
+	// every sample belongs to the metric family described before it
+	families := make(map[string]string)
+	var family string
+	samples := make(map[string]string)
+	for i, line := range strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n") {
+		if strings.HasPrefix(line, "# HELP ") {
+			family = strings.Fields(line)[2]
+			continue
+		}
+		if strings.HasPrefix(line, "# TYPE ") {
+			f := strings.Fields(line)
+			if len(f) != 4 || f[2] != family {
+				t.Errorf("line %d: %q does not follow the HELP line of %s", i+1, line, family)
+			}
+			families[family] = f[3]
+			continue
+		}
+		m := sampleLine.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("line %d: invalid sample %q", i+1, line)
+			continue
+		}
+		name := m[1]
+		if families[family] == "histogram" {
+			name = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(name, "_bucket"), "_sum"), "_count")
+		}
+		if name != family {
+			t.Errorf("line %d: sample %q in family %s", i+1, line, family)
+		}
+		samples[m[1]+m[2]] = m[3]
+	}
+
+	want := map[string]string{
+		`rehook_requests_total{hook="hook"}`:                                                                            "4",
+		`rehook_request_outcomes_total{hook="hook",outcome="done"}`:                                                     "2",
+		`rehook_request_outcomes_total{hook="hook",outcome="failed"}`:                                                   "1",
+		`rehook_request_outcomes_total{hook="hook",outcome="rejected"}`:                                                 "1",
+		`rehook_request_outcomes_total{hook="hook",outcome="filtered"}`:                                                 "0",
+		`rehook_processing_duration_seconds_bucket{hook="hook",le="0.01"}`:                                              "0",
+		`rehook_processing_duration_seconds_bucket{hook="hook",le="0.05"}`:                                              "3",
+		`rehook_processing_duration_seconds_bucket{hook="hook",le="+Inf"}`:                                              "3",
+		`rehook_processing_duration_seconds_sum{hook="hook"}`:                                                           "0.09",
+		`rehook_processing_duration_seconds_count{hook="hook"}`:                                                         "3",
+		`rehook_component_requests_total{hook="hook",component="` + ids["a"] + `",type="test-action",outcome="passed"}`: "1",
+		`rehook_component_duration_seconds_total{hook="hook",component="` + ids["a"] + `",type="test-action"}`:          "0.03",
+		`rehook_queue_depth{hook="hook"}`:                                                                               "1",
+	}
+	for k, v := range want {
+		if got, ok := samples[k]; !ok {
+			t.Errorf("sample %s missing", k)
+		} else if got != v {
+			t.Errorf("sample %s = %s, want %s", k, got, v)
+		}
+	}
+	for _, name := range []string{"rehook_db_size_bytes", "rehook_db_free_pages", "rehook_db_read_transactions_total"} {
+		if _, ok := samples[name]; !ok {
+			t.Errorf("sample %s missing", name)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+)
+
+// migrations contains the functions that upgrade the database layout, the
+// position in the list being the version they upgrade from.
+var migrations = []func(tx *bolt.Tx) error{
+	migrateComponentInstances,
+	migrateUserRoles,
+	migrateOrphanedData,
+}
+
+// migrate upgrades the database to the latest layout.
+func migrate(tx *bolt.Tx) error {
+	b := tx.Bucket(BucketMeta)
+
+	var version int
+	if err := gobDecode(b.Get([]byte("version")), &version); err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		log.Printf("Migrating database to version %d", version+1)
+		if err := migrations[version](tx); err != nil {
+			return fmt.Errorf("database migration to version %d failed: %s", version+1, err)
+		}
+	}
+
+	v, err := gobEncode(version)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte("version"), v)
+}
+
+// legacyParams are the params that components stored as "<hook id>-<param>" in
+// the bucket they shared between all hooks, before every component instance got
+// a bucket of its own.
+var legacyParams = map[string][]string{
+	"email-action":           {"token", "domain", "address", "subject", "template"},
+	"execute-action":         {"command"},
+	"forward-request-action": {"url"},
+	"github-validator":       {"secret"},
+	"mailgun-validator":      {"apikey"},
+	"rate-limit-filter":      {"amount", "interval"},
+}
+
+// legacyParam returns the param stored at key k of the shared bucket of the
+// component registered as name, if k belongs to the hook with the given id.
+// Since hook ids may contain dashes, k belongs to the hook with the longest id
+// among hooks that k could belong to.
+func legacyParam(k []byte, name, id string, hooks [][]byte) (string, bool) {
+	owner, param := "", ""
+	for _, h := range hooks {
+		prefix := string(h) + "-"
+		if len(prefix) <= len(owner) || !bytes.HasPrefix(k, []byte(prefix)) {
+			continue
+		}
+		for _, p := range legacyParams[name] {
+			if string(k[len(prefix):]) == p {
+				owner, param = string(h), p
+			}
+		}
+	}
+	return param, owner != "" && owner == id
+}
+
+// migrateComponentInstances moves component configuration from keys prefixed
+// with the hook id to a bucket per component instance. Every instance gets a
+// new unique identifier. Nested buckets that used to be shared between all
+// hooks, such as replay protection, are copied to each instance.
+func migrateComponentInstances(tx *bolt.Tx) error {
+	cb := tx.Bucket(BucketComponents)
+	hb := tx.Bucket(BucketHooks)
+
+	// instance buckets created per component, everything else is removed
+	created := make(map[string]map[string]bool)
+
+	var hooks [][]byte
+	if err := hb.ForEach(func(k, v []byte) error {
+		hooks = append(hooks, append([]byte(nil), k...))
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, id := range hooks {
+		var hcs []HookComponent
+		if err := gobDecode(hb.Get(id), &hcs); err != nil {
+			return err
+		}
+
+		for i := range hcs {
+			seq, err := cb.NextSequence()
+			if err != nil {
+				return err
+			}
+			hcs[i].ID = strconv.FormatUint(seq, 10)
+
+			old := cb.Bucket([]byte(hcs[i].Name))
+			if old == nil {
+				continue
+			}
+
+			var keys, buckets [][]byte
+			params := make(map[string]string)
+			if err := old.ForEach(func(k, v []byte) error {
+				if created[hcs[i].Name][string(k)] {
+					return nil
+				}
+				if v == nil {
+					buckets = append(buckets, append([]byte(nil), k...))
+				} else if param, ok := legacyParam(k, hcs[i].Name, string(id), hooks); ok {
+					keys = append(keys, append([]byte(nil), k...))
+					params[string(k)] = param
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			ib, err := old.CreateBucket([]byte(hcs[i].ID))
+			if err != nil {
+				return err
+			}
+			if created[hcs[i].Name] == nil {
+				created[hcs[i].Name] = make(map[string]bool)
+			}
+			created[hcs[i].Name][hcs[i].ID] = true
+
+			for _, k := range keys {
+				if err := ib.Put([]byte(params[string(k)]), old.Get(k)); err != nil {
+					return err
+				}
+			}
+			for _, k := range buckets {
+				if err := copyBucket(old.Bucket(k), ib, k); err != nil {
+					return err
+				}
+			}
+		}
+
+		v, err := gobEncode(hcs)
+		if err != nil {
+			return err
+		}
+		if err := hb.Put(id, v); err != nil {
+			return err
+		}
+	}
+
+	// remove the old keys and shared buckets
+	var names [][]byte
+	if err := cb.ForEach(func(k, v []byte) error {
+		if v == nil {
+			names = append(names, append([]byte(nil), k...))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		b, instances := cb.Bucket(name), created[string(name)]
+		var keys [][]byte
+		if err := b.ForEach(func(k, v []byte) error {
+			if !instances[string(k)] {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if b.Bucket(k) != nil {
+				if err := b.DeleteBucket(k); err != nil {
+					return err
+				}
+			} else if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// copyBucket copies bucket src and all its contents to a new bucket called
+// name inside dst.
+func copyBucket(src, dst *bolt.Bucket, name []byte) error {
+	b, err := dst.CreateBucketIfNotExists(name)
+	if err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return copyBucket(src.Bucket(k), b, k)
+		}
+		return b.Put(k, v)
+	})
+}
+
+// migrateUserRoles makes all existing users admins, as they had full access
+// before roles were introduced.
+func migrateUserRoles(tx *bolt.Tx) error {
+	b := tx.Bucket(BucketUsers)
+
+	var users []User
+	if err := b.ForEach(func(k, v []byte) error {
+		var u User
+		if err := gobDecode(v, &u); err != nil {
+			return err
+		}
+		users = append(users, u)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		if u.Role == "" {
+			u.Role = RoleAdmin
+			if err := putUser(tx, u); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// migrateOrphanedData removes the component instances, settings, history and
+// failed and queued requests that deleted hooks left behind, and takes deleted
+// hooks away from the editors that managed them. Request counts are kept.
+func migrateOrphanedData(tx *bolt.Tx) error {
+	hooks := make(map[string]bool)
+	instances := make(map[string]bool)
+	if err := tx.Bucket(BucketHooks).ForEach(func(k, v []byte) error {
+		hooks[string(k)] = true
+		var hcs []HookComponent
+		if err := gobDecode(v, &hcs); err != nil {
+			return err
+		}
+		for _, hc := range hcs {
+			instances[hc.Name+"/"+hc.ID] = true
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	var orphans []HookComponent
+	cb := tx.Bucket(BucketComponents)
+	if err := cb.ForEach(func(name, v []byte) error {
+		if v != nil {
+			return nil
+		}
+		return cb.Bucket(name).ForEach(func(id, v []byte) error {
+			if v == nil && !instances[string(name)+"/"+string(id)] {
+				orphans = append(orphans, HookComponent{ID: string(id), Name: string(name)})
+			}
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+	for _, hc := range orphans {
+		if err := deleteComponent(tx, hc); err != nil {
+			return err
+		}
+	}
+
+	stale := func(b *bolt.Bucket) ([][]byte, error) {
+		return bucketKeys(b, func(k, v []byte) (bool, error) { return !hooks[string(k)], nil })
+	}
+	keys, err := stale(tx.Bucket(BucketSettings))
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := tx.Bucket(BucketSettings).Delete(k); err != nil {
+			return err
+		}
+	}
+	for _, name := range [][]byte{BucketHistory, BucketDeadLetters} {
+		keys, err := stale(tx.Bucket(name))
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := tx.Bucket(name).DeleteBucket(k); err != nil {
+				return err
+			}
+		}
+	}
+
+	deleted := make(map[string]bool)
+	if err := tx.Bucket(BucketQueue).ForEach(func(k, v []byte) error {
+		var d Delivery
+		if err := gobDecode(v, &d); err != nil {
+			return err
+		}
+		if !hooks[d.Hook] {
+			deleted[d.Hook] = true
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for id := range deleted {
+		if err := deleteDeliveries(tx, id); err != nil {
+			return err
+		}
+	}
+
+	unassigned := make(map[string]bool)
+	if err := tx.Bucket(BucketUsers).ForEach(func(k, v []byte) error {
+		var u User
+		if err := gobDecode(v, &u); err != nil {
+			return err
+		}
+		for _, id := range u.Hooks {
+			if !hooks[id] {
+				unassigned[id] = true
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for id := range unassigned {
+		if err := reassignHook(tx, id, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestMigrateComponentInstances(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rehook.db")
+	old, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the layout before component instances had a bucket of their own: every
+	// component stored the params of all hooks as "<hook id>-<param>" in one
+	// bucket, which also held nested buckets shared by all hooks
+	type oldComponent struct{ ID, Name string }
+	hooks := map[string][]oldComponent{
+		"foo":     {{"1400000000", "forward-request-action"}, {"1400000001", "github-validator"}},
+		"foo-bar": {{"1400000002", "forward-request-action"}, {"1400000003", "rate-limit-filter"}},
+		"foo-url": {{"1400000004", "forward-request-action"}, {"1400000005", "log-action"}},
+	}
+	data := map[string]map[string]string{
+		"forward-request-action": {
+			"foo-url":     "http://foo",
+			"foo-bar-url": "http://foo-bar",
+			"foo-url-url": "http://foo-url",
+			"gone-url":    "http://deleted-hook",
+		},
+		"github-validator":  {"foo-secret": "foo secret", "foo-bar-secret": "left behind"},
+		"rate-limit-filter": {"foo-bar-amount": "10", "foo-bar-interval": "60"},
+	}
+	err = old.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{BucketHooks, BucketStats, BucketComponents} {
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		for id, hcs := range hooks {
+			v, err := gobEncode(hcs)
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(BucketHooks).Put([]byte(id), v); err != nil {
+				return err
+			}
+		}
+		for name, kv := range data {
+			b, err := tx.Bucket(BucketComponents).CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+			for k, v := range kv {
+				if err := b.Put([]byte(k), []byte(v)); err != nil {
+					return err
+				}
+			}
+		}
+		b, err := tx.Bucket(BucketComponents).Bucket([]byte("github-validator")).CreateBucket([]byte("deliveries"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("delivery-1"), []byte{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := openDB(path, time.Second)
+	if err != nil {
+		t.Fatalf("openDB: %s", err)
+	}
+	defer db.Close()
+	s := &HookStore{db}
+
+	want := map[string][]map[string]string{
+		"foo":     {{"url": "http://foo"}, {"secret": "foo secret"}},
+		"foo-bar": {{"url": "http://foo-bar"}, {"amount": "10", "interval": "60"}},
+		"foo-url": {{"url": "http://foo-url"}, {}},
+	}
+	seen := make(map[string]bool)
+	for id, want := range want {
+		h, err := s.Find(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(h.Components) != len(want) {
+			t.Fatalf("%s: %d components, want %d", id, len(h.Components), len(want))
+		}
+		for i, hc := range h.Components {
+			if hc.Name != hooks[id][i].Name || hc.ID == hooks[id][i].ID || seen[hc.ID] {
+				t.Errorf("%s: component %d = %+v, want a new unique id for %s", id, i, hc, hooks[id][i].Name)
+			}
+			seen[hc.ID] = true
+
+			params, err := s.ComponentParams(*h, hc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range params {
+				if v != want[i][k] {
+					t.Errorf("%s: param %s of %s = %q, want %q", id, k, hc.Name, v, want[i][k])
+				}
+			}
+		}
+	}
+
+	// only the instance buckets are left, with a copy of the shared buckets
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BucketComponents).ForEach(func(name, v []byte) error {
+			return tx.Bucket(BucketComponents).Bucket(name).ForEach(func(k, v []byte) error {
+				if v != nil || !seen[string(k)] {
+					t.Errorf("%s: key %q left in the shared bucket", name, k)
+				}
+				return nil
+			})
+		})
+	})
+	h, _ := s.Find("foo")
+	db.View(func(tx *bolt.Tx) error {
+		b := h.Components[1].bucket(tx).Bucket([]byte("deliveries"))
+		if b == nil || b.Get([]byte("delivery-1")) == nil {
+			t.Error("replay protection of the github validator not copied")
+		}
+		return nil
+	})
+}
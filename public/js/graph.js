@@ -1,6 +1,44 @@
 var graphs = []
+var months = ["Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"];
+var latency_labels = [];
 
-function draw_graph(e, dataset) {
+// views of the request counts, each graph has a dataset for every view
+var graph_views = {
+	hours: {
+		footer: "Requests last 48 hours",
+		label: function(d) {
+			var current = new Date();
+			current.setHours(current.getHours() - d);
+			return current.getHours() + ":00";
+		}
+	},
+	days: {
+		footer: "Requests last 30 days",
+		label: function(d) {
+			var current = new Date();
+			current.setDate(current.getDate() - d);
+			return current.getDate() + "/" + (current.getMonth() + 1);
+		}
+	},
+	months: {
+		footer: "Requests last 12 months",
+		label: function(d) {
+			var current = new Date();
+			current.setDate(1);
+			current.setMonth(current.getMonth() - d);
+			return months[current.getMonth()];
+		}
+	},
+	latency: {
+		footer: "Processing time of requests",
+		label: function(d, n) {
+			return latency_labels[n - d] || "";
+		}
+	}
+};
+var graph_view = "hours";
+
+function draw_graph(e, dataset, view) {
 	var w = parseInt(d3.select(e).style('width'), 10);
 	var h = 70;
 	var padding = 22;
@@ -10,7 +48,7 @@ function draw_graph(e, dataset) {
 		.range([0, h-padding]);
 
 	var scaleX = d3.scale.linear()
-		.domain([48, 0]).range([padding, w-(padding*2)]);
+		.domain([dataset.length, 0]).range([padding, w-(padding*2)]);
 
 	d3.select(e).select("svg").remove();
 	var svg = d3.select(e)
@@ -20,11 +58,7 @@ function draw_graph(e, dataset) {
 
 	var axis = d3.svg
 		.axis()
-		.tickFormat(function(d){
-			var current = new Date();
-			current.setHours(current.getHours() - d);
-			return current.getHours() + ":00";
-		})
+		.tickFormat(function(d) { return view.label(d, dataset.length); })
 		.scale(scaleX);
 
 	var axisY = d3.svg
@@ -77,9 +111,19 @@ function draw_graph(e, dataset) {
 }
 
 function draw_graphs() {
+	var view = graph_views[graph_view];
 	for (var i=0; i<graphs.length; i++) {
-		draw_graph(graphs[i].e, graphs[i].dataset);
+		draw_graph(graphs[i].e, graphs[i].datasets[graph_view], view);
 	}
+	d3.selectAll(".graph-footer").text(view.footer);
+	d3.selectAll(".graph-view").classed("active", function() {
+		return this.getAttribute("data-view") == graph_view;
+	});
+}
+
+function show_graphs(view) {
+	graph_view = view;
+	draw_graphs();
 }
 
 d3.select(window).on('resize', draw_graphs);
@@ -0,0 +1,78 @@
+// Drag and drop reordering of the components on the edit hook page. When a
+// component is dropped, the new order is submitted using the #reorder form.
+(function() {
+	var list = document.querySelector(".components");
+	var dragged = null;
+
+	function target(e) {
+		var el = e.target;
+		while (el && el !== list && !(el.classList && el.classList.contains("component"))) {
+			el = el.parentNode;
+		}
+		return el === list ? null : el;
+	}
+
+	// after returns true if el follows the dragged component, in which case the
+	// dragged component is inserted after el instead of before it.
+	function after(el) {
+		return dragged.compareDocumentPosition(el) & Node.DOCUMENT_POSITION_FOLLOWING;
+	}
+
+	function clearTargets() {
+		var els = list.querySelectorAll(".drop-before, .drop-after");
+		for (var i = 0; i < els.length; i++) {
+			els[i].classList.remove("drop-before", "drop-after");
+		}
+	}
+
+	list.addEventListener("dragstart", function(e) {
+		dragged = target(e);
+		if (!dragged) {
+			return;
+		}
+		dragged.classList.add("dragging");
+		e.dataTransfer.effectAllowed = "move";
+		e.dataTransfer.setData("text/plain", dragged.getAttribute("data-id"));
+	});
+
+	list.addEventListener("dragend", function() {
+		if (dragged) {
+			dragged.classList.remove("dragging");
+		}
+		clearTargets();
+		dragged = null;
+	});
+
+	list.addEventListener("dragover", function(e) {
+		var el = target(e);
+		if (!dragged || !el) {
+			return;
+		}
+		e.preventDefault();
+		clearTargets();
+		if (el !== dragged) {
+			el.classList.add(after(el) ? "drop-after" : "drop-before");
+		}
+	});
+
+	list.addEventListener("drop", function(e) {
+		var el = target(e);
+		if (!dragged || !el || el === dragged) {
+			return;
+		}
+		e.preventDefault();
+
+		list.insertBefore(dragged, after(el) ? el.nextElementSibling : el);
+
+		var form = document.getElementById("reorder");
+		var items = list.querySelectorAll(".component");
+		for (var i = 0; i < items.length; i++) {
+			var input = document.createElement("input");
+			input.type = "hidden";
+			input.name = "order";
+			input.value = items[i].getAttribute("data-id");
+			form.appendChild(input);
+		}
+		form.submit();
+	});
+})();
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// QueuePollInterval is the maximum time an idle worker waits before
+	// checking the queue for new deliveries.
+	QueuePollInterval = 5 * time.Second
+)
+
+// errHookDeleted is returned when a delivery is stored for a hook that was
+// deleted while the delivery was being processed.
+var errHookDeleted = errors.New("hook was deleted")
+
+// Delivery is an incoming request for a hook that is waiting to be processed.
+type Delivery struct {
+	ID        uint64    // unique delivery identifier
+	Hook      string    // hook identifier
+	Request   Request   // the incoming request
+	Received  time.Time // time the request was received
+	Next      string    // identifier of the next component to process, empty to start at the first
+	Processed bool      // all components have processed the request
+
+	Attempts    int       // failed attempts of the current component
+	NextAttempt time.Time // time of the next attempt after a failure
+
+	Trace []TraceStep // components the request passed through so far
+}
+
+// advance moves delivery d past component i of hook h.
+func (d *Delivery) advance(h *Hook, i int) {
+	if i+1 < len(h.Components) {
+		d.Next = h.Components[i+1].ID
+		return
+	}
+	d.Next, d.Processed = "", true
+}
+
+// component returns the next component of delivery d as recorded in its
+// trace, which is needed once the component is no longer part of the hook.
+func (d *Delivery) component() HookComponent {
+	for i := len(d.Trace) - 1; i >= 0; i-- {
+		if d.Trace[i].Component.ID == d.Next {
+			return d.Trace[i].Component
+		}
+	}
+	return HookComponent{ID: d.Next}
+}
+
+// Queue is a persistent queue of deliveries. Deliveries are stored in the
+// database before they are acknowledged and only removed after processing has
+// finished, so no requests are lost when rehook is restarted.
+type Queue struct {
+	db   *DB
+	wake chan struct{}
+
+	mu       sync.Mutex
+	inflight map[uint64]bool
+	workers  int // number of running workers
+}
+
+// NewQueue returns a new queue that stores its deliveries in db.
+func NewQueue(db *DB) *Queue {
+	return &Queue{
+		db:       db,
+		wake:     make(chan struct{}, 1),
+		inflight: make(map[uint64]bool),
+	}
+}
+
+// Push stores delivery d in the queue and assigns it a unique identifier.
+func (q *Queue) Push(d *Delivery) error {
+	err := q.push(d, false)
+	if err == nil {
+		q.notify()
+	}
+	return err
+}
+
+// PushClaimed stores delivery d in the queue like Push, but does not hand it
+// to the workers. The caller processes d itself and must call Release when it
+// is done. If processing is interrupted, d is picked up on the next start.
+func (q *Queue) PushClaimed(d *Delivery) error {
+	return q.push(d, true)
+}
+
+func (q *Queue) push(d *Delivery, claim bool) error {
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		id, err := tx.Bucket(BucketQueue).NextSequence()
+		if err != nil {
+			return err
+		}
+		d.ID = id
+		if claim {
+			// claim before committing, so no worker can take it
+			q.claim(d.ID)
+		}
+		return q.put(tx, d)
+	})
+	if err != nil && claim {
+		q.release(d.ID)
+	}
+	return err
+}
+
+// put stores the current state of delivery d in transaction tx. It returns
+// errHookDeleted if the hook of d no longer exists.
+func (q *Queue) put(tx *bolt.Tx, d *Delivery) error {
+	if tx.Bucket(BucketHooks).Get([]byte(d.Hook)) == nil {
+		return errHookDeleted
+	}
+	v, err := gobEncode(d)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(BucketQueue).Put(itob(d.ID), v); err != nil {
+		return err
+	}
+	return q.record(tx, d, StatusPending)
+}
+
+// Retry stores delivery d, which will not be processed again until its next
+// attempt is due.
+func (q *Queue) Retry(d *Delivery) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		return q.put(tx, d)
+	})
+}
+
+// Done removes delivery d from the queue after it has been processed, or
+// after it was dropped by one of the components in which case status is
+// StatusFiltered.
+func (q *Queue) Done(d *Delivery, status Status) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		if err := q.record(tx, d, status); err != nil {
+			return err
+		}
+		return tx.Bucket(BucketQueue).Delete(itob(d.ID))
+	})
+}
+
+// Remove removes the delivery with the given id from the queue without
+// recording it in the history.
+func (q *Queue) Remove(id uint64) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(BucketQueue).Delete(itob(id))
+	})
+}
+
+// Pending returns the number of queued deliveries for hook.
+func (q *Queue) Pending(hook string) (n int, err error) {
+	err = q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BucketQueue).ForEach(func(k, v []byte) error {
+			var d Delivery
+			if err := gobDecode(v, &d); err != nil {
+				return err
+			}
+			if d.Hook == hook {
+				n++
+			}
+			return nil
+		})
+	})
+	return n, err
+}
+
+// Depth returns the number of queued deliveries per hook.
+func (q *Queue) Depth() (map[string]int, error) {
+	depth := make(map[string]int)
+	err := q.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BucketQueue).ForEach(func(k, v []byte) error {
+			var d Delivery
+			if err := gobDecode(v, &d); err != nil {
+				return err
+			}
+			depth[d.Hook]++
+			return nil
+		})
+	})
+	return depth, err
+}
+
+// Workers returns the number of running workers.
+func (q *Queue) Workers() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.workers
+}
+
+// Backlog returns the number of queued deliveries of active hooks. If limit is
+// positive, counting stops once the backlog exceeds it.
+func (q *Queue) Backlog(limit int) (n int, err error) {
+	err = q.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(BucketQueue).Cursor()
+		for k, v := c.First(); k != nil && (limit <= 0 || n <= limit); k, v = c.Next() {
+			var d Delivery
+			if err := gobDecode(v, &d); err != nil {
+				return err
+			}
+			if active(tx, d.Hook) {
+				n++
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+// Start starts n workers that call fn for every delivery in the queue,
+// including deliveries left unfinished by a previous run. The fn function is
+// responsible for calling Done once a delivery has been handled.
+func (q *Queue) Start(n int, fn func(d *Delivery)) {
+	for i := 0; i < n; i++ {
+		go q.work(fn)
+	}
+	q.notify()
+}
+
+func (q *Queue) work(fn func(d *Delivery)) {
+	q.mu.Lock()
+	q.workers++
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		q.workers--
+		q.mu.Unlock()
+	}()
+
+	for {
+		d, wait, err := q.next()
+		if err != nil {
+			log.Printf("error reading from queue: %s", err)
+		}
+		if d == nil {
+			select {
+			case <-q.wake:
+			case <-time.After(wait):
+			}
+			continue
+		}
+
+		// there may be more work, let another worker have a look
+		q.notify()
+
+		fn(d)
+		q.release(d.ID)
+	}
+}
+
+// next claims the oldest delivery that is due and not already being
+// processed, skipping deliveries of hooks that are not active. If there is
+// nothing to do, it returns nil and the duration after which the next retry
+// is due.
+func (q *Queue) next() (d *Delivery, wait time.Duration, err error) {
+	now := time.Now()
+	wait = QueuePollInterval
+	err = q.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(BucketQueue).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if !q.claim(btoi(k)) {
+				continue
+			}
+			d = &Delivery{}
+			if err := gobDecode(v, d); err != nil {
+				// leave it claimed so it is skipped from now on
+				d = nil
+				return err
+			}
+			if !active(tx, d.Hook) {
+				q.release(d.ID)
+				d = nil
+				continue
+			}
+			if d.NextAttempt.After(now) {
+				if w := d.NextAttempt.Sub(now); w < wait {
+					wait = w
+				}
+				q.release(d.ID)
+				d = nil
+				continue
+			}
+			return nil
+		}
+		return nil
+	})
+	return d, wait, err
+}
+
+// active returns true if the deliveries of hook may be processed.
+func active(tx *bolt.Tx, hook string) bool {
+	var s Settings
+	if err := gobDecode(tx.Bucket(BucketSettings).Get([]byte(hook)), &s); err != nil {
+		// let processing report the problem
+		return true
+	}
+	return !s.Paused() && !s.Disabled()
+}
+
+func (q *Queue) claim(id uint64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.inflight[id] {
+		return false
+	}
+	q.inflight[id] = true
+	return true
+}
+
+// Release hands a claimed delivery back to the workers, which process it once
+// it is due.
+func (q *Queue) Release(id uint64) {
+	q.release(id)
+	q.notify()
+}
+
+func (q *Queue) release(id uint64) {
+	q.mu.Lock()
+	delete(q.inflight, id)
+	q.mu.Unlock()
+}
+
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// itob returns the big endian representation of v, which keeps keys sorted.
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func btoi(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestProcessRequestResume(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(s *HookStore, h *Hook, ids map[string]string) error
+		status Status
+		want   []string // components run after the change
+	}{
+		{
+			name:   "unchanged",
+			change: func(s *HookStore, h *Hook, ids map[string]string) error { return nil },
+			status: StatusDone,
+			want:   []string{"b", "c"},
+		},
+		{
+			name: "reordered",
+			change: func(s *HookStore, h *Hook, ids map[string]string) error {
+				return s.ReorderComponents(h.ID, []string{ids["c"], ids["a"], ids["b"]})
+			},
+			status: StatusDone,
+			want:   []string{"b"},
+		},
+		{
+			name: "moved down",
+			change: func(s *HookStore, h *Hook, ids map[string]string) error {
+				return s.MoveComponent(h.ID, ids["b"], 1)
+			},
+			status: StatusDone,
+			want:   []string{"b"},
+		},
+		{
+			name: "moved up",
+			change: func(s *HookStore, h *Hook, ids map[string]string) error {
+				return s.MoveComponent(h.ID, ids["b"], -1)
+			},
+			status: StatusDone,
+			want:   []string{"b", "a", "c"},
+		},
+		{
+			name: "component added",
+			change: func(s *HookStore, h *Hook, ids map[string]string) error {
+				_, err := s.AddComponent(*h, HookComponent{Name: "test-action"}, map[string]string{"name": "d"})
+				return err
+			},
+			status: StatusDone,
+			want:   []string{"b", "c", "d"},
+		},
+		{
+			name: "component removed",
+			change: func(s *HookStore, h *Hook, ids map[string]string) error {
+				return s.DeleteComponent(*h, ids["b"])
+			},
+			status: StatusFailed,
+			want:   nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, s, q := testStores(t)
+			hh := &HookHandler{s, db, q}
+			h, ids := testHook(t, s, "hook", "a", "b", "c")
+
+			processed, failing = nil, map[string]bool{"b": true}
+			d := &Delivery{Hook: h.ID, Request: Request{Method: "POST"}}
+			if err := q.Push(d); err != nil {
+				t.Fatal(err)
+			}
+			if res := hh.processRequest(d); res.Status != StatusPending {
+				t.Fatalf("first attempt status = %q, want %q", res.Status, StatusPending)
+			}
+			if want := []string{"a", "b"}; !reflect.DeepEqual(processed, want) {
+				t.Fatalf("first attempt processed %q, want %q", processed, want)
+			}
+
+			h, _ = s.Find(h.ID)
+			if err := tt.change(s, h, ids); err != nil {
+				t.Fatal(err)
+			}
+
+			// resume from the stored delivery, as after a restart
+			d = queued(t, db, d.ID)
+			if d == nil {
+				t.Fatal("delivery not queued after failed attempt")
+			}
+			if d.Next != ids["b"] || d.Attempts != 1 {
+				t.Fatalf("queued delivery Next = %q, Attempts = %d, want %q, 1", d.Next, d.Attempts, ids["b"])
+			}
+			processed, failing = nil, nil
+			if res := hh.processRequest(d); res.Status != tt.status {
+				t.Errorf("retry status = %q, want %q", res.Status, tt.status)
+			}
+			if !reflect.DeepEqual(processed, tt.want) {
+				t.Errorf("retry processed %q, want %q", processed, tt.want)
+			}
+			if d := queued(t, db, d.ID); d != nil {
+				t.Errorf("delivery still queued after retry")
+			}
+		})
+	}
+}
+
+func TestProcessRequestPersistsProgress(t *testing.T) {
+	db, s, q := testStores(t)
+	hh := &HookHandler{s, db, q}
+	h, ids := testHook(t, s, "hook", "a", "b")
+
+	processed, failing = nil, map[string]bool{"b": true}
+	d := &Delivery{Hook: h.ID}
+	if err := q.Push(d); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		hh.processRequest(d)
+		if got := queued(t, db, d.ID); i < 3 && (got == nil || got.Attempts != i) {
+			t.Fatalf("after attempt %d queued delivery = %+v, want %d attempts", i, got, i)
+		}
+	}
+	if want := []string{"a", "b", "b", "b"}; !reflect.DeepEqual(processed, want) {
+		t.Errorf("processed %q, want %q", processed, want)
+	}
+
+	if d := queued(t, db, d.ID); d != nil {
+		t.Errorf("delivery still queued after the last attempt")
+	}
+	dls, err := q.DeadLetters(h.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dls) != 1 || dls[0].Component.ID != ids["b"] || dls[0].Attempts != 3 {
+		t.Errorf("dead letters = %+v, want one for component %s after 3 attempts", dls, ids["b"])
+	}
+}
+
+func TestQueueRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rehook.db")
+	db, err := openDB(path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, q := &HookStore{db}, NewQueue(db)
+	h, _ := testHook(t, s, "hook", "a")
+	for i := 0; i < 2; i++ {
+		if err := q.Push(&Delivery{Hook: h.ID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a synchronous request that was being processed when rehook stopped
+	if err := q.PushClaimed(&Delivery{Hook: h.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = openDB(path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	q = NewQueue(db)
+	done := make(chan uint64)
+	q.Start(1, func(d *Delivery) {
+		if err := q.Done(d, StatusDone); err != nil {
+			t.Error(err)
+		}
+		done <- d.ID
+	})
+
+	var got []uint64
+	for len(got) < 3 {
+		select {
+		case id := <-done:
+			got = append(got, id)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("processed %v after restart, want all 3 deliveries", got)
+		}
+	}
+	if want := []uint64{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("processed %v after restart, want %v", got, want)
+	}
+	if n, err := q.Pending(h.ID); err != nil || n != 0 {
+		t.Errorf("Pending = %d, %v, want 0", n, err)
+	}
+}
+
+func TestQueuePaused(t *testing.T) {
+	_, s, q := testStores(t)
+	h, _ := testHook(t, s, "hook", "a")
+	if err := s.SetState(h.ID, StatePaused); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Push(&Delivery{Hook: h.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	// queued deliveries wait until the hook is resumed
+	if d, _, err := q.next(); err != nil || d != nil {
+		t.Fatalf("next while paused = %+v, %v, want nothing", d, err)
+	}
+	if err := s.SetState(h.ID, StateActive); err != nil {
+		t.Fatal(err)
+	}
+	if d, _, err := q.next(); err != nil || d == nil || d.Hook != h.ID {
+		t.Errorf("next after resuming = %+v, %v, want the queued delivery", d, err)
+	}
+
+	if err := s.SetState(h.ID, "stopped"); err == nil {
+		t.Error("SetState accepted an invalid state")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"net/http"
 	"strconv"
 	"time"
 
@@ -23,12 +24,16 @@ func (RateLimitFilter) Name() string { return "Rate limiter" }
 // Template returns the HTML template name of this component.
 func (RateLimitFilter) Template() string { return "rate-limit-filter" }
 
-// Params returns the currently stored configuration parameters for hook h
-// from bucket b.
-func (RateLimitFilter) Params(h Hook, b *bolt.Bucket) map[string]string {
+// Parameters returns the names of the configuration parameters.
+func (RateLimitFilter) Parameters() []string {
+	return []string{"amount", "interval"}
+}
+
+// Params returns the currently stored configuration parameters from bucket b.
+func (c RateLimitFilter) Params(h Hook, b *bolt.Bucket) map[string]string {
 	m := make(map[string]string)
-	for _, k := range []string{"amount", "interval"} {
-		m[k] = string(b.Get([]byte(fmt.Sprintf("%s-%s", h.ID, k))))
+	for _, k := range c.Parameters() {
+		m[k] = string(b.Get([]byte(k)))
 	}
 	return m
 }
@@ -38,26 +43,26 @@ func (RateLimitFilter) Params(h Hook, b *bolt.Bucket) map[string]string {
 func (RateLimitFilter) Init(h Hook, params map[string]string, b *bolt.Bucket) error {
 	amount, ok := params["amount"]
 	if !ok {
-		return errors.New("amount is required")
+		return invalidParam("amount", "amount is required")
 	}
 
 	if i, err := strconv.Atoi(amount); err != nil || i <= 0 {
-		return fmt.Errorf("amount must be a positive number > 0: %s", err)
+		return invalidParam("amount", "amount must be a positive number > 0: %s", err)
 	}
 
 	interval, ok := params["interval"]
 	if !ok {
-		return errors.New("interval is required")
+		return invalidParam("interval", "interval is required")
 	}
 
 	if i, err := strconv.Atoi(interval); err != nil || i <= 0 {
-		return fmt.Errorf("interval must be a positive number: %s", err)
+		return invalidParam("interval", "interval must be a positive number: %s", err)
 	}
 
-	if err := b.Put([]byte(fmt.Sprintf("%s-amount", h.ID)), []byte(amount)); err != nil {
+	if err := b.Put([]byte("amount"), []byte(amount)); err != nil {
 		return err
 	}
-	if err := b.Put([]byte(fmt.Sprintf("%s-interval", h.ID)), []byte(interval)); err != nil {
+	if err := b.Put([]byte("interval"), []byte(interval)); err != nil {
 		return err
 	}
 	_, err := b.CreateBucketIfNotExists([]byte("requests"))
@@ -67,8 +72,8 @@ func (RateLimitFilter) Init(h Hook, params map[string]string, b *bolt.Bucket) er
 // Process makes sure incoming requests do not exceed the configured rate
 // limit.
 func (RateLimitFilter) Process(h Hook, r Request, b *bolt.Bucket) error {
-	amount, _ := strconv.Atoi(string(b.Get([]byte(fmt.Sprintf("%s-amount", h.ID)))))
-	interval, _ := strconv.Atoi(string(b.Get([]byte(fmt.Sprintf("%s-interval", h.ID)))))
+	amount, _ := strconv.Atoi(string(b.Get([]byte("amount"))))
+	interval, _ := strconv.Atoi(string(b.Get([]byte("interval"))))
 	if amount <= 0 || interval <= 0 {
 		return errors.New("rate limit filter not initialized")
 	}
@@ -92,7 +97,14 @@ func (RateLimitFilter) Process(h Hook, r Request, b *bolt.Bucket) error {
 	}
 
 	if count > amount {
-		return fmt.Errorf("rate limit exceeded (limit=%d count=%d)", amount, count)
+		// the oldest request in the interval determines when there is room
+		k, _ := c.Seek(from)
+		ts, _ := strconv.ParseInt(string(k), 10, 64)
+		return &FilteredError{
+			Reason:     fmt.Sprintf("rate limit exceeded (limit=%d count=%d)", amount, count),
+			Status:     http.StatusTooManyRequests,
+			RetryAfter: time.Unix(0, ts).Add(time.Duration(interval) * time.Second).Sub(now),
+		}
 	}
 
 	// cleanup old entries
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Validators protect against replayed requests by storing the unique
+// identifier of every request they accept in a bucket, with the time it was
+// seen as value. An identifier that is seen again within the retention period
+// is a replayed request. Identifiers are removed by the janitor once their
+// retention period has passed. A retention of 0 keeps them forever, which is
+// needed when a request carries no time that limits how long it may be
+// replayed.
+const (
+	// DefaultReplayRetention is how long validators that reject old requests
+	// remember the unique identifiers of requests if no retention is
+	// configured.
+	DefaultReplayRetention = 30 * 24 * time.Hour
+)
+
+// initReplayProtection stores the retention param and creates the bucket
+// called name that holds the identifiers seen by a component.
+func initReplayProtection(params map[string]string, b *bolt.Bucket, name string) error {
+	retention := params["retention"]
+	if retention != "" {
+		d, err := time.ParseDuration(retention)
+		if err != nil || d <= 0 {
+			return invalidParam("retention", "retention must be a positive duration, such as 720h")
+		}
+	}
+	if err := b.Put([]byte("retention"), []byte(retention)); err != nil {
+		return err
+	}
+	_, err := b.CreateBucketIfNotExists([]byte(name))
+	return err
+}
+
+// replayRetention returns the retention period stored in component bucket b,
+// or def if none is configured.
+func replayRetention(b *bolt.Bucket, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(string(b.Get([]byte("retention"))))
+	if err != nil || d <= 0 {
+		return def
+	}
+	return d
+}
+
+// seen records identifier id in bucket name of component bucket b and returns
+// true if it was already seen within the retention period.
+func seen(b *bolt.Bucket, name string, id []byte, now time.Time, retention time.Duration) (bool, error) {
+	ids := b.Bucket([]byte(name))
+	if v := ids.Get(id); v != nil {
+		// identifiers stored before they had a time are always replays
+		if retention == 0 || len(v) != 8 || now.Sub(time.Unix(0, int64(btoi(v)))) < retention {
+			return true, nil
+		}
+	}
+	return false, ids.Put(id, itob(uint64(now.UnixNano())))
+}
+
+// expireSeen removes the identifiers from bucket name of component bucket b
+// that are older than the retention period, and returns the number removed.
+// Identifiers stored before they had a time are given the current time, so
+// they expire after the retention period from now on.
+func expireSeen(b *bolt.Bucket, name string, now time.Time, retention time.Duration) (int, error) {
+	ids := b.Bucket([]byte(name))
+	if ids == nil || retention == 0 {
+		return 0, nil
+	}
+
+	var expired, untimed [][]byte
+	if err := ids.ForEach(func(k, v []byte) error {
+		switch {
+		case len(v) != 8:
+			untimed = append(untimed, append([]byte(nil), k...))
+		case now.Sub(time.Unix(0, int64(btoi(v)))) >= retention:
+			expired = append(expired, append([]byte(nil), k...))
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	for _, k := range expired {
+		if err := ids.Delete(k); err != nil {
+			return 0, err
+		}
+	}
+	for _, k := range untimed {
+		if err := ids.Put(k, itob(uint64(now.UnixNano()))); err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), nil
+}
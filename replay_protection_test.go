@@ -0,0 +1,137 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestReplayProtection(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		retention time.Duration
+		after     time.Duration // time between the first and second request
+		replay    bool          // second request is a replay
+		expired   int           // identifiers removed by expireSeen at that time
+	}{
+		{0, time.Minute, true, 0},
+		{0, 365 * 24 * time.Hour, true, 0},
+		{time.Hour, time.Minute, true, 0},
+		{time.Hour, time.Hour, false, 1},
+		{time.Hour, 2 * time.Hour, false, 1},
+	}
+	for _, tt := range tests {
+		db := testDB(t)
+		err := db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(BucketComponents)
+			if err := initReplayProtection(map[string]string{}, b, "ids"); err != nil {
+				return err
+			}
+			if dup, err := seen(b, "ids", []byte("1"), now, tt.retention); dup || err != nil {
+				t.Errorf("retention %s: first seen = %t, %v, want false, nil", tt.retention, dup, err)
+			}
+
+			n, err := expireSeen(b, "ids", now.Add(tt.after), tt.retention)
+			if n != tt.expired || err != nil {
+				t.Errorf("retention %s: expireSeen after %s = %d, %v, want %d, nil", tt.retention, tt.after, n, err, tt.expired)
+			}
+			if dup, err := seen(b, "ids", []byte("1"), now.Add(tt.after), tt.retention); dup != tt.replay || err != nil {
+				t.Errorf("retention %s: seen after %s = %t, %v, want %t, nil", tt.retention, tt.after, dup, err, tt.replay)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReplayProtectionUntimed(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	db := testDB(t)
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BucketComponents)
+		if err := initReplayProtection(map[string]string{}, b, "ids"); err != nil {
+			return err
+		}
+		// identifiers stored by older versions have no time
+		if err := b.Bucket([]byte("ids")).Put([]byte("1"), []byte{}); err != nil {
+			return err
+		}
+
+		if dup, _ := seen(b, "ids", []byte("1"), now, time.Hour); !dup {
+			t.Error("untimed identifier not treated as a replay")
+		}
+		if n, _ := expireSeen(b, "ids", now, time.Hour); n != 0 {
+			t.Errorf("expireSeen removed %d untimed identifiers, want 0", n)
+		}
+		if dup, _ := seen(b, "ids", []byte("1"), now.Add(time.Minute), time.Hour); !dup {
+			t.Error("identifier not a replay within the retention after it was given a time")
+		}
+		if n, _ := expireSeen(b, "ids", now.Add(time.Hour), time.Hour); n != 1 {
+			t.Errorf("expireSeen removed %d identifiers a retention period later, want 1", n)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplayRetention(t *testing.T) {
+	tests := []struct {
+		params  map[string]string
+		valid   bool
+		github  time.Duration
+		mailgun time.Duration
+	}{
+		{map[string]string{}, true, 0, DefaultReplayRetention},
+		{map[string]string{"retention": ""}, true, 0, DefaultReplayRetention},
+		{map[string]string{"retention": "48h"}, true, 48 * time.Hour, 48 * time.Hour},
+		{map[string]string{"retention": "0s"}, false, 0, 0},
+		{map[string]string{"retention": "-1h"}, false, 0, 0},
+		{map[string]string{"retention": "month"}, false, 0, 0},
+	}
+	for _, tt := range tests {
+		db := testDB(t)
+		db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(BucketComponents)
+			err := initReplayProtection(tt.params, b, "ids")
+			if (err == nil) != tt.valid {
+				t.Errorf("initReplayProtection(%v) = %v, want valid %t", tt.params, err, tt.valid)
+			}
+			if err != nil {
+				return nil
+			}
+			if got := replayRetention(b, 0); got != tt.github {
+				t.Errorf("%v: GitHub retention = %s, want %s", tt.params, got, tt.github)
+			}
+			if got := replayRetention(b, DefaultReplayRetention); got != tt.mailgun {
+				t.Errorf("%v: Mailgun retention = %s, want %s", tt.params, got, tt.mailgun)
+			}
+			return nil
+		})
+	}
+}
+
+func TestGithubValidatorExpire(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	for _, retention := range []string{"", "1h"} {
+		db := testDB(t)
+		db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(BucketComponents)
+			if err := (GithubValidator{}).Init(Hook{}, map[string]string{"secret": "s", "retention": retention}, b); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := seen(b, "deliveries", []byte("1"), now, replayRetention(b, 0)); err != nil {
+				t.Fatal(err)
+			}
+			n, err := (GithubValidator{}).Expire(Hook{}, b, now.Add(365*24*time.Hour))
+			if want := map[string]int{"": 0, "1h": 1}[retention]; n != want || err != nil {
+				t.Errorf("retention %q: Expire after a year = %d, %v, want %d, nil", retention, n, err, want)
+			}
+			return nil
+		})
+	}
+}
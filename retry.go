@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxRetryDelay is the upper bound of the delay between attempts if a retry
+// policy does not set one.
+const MaxRetryDelay = 24 * time.Hour
+
+// RetryPolicy determines if and when a component that failed to process a
+// request is tried again.
+type RetryPolicy struct {
+	MaxAttempts  int           // maximum number of attempts, 0 or 1 disables retries
+	InitialDelay time.Duration // delay before the first retry
+	Multiplier   float64       // factor the delay is multiplied with after every retry
+	MaxDelay     time.Duration // upper bound of the delay, 0 means MaxRetryDelay
+	Jitter       float64       // fraction of the delay that is randomized, between 0 and 1
+}
+
+// Enabled returns true if the policy allows a request to be retried.
+func (p RetryPolicy) Enabled() bool {
+	return p.MaxAttempts > 1
+}
+
+// Delay returns the time to wait before the next attempt, after the given
+// number of failed attempts.
+func (p RetryPolicy) Delay(attempts int) time.Duration {
+	mult := p.Multiplier
+	if mult < 1 {
+		mult = 1
+	}
+	limit := p.MaxDelay
+	if limit <= 0 {
+		limit = MaxRetryDelay
+	}
+	// compare as float, the delay overflows a time.Duration after enough attempts
+	d := math.Min(float64(p.InitialDelay)*math.Pow(mult, float64(attempts-1)), float64(limit))
+	if p.Jitter > 0 {
+		// spread the delay evenly in [d-jitter*d, d+jitter*d], without
+		// exceeding the limit
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+		d = math.Min(d, float64(limit))
+	}
+	return time.Duration(d)
+}
+
+// String returns a short description of the policy.
+func (p RetryPolicy) String() string {
+	if !p.Enabled() {
+		return "no retries"
+	}
+	return fmt.Sprintf("%d attempts, %s delay", p.MaxAttempts, p.InitialDelay)
+}
+
+// Validate returns an error if the policy contains invalid settings.
+func (p RetryPolicy) Validate() error {
+	switch {
+	case p.MaxAttempts < 0:
+		return errors.New("retry attempts cannot be negative")
+	case p.InitialDelay < 0 || p.MaxDelay < 0:
+		return errors.New("retry delay cannot be negative")
+	case p.Multiplier != 0 && p.Multiplier < 1:
+		return errors.New("retry multiplier must be at least 1")
+	case p.Jitter < 0 || p.Jitter > 1:
+		return errors.New("retry jitter must be between 0 and 1")
+	}
+	return nil
+}
+
+// parseRetryPolicy reads the retry policy from the retry-* form values in r.
+func parseRetryPolicy(r *http.Request) (p RetryPolicy, err error) {
+	value := func(k string) string { return strings.TrimSpace(r.FormValue("retry-" + k)) }
+
+	if v := value("attempts"); v != "" {
+		if p.MaxAttempts, err = strconv.Atoi(v); err != nil {
+			return p, fmt.Errorf("invalid retry attempts: %s", err)
+		}
+	}
+	if v := value("delay"); v != "" {
+		if p.InitialDelay, err = time.ParseDuration(v); err != nil {
+			return p, fmt.Errorf("invalid retry delay: %s", err)
+		}
+	}
+	if v := value("multiplier"); v != "" {
+		if p.Multiplier, err = strconv.ParseFloat(v, 64); err != nil {
+			return p, fmt.Errorf("invalid retry multiplier: %s", err)
+		}
+	}
+	if v := value("max-delay"); v != "" {
+		if p.MaxDelay, err = time.ParseDuration(v); err != nil {
+			return p, fmt.Errorf("invalid retry max delay: %s", err)
+		}
+	}
+	if v := value("jitter"); v != "" {
+		if p.Jitter, err = strconv.ParseFloat(v, 64); err != nil {
+			return p, fmt.Errorf("invalid retry jitter: %s", err)
+		}
+	}
+	return p, p.Validate()
+}
+
+// retryConfig is the JSON representation of a retry policy, durations are
+// formatted like "1m30s".
+type retryConfig struct {
+	Attempts   int     `json:"attempts"`
+	Delay      string  `json:"delay,omitempty"`
+	Multiplier float64 `json:"multiplier,omitempty"`
+	MaxDelay   string  `json:"max_delay,omitempty"`
+	Jitter     float64 `json:"jitter,omitempty"`
+}
+
+// newRetryConfig returns the JSON representation of retry policy p.
+func newRetryConfig(p RetryPolicy) *retryConfig {
+	r := &retryConfig{Attempts: p.MaxAttempts, Multiplier: p.Multiplier, Jitter: p.Jitter}
+	if p.InitialDelay > 0 {
+		r.Delay = p.InitialDelay.String()
+	}
+	if p.MaxDelay > 0 {
+		r.MaxDelay = p.MaxDelay.String()
+	}
+	return r
+}
+
+// policy returns the retry policy described by r.
+func (r retryConfig) policy() (p RetryPolicy, err error) {
+	p = RetryPolicy{MaxAttempts: r.Attempts, Multiplier: r.Multiplier, Jitter: r.Jitter}
+	if r.Delay != "" {
+		if p.InitialDelay, err = time.ParseDuration(r.Delay); err != nil {
+			return p, fmt.Errorf("invalid retry delay: %s", err)
+		}
+	}
+	if r.MaxDelay != "" {
+		if p.MaxDelay, err = time.ParseDuration(r.MaxDelay); err != nil {
+			return p, fmt.Errorf("invalid retry max delay: %s", err)
+		}
+	}
+	return p, p.Validate()
+}
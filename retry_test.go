@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	tests := []struct {
+		policy   RetryPolicy
+		attempts int
+		want     time.Duration
+	}{
+		{RetryPolicy{InitialDelay: time.Second}, 1, time.Second},
+		{RetryPolicy{InitialDelay: time.Second}, 5, time.Second},
+		{RetryPolicy{InitialDelay: time.Second, Multiplier: 0.5}, 3, time.Second},
+		{RetryPolicy{InitialDelay: time.Second, Multiplier: 2}, 1, time.Second},
+		{RetryPolicy{InitialDelay: time.Second, Multiplier: 2}, 4, 8 * time.Second},
+		{RetryPolicy{InitialDelay: time.Second, Multiplier: 2, MaxDelay: 5 * time.Second}, 4, 5 * time.Second},
+		{RetryPolicy{InitialDelay: time.Second, Multiplier: 2}, 20, MaxRetryDelay},
+		{RetryPolicy{InitialDelay: time.Hour, Multiplier: 10}, 1000, MaxRetryDelay},
+		{RetryPolicy{InitialDelay: time.Hour, Multiplier: 10, MaxDelay: 48 * time.Hour}, 1000, 48 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.Delay(tt.attempts); got != tt.want {
+			t.Errorf("%+v Delay(%d) = %s, want %s", tt.policy, tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicyDelayJitter(t *testing.T) {
+	p := RetryPolicy{InitialDelay: 10 * time.Second, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		if d := p.Delay(1); d < 5*time.Second || d > 15*time.Second {
+			t.Fatalf("Delay(1) = %s, want between 5s and 15s", d)
+		}
+	}
+
+	p = RetryPolicy{InitialDelay: time.Hour, Multiplier: 10, Jitter: 1}
+	for i := 0; i < 100; i++ {
+		if d := p.Delay(1000); d < 0 || d > MaxRetryDelay {
+			t.Fatalf("Delay(1000) = %s, want between 0 and %s", d, MaxRetryDelay)
+		}
+	}
+
+	// jitter never exceeds the maximum delay
+	p = RetryPolicy{InitialDelay: 4 * time.Second, Multiplier: 2, MaxDelay: 10 * time.Second, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		if d := p.Delay(2); d < 4*time.Second || d > 10*time.Second {
+			t.Fatalf("Delay(2) = %s, want between 4s and 10s", d)
+		}
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Request counts are stored per hour as "<id>-<hour>". Once they reach the
+// configured age, the janitor adds hourly counts to a daily count stored as
+// "<id>-<day>", and daily counts to a monthly count stored as "<id>-<month>".
+// Monthly counts are optionally removed after some time. The keys of a day or
+// month all start with the key of its count, so the count of a period is the
+// sum of the keys with that prefix, regardless of how far it was rolled up.
+const (
+	// StatsDayFormat is the time format of daily request counts.
+	StatsDayFormat = "2006-01-02"
+
+	// StatsMonthFormat is the time format of monthly request counts.
+	StatsMonthFormat = "2006-01"
+)
+
+// StatsRetention determines how long request counts are kept per period.
+type StatsRetention struct {
+	Hourly  time.Duration // age after which hourly counts are added to daily counts
+	Daily   time.Duration // age after which daily counts are added to monthly counts
+	Monthly time.Duration // age after which monthly counts are removed, 0 keeps them
+}
+
+// validate returns an error if r rolls up counts that are still shown in the
+// stats graphs: hourly counts for 48 hours, daily counts for 30 days and
+// monthly counts for 12 months.
+func (r StatsRetention) validate() error {
+	if r.Hourly < 48*time.Hour {
+		return errors.New("hourly request counts must be kept for at least 48h")
+	}
+	if r.Daily < 30*24*time.Hour {
+		return errors.New("daily request counts must be kept for at least 720h")
+	}
+	if r.Monthly != 0 && r.Monthly < 366*24*time.Hour {
+		return errors.New("monthly request counts must be kept for at least 8784h")
+	}
+	return nil
+}
+
+// statsPeriod is the period a request count covers.
+type statsPeriod int
+
+const (
+	statsHour statsPeriod = iota
+	statsDay
+	statsMonth
+)
+
+var statsFormats = []string{StatsTimeFormat, StatsDayFormat, StatsMonthFormat}
+
+// start returns the start of the period containing t.
+func (p statsPeriod) start(t time.Time) time.Time {
+	y, m, d := t.Date()
+	switch p {
+	case statsHour:
+		return time.Date(y, m, d, t.Hour(), 0, 0, 0, t.Location())
+	case statsDay:
+		return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	}
+	return time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+}
+
+// end returns the end of the period starting at t.
+func (p statsPeriod) end(t time.Time) time.Time {
+	switch p {
+	case statsHour:
+		return t.Add(time.Hour)
+	case statsDay:
+		return t.AddDate(0, 0, 1)
+	}
+	return t.AddDate(0, 1, 0)
+}
+
+// parseStatsKey splits the key of an hourly, daily or monthly request count
+// into the hook id, the period and its start. It returns false for other keys.
+func parseStatsKey(k string) (id string, p statsPeriod, t time.Time, ok bool) {
+	for p, format := range statsFormats {
+		i := len(k) - len(format) - 1
+		if i < 1 || k[i] != '-' {
+			continue
+		}
+		t, err := time.ParseInLocation(format, k[i+1:], time.Local)
+		if err == nil {
+			return k[:i], statsPeriod(p), t, true
+		}
+	}
+	return "", 0, time.Time{}, false
+}
+
+// sumStats returns the number of requests of the hook with the given id in
+// the period whose key ends in suffix, including the counts of shorter periods
+// within it that have not been rolled up yet.
+func sumStats(b *bolt.Bucket, id, suffix string) (total int, err error) {
+	prefix := []byte(id + "-" + suffix)
+	c := b.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if kid, _, _, ok := parseStatsKey(string(k)); v == nil || !ok || kid != id {
+			continue
+		}
+		var n int
+		if err := gobDecode(v, &n); err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// RollUp adds the hourly and daily request counts that are older than the
+// retention periods in r to the counts of the day or month they belong to,
+// and removes expired monthly counts. It returns the number of removed keys.
+func (s *HookStore) RollUp(now time.Time, r StatsRetention) (n int, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BucketStats)
+		ages := []time.Duration{r.Hourly, r.Daily, r.Monthly}
+
+		type rollUp struct {
+			key, to []byte // to is nil if the count expired
+			count   int
+		}
+		var rollUps []rollUp
+		err := b.ForEach(func(k, v []byte) error {
+			if v == nil {
+				return nil
+			}
+			id, p, t, ok := parseStatsKey(string(k))
+			if !ok {
+				return nil
+			}
+			from := p
+			for p <= statsMonth && ages[p] > 0 && now.Sub(p.end(t)) >= ages[p] {
+				if p++; p <= statsMonth {
+					t = p.start(t)
+				}
+			}
+			if p == from {
+				return nil
+			}
+
+			ru := rollUp{key: append([]byte(nil), k...)}
+			if p <= statsMonth {
+				ru.to = []byte(id + "-" + t.Format(statsFormats[p]))
+				if err := gobDecode(v, &ru.count); err != nil {
+					return err
+				}
+			}
+			rollUps = append(rollUps, ru)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, ru := range rollUps {
+			if ru.to != nil {
+				if err := add(ru.to, b, ru.count); err != nil {
+					return err
+				}
+			}
+			if err := b.Delete(ru.key); err != nil {
+				return err
+			}
+		}
+		n = len(rollUps)
+		return nil
+	})
+	return n, err
+}
+
+var (
+	// statsLatency is the bucket in BucketStats that contains a bucket per
+	// hook with its processing latency histogram.
+	statsLatency = []byte("latency")
+
+	// statsComponents is the bucket in BucketStats that contains the outcome
+	// counts and processing time of every component instance, stored as
+	// "<component id>-<outcome>" and "<component id>-duration".
+	statsComponents = []byte("components")
+)
+
+// LatencyBuckets are the upper bounds of the buckets of the processing latency
+// histograms. Slower requests are counted in an additional bucket.
+var LatencyBuckets = []time.Duration{
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// Latency is a histogram of the time the components of a hook spent
+// processing its requests, including failed attempts.
+type Latency struct {
+	Counts []int         // requests per bucket of LatencyBuckets, the last one counts slower requests
+	Sum    time.Duration // total processing time
+}
+
+// Total returns the number of requests in the histogram.
+func (l Latency) Total() (n int) {
+	for _, c := range l.Counts {
+		n += c
+	}
+	return n
+}
+
+// Average returns the average processing time of a request.
+func (l Latency) Average() time.Duration {
+	n := l.Total()
+	if n == 0 {
+		return 0
+	}
+	return roundDuration(l.Sum / time.Duration(n))
+}
+
+// latencyKey returns the key of bucket i of a latency histogram.
+func latencyKey(i int) []byte {
+	if i < len(LatencyBuckets) {
+		return []byte(LatencyBuckets[i].String())
+	}
+	return []byte("+Inf")
+}
+
+// latencyLabels returns the descriptions of the buckets of a latency
+// histogram.
+func latencyLabels() []string {
+	labels := make([]string, 0, len(LatencyBuckets)+1)
+	for _, d := range LatencyBuckets {
+		labels = append(labels, "≤ "+d.String())
+	}
+	return append(labels, "> "+LatencyBuckets[len(LatencyBuckets)-1].String())
+}
+
+// observeLatency adds processing time d to the latency histogram of the hook
+// with the given id.
+func observeLatency(tx *bolt.Tx, id string, d time.Duration) error {
+	b, err := tx.Bucket(BucketStats).CreateBucketIfNotExists(statsLatency)
+	if err != nil {
+		return err
+	}
+	if b, err = b.CreateBucketIfNotExists([]byte(id)); err != nil {
+		return err
+	}
+	i := sort.Search(len(LatencyBuckets), func(i int) bool { return d <= LatencyBuckets[i] })
+	if err := increment(latencyKey(i), b); err != nil {
+		return err
+	}
+	return add([]byte("sum"), b, int(d))
+}
+
+// latency returns the latency histogram of the hook with the given id.
+func latency(tx *bolt.Tx, id string) (l Latency, err error) {
+	l.Counts = make([]int, len(LatencyBuckets)+1)
+	b := tx.Bucket(BucketStats).Bucket(statsLatency)
+	if b == nil {
+		return l, nil
+	}
+	if b = b.Bucket([]byte(id)); b == nil {
+		return l, nil
+	}
+	for i := range l.Counts {
+		if err := gobDecode(b.Get(latencyKey(i)), &l.Counts[i]); err != nil {
+			return l, err
+		}
+	}
+	var sum int
+	err = gobDecode(b.Get([]byte("sum")), &sum)
+	l.Sum = time.Duration(sum)
+	return l, err
+}
+
+// ComponentCount contains the outcome counts of a component instance.
+type ComponentCount struct {
+	Passed   int           // requests passed on to the next component
+	Filtered int           // requests dropped by the component
+	Errored  int           // failed attempts to process a request
+	Duration time.Duration // total processing time
+}
+
+// Total returns the number of times the component processed a request.
+func (c ComponentCount) Total() int {
+	return c.Passed + c.Filtered + c.Errored
+}
+
+// Average returns the average time the component spent processing a request.
+func (c ComponentCount) Average() time.Duration {
+	if c.Total() == 0 {
+		return 0
+	}
+	return roundDuration(c.Duration / time.Duration(c.Total()))
+}
+
+// componentStatsKeys returns the keys of the counts of component instance id.
+func componentStatsKeys(id string) [][]byte {
+	var keys [][]byte
+	for _, s := range []string{string(OutcomePassed), string(OutcomeFiltered), string(OutcomeErrored), "duration"} {
+		keys = append(keys, []byte(id+"-"+s))
+	}
+	return keys
+}
+
+// incComponent counts the outcome and processing time of trace step ts, unless
+// its component instance was deleted in the meantime.
+func incComponent(tx *bolt.Tx, ts TraceStep) error {
+	if ts.Component.bucket(tx) == nil {
+		return nil
+	}
+	b, err := tx.Bucket(BucketStats).CreateBucketIfNotExists(statsComponents)
+	if err != nil {
+		return err
+	}
+	if err := increment([]byte(ts.Component.ID+"-"+string(ts.Outcome)), b); err != nil {
+		return err
+	}
+	return add([]byte(ts.Component.ID+"-duration"), b, int(ts.Duration))
+}
+
+// copyComponentStats replaces the counts of component instance to with those
+// of component instance from.
+func copyComponentStats(tx *bolt.Tx, from, to string) error {
+	b, err := tx.Bucket(BucketStats).CreateBucketIfNotExists(statsComponents)
+	if err != nil {
+		return err
+	}
+	fk, tk := componentStatsKeys(from), componentStatsKeys(to)
+	for i := range fk {
+		if err := copyKey(b, string(fk[i]), string(tk[i]), false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteComponentStats removes the counts of component instance id.
+func deleteComponentStats(tx *bolt.Tx, id string) error {
+	b := tx.Bucket(BucketStats).Bucket(statsComponents)
+	if b == nil {
+		return nil
+	}
+	for _, k := range componentStatsKeys(id) {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IncComponent counts the outcome and processing time of trace step ts.
+func (s *HookStore) IncComponent(ts TraceStep) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return incComponent(tx, ts)
+	})
+}
+
+// ComponentCounts returns the counts of the components of hook h by component
+// identifier.
+func (s *HookStore) ComponentCounts(h Hook) (map[string]ComponentCount, error) {
+	counts := make(map[string]ComponentCount)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for _, hc := range h.Components {
+			c, err := componentCount(tx, hc.ID)
+			if err != nil {
+				return err
+			}
+			counts[hc.ID] = c
+		}
+		return nil
+	})
+	return counts, err
+}
+
+// componentCount returns the counts of component instance id.
+func componentCount(tx *bolt.Tx, id string) (c ComponentCount, err error) {
+	b := tx.Bucket(BucketStats).Bucket(statsComponents)
+	if b == nil {
+		return c, nil
+	}
+	var d int
+	keys := componentStatsKeys(id)
+	for i, v := range []*int{&c.Passed, &c.Filtered, &c.Errored, &d} {
+		if err := gobDecode(b.Get(keys[i]), v); err != nil {
+			return c, err
+		}
+	}
+	c.Duration = time.Duration(d)
+	return c, nil
+}
+
+// roundDuration rounds d to a precision that is useful to display.
+func roundDuration(d time.Duration) time.Duration {
+	if d < time.Millisecond {
+		return d.Round(time.Microsecond)
+	}
+	return d.Round(time.Millisecond)
+}
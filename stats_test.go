@@ -0,0 +1,274 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestParseStatsKey(t *testing.T) {
+	date := func(y int, m time.Month, d, h int) time.Time { return time.Date(y, m, d, h, 0, 0, 0, time.Local) }
+	tests := []struct {
+		key string
+		id  string
+		p   statsPeriod
+		t   time.Time
+		ok  bool
+	}{
+		{"foo-2026-10-18-11", "foo", statsHour, date(2026, 10, 18, 11), true},
+		{"foo-2026-10-18", "foo", statsDay, date(2026, 10, 18, 0), true},
+		{"foo-2026-10", "foo", statsMonth, date(2026, 10, 1, 0), true},
+		{"foo-2026-2026-10", "foo-2026", statsMonth, date(2026, 10, 1, 0), true},
+		{"foo-2026-2026-10-18-00", "foo-2026", statsHour, date(2026, 10, 18, 0), true},
+		{"foo-bar-2026-01-31", "foo-bar", statsDay, date(2026, 1, 31, 0), true},
+		{"f-2026-10", "f", statsMonth, date(2026, 10, 1, 0), true},
+		{"foo-total", "", 0, time.Time{}, false},
+		{"foo-2026-13", "", 0, time.Time{}, false},
+		{"foo-2026-10-18-25", "", 0, time.Time{}, false},
+		{"2026-10", "", 0, time.Time{}, false},
+		{"-2026-10", "", 0, time.Time{}, false},
+		{"foo2026-10", "", 0, time.Time{}, false},
+		{"", "", 0, time.Time{}, false},
+	}
+	for _, tt := range tests {
+		id, p, ts, ok := parseStatsKey(tt.key)
+		if id != tt.id || p != tt.p || !ts.Equal(tt.t) || ok != tt.ok {
+			t.Errorf("parseStatsKey(%q) = %q, %d, %s, %t, want %q, %d, %s, %t", tt.key, id, p, ts, ok, tt.id, tt.p, tt.t, tt.ok)
+		}
+	}
+}
+
+func TestStatsPeriod(t *testing.T) {
+	ts := time.Date(2026, 12, 31, 23, 45, 10, 0, time.Local)
+	tests := []struct {
+		p          statsPeriod
+		start, end time.Time
+	}{
+		{statsHour, time.Date(2026, 12, 31, 23, 0, 0, 0, time.Local), time.Date(2027, 1, 1, 0, 0, 0, 0, time.Local)},
+		{statsDay, time.Date(2026, 12, 31, 0, 0, 0, 0, time.Local), time.Date(2027, 1, 1, 0, 0, 0, 0, time.Local)},
+		{statsMonth, time.Date(2026, 12, 1, 0, 0, 0, 0, time.Local), time.Date(2027, 1, 1, 0, 0, 0, 0, time.Local)},
+	}
+	for _, tt := range tests {
+		start := tt.p.start(ts)
+		if !start.Equal(tt.start) {
+			t.Errorf("period %d: start(%s) = %s, want %s", tt.p, ts, start, tt.start)
+		}
+		if end := tt.p.end(start); !end.Equal(tt.end) {
+			t.Errorf("period %d: end(%s) = %s, want %s", tt.p, start, end, tt.end)
+		}
+	}
+}
+
+func TestRollUp(t *testing.T) {
+	db := testDB(t)
+	s := &HookStore{db}
+	now := time.Date(2026, 10, 18, 12, 30, 0, 0, time.Local)
+	retention := StatsRetention{Hourly: 48 * time.Hour, Daily: 30 * 24 * time.Hour, Monthly: 366 * 24 * time.Hour}
+
+	counts := map[string]int{
+		"foo-2026-10-18-11":      1, // recent hour
+		"foo-2026-10-16-13":      2, // hour within the retention period
+		"foo-2026-10-15-23":      3, // hour rolled up into its day
+		"foo-2026-10-15-05":      4, // another hour of the same day
+		"foo-2026-10-15":         5, // day the hours are added to
+		"foo-2026-09-01-10":      6, // hour rolled up into its month
+		"foo-2026-08-10":         7, // day rolled up into its month
+		"foo-2025-11":            8, // month within the retention period
+		"foo-2024-05":            9, // expired month
+		"foo-total":              45,
+		"foo-2026-2026-10-15-05": 10, // hook "foo-2026"
+		"foo-2026-total":         10,
+		"other-key":              11,
+	}
+	want := map[string]int{
+		"foo-2026-10-18-11":   1,
+		"foo-2026-10-16-13":   2,
+		"foo-2026-10-15":      12,
+		"foo-2026-09":         6,
+		"foo-2026-08":         7,
+		"foo-2025-11":         8,
+		"foo-total":           45,
+		"foo-2026-2026-10-15": 10,
+		"foo-2026-total":      10,
+		"other-key":           11,
+	}
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		for k, n := range counts {
+			if err := add([]byte(k), tx.Bucket(BucketStats), n); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the count of a period includes the counts of shorter periods within it
+	periods := []string{"2026-10-16", "2026-10-15", "2026-10", "2026-09", "2026-08", "2025-11"}
+	sums := func() (sums []int) {
+		db.View(func(tx *bolt.Tx) error {
+			for _, p := range periods {
+				n, err := sumStats(tx.Bucket(BucketStats), "foo", p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sums = append(sums, n)
+			}
+			return nil
+		})
+		return sums
+	}
+	before := sums()
+
+	n, err := s.RollUp(now, retention)
+	if err != nil {
+		t.Fatalf("RollUp: %s", err)
+	}
+	if n != 6 {
+		t.Errorf("RollUp removed %d keys, want 6", n)
+	}
+
+	got := make(map[string]int)
+	db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BucketStats).ForEach(func(k, v []byte) error {
+			if v == nil {
+				return nil
+			}
+			var n int
+			if err := gobDecode(v, &n); err != nil {
+				return err
+			}
+			got[string(k)] = n
+			return nil
+		})
+	})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("counts after RollUp:\n got %v\nwant %v", got, want)
+	}
+
+	if after := sums(); !reflect.DeepEqual(after, before) {
+		t.Errorf("counts of %q changed by RollUp from %v to %v", periods, before, after)
+	}
+
+	if n, err := s.RollUp(now, retention); n != 0 || err != nil {
+		t.Errorf("second RollUp = %d, %v, want 0, nil", n, err)
+	}
+}
+
+func TestStatsKeys(t *testing.T) {
+	db := testDB(t)
+	keys := []string{
+		"foo-total",
+		"foo-2026-10-18-11",
+		"foo-2026-10-15",
+		"foo-2026-09",
+		"foo-2026-total",
+		"foo-2026-2026-10-18-11",
+		"foo-bar-2026-10",
+		"fo-2026-10",
+	}
+	want := map[string][]string{
+		"foo":      {"foo-2026-09", "foo-2026-10-15", "foo-2026-10-18-11", "foo-total"},
+		"foo-2026": {"foo-2026-2026-10-18-11", "foo-2026-total"},
+		"foo-bar":  {"foo-bar-2026-10"},
+		"fo":       {"fo-2026-10"},
+	}
+	db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BucketStats)
+		for _, k := range keys {
+			if err := add([]byte(k), b, 1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for id, want := range want {
+			var got []string
+			for _, k := range statsKeys(b, id) {
+				got = append(got, string(k))
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("statsKeys(%q) = %q, want %q", id, got, want)
+			}
+		}
+		return nil
+	})
+}
+
+func TestStatsRetentionValidate(t *testing.T) {
+	day := 24 * time.Hour
+	tests := []struct {
+		r     StatsRetention
+		valid bool
+	}{
+		{StatsRetention{48 * time.Hour, 30 * day, 0}, true},
+		{StatsRetention{48 * time.Hour, 30 * day, 366 * day}, true},
+		{StatsRetention{47 * time.Hour, 30 * day, 0}, false},
+		{StatsRetention{48 * time.Hour, 29 * day, 0}, false},
+		{StatsRetention{48 * time.Hour, 30 * day, 365 * day}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.r.validate(); (err == nil) != tt.valid {
+			t.Errorf("%+v validate() = %v, want valid %t", tt.r, err, tt.valid)
+		}
+	}
+}
+
+func TestOutcomeStats(t *testing.T) {
+	_, s, _ := testStores(t)
+	h, ids := testHook(t, s, "hook", "a", "b")
+	a, b := h.Components[0], h.Components[1]
+
+	deliveries := []struct {
+		status Status
+		trace  []TraceStep
+	}{
+		{StatusDone, []TraceStep{{Component: a, Outcome: OutcomePassed, Duration: 5 * time.Millisecond}, {Component: b, Outcome: OutcomePassed, Duration: 10 * time.Millisecond}}},
+		{StatusFiltered, []TraceStep{{Component: a, Outcome: OutcomeFiltered, Duration: 2 * time.Second}}},
+		{StatusFailed, []TraceStep{{Component: a, Outcome: OutcomePassed, Duration: time.Second}, {Component: b, Outcome: OutcomeErrored, Duration: 19 * time.Second}}},
+	}
+	for _, d := range deliveries {
+		for _, ts := range d.trace {
+			if err := s.IncComponent(ts); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.IncDelivery(&Delivery{Hook: h.ID, Trace: d.trace}, d.status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Inc(h.ID, StatusRejected); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := s.RequestCount(h.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Total != 4 || c.Succeeded != 1 || c.Filtered != 1 || c.Failed != 1 || c.Rejected != 1 {
+		t.Errorf("total, succeeded, filtered, failed, rejected = %d, %d, %d, %d, %d, want 4, 1, 1, 1, 1", c.Total, c.Succeeded, c.Filtered, c.Failed, c.Rejected)
+	}
+
+	// rejected requests are not processed, so they have no latency
+	want := Latency{Counts: make([]int, len(LatencyBuckets)+1), Sum: 15*time.Millisecond + 2*time.Second + 20*time.Second}
+	want.Counts[1], want.Counts[6], want.Counts[len(LatencyBuckets)] = 1, 1, 1
+	if !reflect.DeepEqual(c.Latency, want) {
+		t.Errorf("latency = %+v, want %+v", c.Latency, want)
+	}
+
+	counts, err := s.ComponentCounts(*h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantCounts := map[string]ComponentCount{
+		ids["a"]: {Passed: 2, Filtered: 1, Duration: 5*time.Millisecond + 3*time.Second},
+		ids["b"]: {Passed: 1, Errored: 1, Duration: 10*time.Millisecond + 19*time.Second},
+	}
+	if !reflect.DeepEqual(counts, wantCounts) {
+		t.Errorf("component counts = %+v, want %+v", counts, wantCounts)
+	}
+	if avg := counts[ids["a"]].Average(); avg != 1002*time.Millisecond {
+		t.Errorf("average of a = %s, want 1.002s", avg)
+	}
+}
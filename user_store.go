@@ -0,0 +1,611 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// SessionLifetime is the time after which a login session expires.
+	SessionLifetime = 7 * 24 * time.Hour
+
+	// MinPasswordLength is the minimum number of characters in a password.
+	MinPasswordLength = 8
+)
+
+// Role determines what a user is allowed to do in the admin interface.
+type Role string
+
+// Roles
+const (
+	RoleViewer Role = "viewer" // can see hooks, statistics and history
+	RoleEditor Role = "editor" // can also manage the components of assigned hooks
+	RoleAdmin  Role = "admin"  // can do everything, including managing users
+)
+
+// Roles contains all roles, from least to most privileged.
+var Roles = []Role{RoleViewer, RoleEditor, RoleAdmin}
+
+// valid returns true if r is a known role.
+func (r Role) valid() bool {
+	for _, role := range Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// UserStore is the database that stores admin users and their sessions.
+type UserStore struct {
+	db *DB
+}
+
+// User is an account that has access to the admin interface.
+type User struct {
+	Name     string    // unique user name
+	Password []byte    // bcrypt hash of the password
+	Created  time.Time // time the account was created
+	Role     Role      // access level of the user
+	Hooks    []string  // identifiers of the hooks an editor may manage
+}
+
+// IsAdmin returns true if u has the admin role.
+func (u *User) IsAdmin() bool {
+	return u != nil && u.Role == RoleAdmin
+}
+
+func (u *User) name() string {
+	if u == nil {
+		return ""
+	}
+	return u.Name
+}
+
+// CanEdit returns true if u may change the hook with the given id.
+func (u *User) CanEdit(hook string) bool {
+	if u == nil {
+		return false
+	}
+	switch u.Role {
+	case RoleAdmin:
+		return true
+	case RoleEditor:
+		for _, id := range u.Hooks {
+			if id == hook {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CanConfigure returns true if u may add or configure the component
+// registered as name on the hook with the given id.
+func (u *User) CanConfigure(hook, name string) bool {
+	return u.CanEdit(hook) && (u.IsAdmin() || !isPrivileged(name))
+}
+
+// CanReorder returns true if u may change the processing order of the
+// components of hook h. Moving any component changes the position of the
+// others, so u must be allowed to configure all of them.
+func (u *User) CanReorder(h *Hook) bool {
+	if !u.CanEdit(h.ID) {
+		return false
+	}
+	for _, hc := range h.Components {
+		if !u.CanConfigure(h.ID, hc.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// Session is a logged in user.
+type Session struct {
+	User    string    // name of the logged in user
+	Created time.Time // time of login
+	Expires time.Time // time the session expires
+	CSRF    string    // token required in all state-changing requests
+}
+
+// List returns a list of all users.
+func (s *UserStore) List() (users []User, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BucketUsers).ForEach(func(k, v []byte) error {
+			var u User
+			if err := gobDecode(v, &u); err != nil {
+				return err
+			}
+			users = append(users, u)
+			return nil
+		})
+	})
+	return users, err
+}
+
+// Count returns the number of users.
+func (s *UserStore) Count() (n int, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(BucketUsers).Stats().KeyN
+		return nil
+	})
+	return n, err
+}
+
+// Find returns the user with the given name if it exists.
+func (s *UserStore) Find(name string) (u *User, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(BucketUsers).Get([]byte(name))
+		if v == nil {
+			return errors.New("user does not exist")
+		}
+		u = &User{}
+		return gobDecode(v, u)
+	})
+	return u, err
+}
+
+// ErrSetupDone is returned by CreateFirst if a user already exists.
+var ErrSetupDone = errors.New("the first user has already been created")
+
+// Create creates user u with the given password.
+func (s *UserStore) Create(u User, password string) error {
+	return s.create(u, password, false)
+}
+
+// CreateFirst creates user u with the given password if no users exist yet,
+// and returns ErrSetupDone otherwise.
+func (s *UserStore) CreateFirst(u User, password string) error {
+	return s.create(u, password, true)
+}
+
+func (s *UserStore) create(u User, password string, first bool) error {
+	if match, _ := regexp.MatchString("^[a-zA-Z0-9._-]+$", u.Name); !match {
+		return errors.New("user name is required and may only contain letters, numbers, dots, dashes or underscores")
+	}
+	if !u.Role.valid() {
+		return errors.New("invalid role")
+	}
+
+	var err error
+	if u.Password, err = hashPassword(password); err != nil {
+		return err
+	}
+	u.Created = time.Now()
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BucketUsers)
+		if first && b.Stats().KeyN > 0 {
+			return ErrSetupDone
+		}
+		if b.Get([]byte(u.Name)) != nil {
+			return errors.New("a user with that name already exists")
+		}
+		return putUser(tx, u)
+	})
+}
+
+// SetPassword changes the password of the user with the given name and ends
+// all their sessions.
+func (s *UserStore) SetPassword(name, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var u User
+		v := tx.Bucket(BucketUsers).Get([]byte(name))
+		if v == nil {
+			return errors.New("user does not exist")
+		}
+		if err := gobDecode(v, &u); err != nil {
+			return err
+		}
+		u.Password = hash
+		if err := putUser(tx, u); err != nil {
+			return err
+		}
+		return deleteSessions(tx, func(s Session) bool { return s.User == name })
+	})
+}
+
+// SetRole changes the role of the user with the given name and the hooks they
+// may manage as an editor.
+func (s *UserStore) SetRole(name string, role Role, hooks []string) error {
+	if !role.valid() {
+		return errors.New("invalid role")
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		var u User
+		v := tx.Bucket(BucketUsers).Get([]byte(name))
+		if v == nil {
+			return errors.New("user does not exist")
+		}
+		if err := gobDecode(v, &u); err != nil {
+			return err
+		}
+		if u.Role == RoleAdmin && role != RoleAdmin {
+			if err := requireAdmin(tx, name); err != nil {
+				return err
+			}
+		}
+		u.Role, u.Hooks = role, hooks
+		if role != RoleEditor {
+			u.Hooks = nil
+		}
+		return putUser(tx, u)
+	})
+}
+
+// Delete deletes the user with the given name, ends all their sessions and
+// revokes their API tokens.
+func (s *UserStore) Delete(name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BucketUsers)
+		if b.Get([]byte(name)) == nil {
+			return errors.New("user does not exist")
+		}
+		if err := requireAdmin(tx, name); err != nil {
+			return err
+		}
+		if err := b.Delete([]byte(name)); err != nil {
+			return err
+		}
+		if err := deleteTokens(tx, func(t APIToken) bool { return t.User == name }); err != nil {
+			return err
+		}
+		return deleteSessions(tx, func(s Session) bool { return s.User == name })
+	})
+}
+
+// Authenticate returns the user with the given name if password matches.
+func (s *UserStore) Authenticate(name, password string) (*User, error) {
+	u, err := s.Find(name)
+	if err != nil {
+		// spend the same amount of time as for existing users
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, errors.New("invalid user name or password")
+	}
+	if err := bcrypt.CompareHashAndPassword(u.Password, []byte(password)); err != nil {
+		return nil, errors.New("invalid user name or password")
+	}
+	return u, nil
+}
+
+// CreateSession starts a new session for the user with the given name. It
+// returns the secret token identifying the session.
+func (s *UserStore) CreateSession(name string) (token string, err error) {
+	if token, err = randomToken(); err != nil {
+		return "", err
+	}
+	csrf, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	session := Session{User: name, Created: now, Expires: now.Add(SessionLifetime), CSRF: csrf}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		v, err := gobEncode(session)
+		if err != nil {
+			return err
+		}
+
+		// remove expired sessions while we're here
+		if err := deleteSessions(tx, func(s Session) bool { return now.After(s.Expires) }); err != nil {
+			return err
+		}
+		return tx.Bucket(BucketSessions).Put(sessionKey(token), v)
+	})
+	return token, err
+}
+
+// Session returns the session and user identified by token if it exists and
+// has not expired.
+func (s *UserStore) Session(token string) (session *Session, u *User, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(BucketSessions).Get(sessionKey(token))
+		if v == nil {
+			return errors.New("session does not exist")
+		}
+		session = &Session{}
+		if err := gobDecode(v, session); err != nil {
+			return err
+		}
+		if time.Now().After(session.Expires) {
+			return errors.New("session expired")
+		}
+		if session.CSRF == "" {
+			// created before CSRF tokens were introduced
+			return errors.New("session invalid")
+		}
+
+		v = tx.Bucket(BucketUsers).Get([]byte(session.User))
+		if v == nil {
+			return errors.New("user does not exist")
+		}
+		u = &User{}
+		return gobDecode(v, u)
+	})
+	return session, u, err
+}
+
+// DeleteSession ends the session identified by token.
+func (s *UserStore) DeleteSession(token string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(BucketSessions).Delete(sessionKey(token))
+	})
+}
+
+// APIToken gives scripts access to the API on behalf of a user.
+type APIToken struct {
+	ID       uint64    // identifier of the token
+	Name     string    // description of what the token is used for
+	User     string    // name of the user the token belongs to
+	Created  time.Time // time the token was created
+	LastUsed time.Time // time the token was last used
+}
+
+// CreateToken creates a new API token called name for the user with the given
+// name. The secret token is only returned here, the database only contains its
+// hash.
+func (s *UserStore) CreateToken(user, name string) (secret string, err error) {
+	if strings.TrimSpace(name) == "" {
+		return "", errors.New("token name is required")
+	}
+	if secret, err = randomToken(); err != nil {
+		return "", err
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(BucketUsers).Get([]byte(user)) == nil {
+			return errors.New("user does not exist")
+		}
+
+		b := tx.Bucket(BucketTokens)
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		v, err := gobEncode(APIToken{ID: id, Name: name, User: user, Created: time.Now()})
+		if err != nil {
+			return err
+		}
+		return b.Put(sessionKey(secret), v)
+	})
+	return secret, err
+}
+
+// Tokens returns the API tokens of the user with the given name.
+func (s *UserStore) Tokens(user string) (tokens []APIToken, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BucketTokens).ForEach(func(k, v []byte) error {
+			var t APIToken
+			if err := gobDecode(v, &t); err != nil {
+				return err
+			}
+			if t.User == user {
+				tokens = append(tokens, t)
+			}
+			return nil
+		})
+	})
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID < tokens[j].ID })
+	return tokens, err
+}
+
+// DeleteToken deletes the API token with the given id of the user with the
+// given name.
+func (s *UserStore) DeleteToken(user string, id uint64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		found := false
+		err := deleteTokens(tx, func(t APIToken) bool {
+			if t.User != user || t.ID != id {
+				return false
+			}
+			found = true
+			return true
+		})
+		if err == nil && !found {
+			err = errors.New("token does not exist")
+		}
+		return err
+	})
+}
+
+// TokenUser returns the user the API token secret belongs to.
+func (s *UserStore) TokenUser(secret string) (u *User, err error) {
+	var t APIToken
+	err = s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(BucketTokens).Get(sessionKey(secret))
+		if v == nil {
+			return errors.New("token does not exist")
+		}
+		if err := gobDecode(v, &t); err != nil {
+			return err
+		}
+
+		v = tx.Bucket(BucketUsers).Get([]byte(t.User))
+		if v == nil {
+			return errors.New("user does not exist")
+		}
+		u = &User{}
+		return gobDecode(v, u)
+	})
+
+	// only record the last use once a minute to avoid a write per request
+	if err != nil || time.Since(t.LastUsed) < time.Minute {
+		return u, err
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BucketTokens)
+		v := b.Get(sessionKey(secret))
+		if v == nil {
+			// revoked in the meantime
+			return nil
+		}
+		if err := gobDecode(v, &t); err != nil {
+			return err
+		}
+		t.LastUsed = time.Now()
+		if v, err = gobEncode(t); err != nil {
+			return err
+		}
+		return b.Put(sessionKey(secret), v)
+	})
+	return u, err
+}
+
+// deleteTokens deletes all API tokens for which fn returns true.
+func deleteTokens(tx *bolt.Tx, fn func(t APIToken) bool) error {
+	b := tx.Bucket(BucketTokens)
+	keys, err := bucketKeys(b, func(k, v []byte) (bool, error) {
+		var t APIToken
+		if err := gobDecode(v, &t); err != nil {
+			return false, err
+		}
+		return fn(t), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteSessions deletes all sessions for which fn returns true.
+func deleteSessions(tx *bolt.Tx, fn func(s Session) bool) error {
+	b := tx.Bucket(BucketSessions)
+	keys, err := bucketKeys(b, func(k, v []byte) (bool, error) {
+		var s Session
+		if err := gobDecode(v, &s); err != nil {
+			return false, err
+		}
+		return fn(s), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requireAdmin returns an error if no admin other than the user with the given
+// name exists.
+func requireAdmin(tx *bolt.Tx, name string) error {
+	found := false
+	err := tx.Bucket(BucketUsers).ForEach(func(k, v []byte) error {
+		var u User
+		if err := gobDecode(v, &u); err != nil {
+			return err
+		}
+		if u.Name != name && u.Role == RoleAdmin {
+			found = true
+		}
+		return nil
+	})
+	if err == nil && !found {
+		err = errors.New("at least one admin is required")
+	}
+	return err
+}
+
+// reassignHook replaces the hook with the given id by newID in the hooks that
+// editors may manage, or removes it if newID is empty. This keeps a later hook
+// that reuses id from being managed by the editors of the old one.
+func reassignHook(tx *bolt.Tx, id, newID string) error {
+	var changed []User
+	err := tx.Bucket(BucketUsers).ForEach(func(k, v []byte) error {
+		var u User
+		if err := gobDecode(v, &u); err != nil {
+			return err
+		}
+		var hooks []string
+		found := false
+		for _, h := range u.Hooks {
+			switch h {
+			case id:
+				found = true
+			case newID:
+			default:
+				hooks = append(hooks, h)
+			}
+		}
+		if !found {
+			return nil
+		}
+		if newID != "" {
+			hooks = append(hooks, newID)
+		}
+		u.Hooks = hooks
+		changed = append(changed, u)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, u := range changed {
+		if err := putUser(tx, u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func putUser(tx *bolt.Tx, u User) error {
+	v, err := gobEncode(u)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(BucketUsers).Put([]byte(u.Name), v)
+}
+
+// randomToken returns a random hex encoded 256-bit token.
+func randomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// sessionKey returns the database key of a session token. Only a hash of the
+// token is stored, so a copy of the database cannot be used to log in.
+func sessionKey(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+func hashPassword(password string) ([]byte, error) {
+	if len(password) < MinPasswordLength {
+		return nil, errors.New("password must be at least 8 characters")
+	}
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+// dummyHash is compared against when a user does not exist.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("rehook"), bcrypt.DefaultCost)
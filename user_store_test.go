@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestCreateFirst(t *testing.T) {
+	s := &UserStore{testDB(t)}
+
+	// only one of several concurrent setups may succeed
+	errs := make([]error, 5)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = s.CreateFirst(User{Name: fmt.Sprintf("admin%d", i), Role: RoleAdmin}, "password")
+		}(i)
+	}
+	wg.Wait()
+
+	var created int
+	for _, err := range errs {
+		switch err {
+		case nil:
+			created++
+		case ErrSetupDone:
+		default:
+			t.Errorf("CreateFirst returned unexpected error: %s", err)
+		}
+	}
+	if created != 1 {
+		t.Errorf("CreateFirst succeeded %d times, want 1", created)
+	}
+	if n, _ := s.Count(); n != 1 {
+		t.Errorf("Count() = %d, want 1", n)
+	}
+
+	if err := s.Create(User{Name: "editor", Role: RoleEditor}, "password"); err != nil {
+		t.Errorf("Create after setup: %s", err)
+	}
+}
+
+func TestSetPasswordEndsSessions(t *testing.T) {
+	s := &UserStore{testDB(t)}
+	for _, name := range []string{"alice", "bob"} {
+		if err := s.Create(User{Name: name, Role: RoleAdmin}, "password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice, err := s.CreateSession("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := s.CreateSession("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.SetPassword("alice", "new password"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Session(alice); err == nil {
+		t.Error("session of alice still valid after changing the password")
+	}
+	if _, _, err := s.Session(bob); err != nil {
+		t.Errorf("session of bob ended after changing the password of alice: %s", err)
+	}
+
+	if _, err := s.Authenticate("alice", "password"); err == nil {
+		t.Error("old password still accepted")
+	}
+	if _, err := s.Authenticate("alice", "new password"); err != nil {
+		t.Errorf("new password not accepted: %s", err)
+	}
+}
+
+func TestTokenUser(t *testing.T) {
+	db := testDB(t)
+	s := &UserStore{db}
+	if err := s.Create(User{Name: "admin", Role: RoleAdmin}, "password"); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := s.CreateToken("admin", "ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastUsed := func() time.Time {
+		tokens, err := s.Tokens("admin")
+		if err != nil || len(tokens) != 1 {
+			t.Fatalf("Tokens = %+v, %v, want one token", tokens, err)
+		}
+		return tokens[0].LastUsed
+	}
+
+	if _, err := s.TokenUser("invalid"); err == nil {
+		t.Error("TokenUser accepted an invalid token")
+	}
+	if !lastUsed().IsZero() {
+		t.Error("LastUsed set before the token was used")
+	}
+
+	u, err := s.TokenUser(secret)
+	if err != nil || u.Name != "admin" {
+		t.Fatalf("TokenUser = %+v, %v, want admin", u, err)
+	}
+	first := lastUsed()
+	if first.IsZero() {
+		t.Fatal("LastUsed not set after the first use")
+	}
+
+	// uses within a minute are not recorded
+	if _, err := s.TokenUser(secret); err != nil {
+		t.Fatal(err)
+	}
+	if got := lastUsed(); !got.Equal(first) {
+		t.Errorf("LastUsed changed from %s to %s within a minute", first, got)
+	}
+
+	// pretend the last use was a while ago
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BucketTokens)
+		var token APIToken
+		if err := gobDecode(b.Get(sessionKey(secret)), &token); err != nil {
+			return err
+		}
+		token.LastUsed = first.Add(-2 * time.Minute)
+		v, err := gobEncode(token)
+		if err != nil {
+			return err
+		}
+		return b.Put(sessionKey(secret), v)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.TokenUser(secret); err != nil {
+		t.Fatal(err)
+	}
+	if got := lastUsed(); got.Before(first) {
+		t.Errorf("LastUsed = %s after a use more than a minute later, want at least %s", got, first)
+	}
+
+	tokens, _ := s.Tokens("admin")
+	if err := s.DeleteToken("admin", tokens[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.TokenUser(secret); err == nil {
+		t.Error("TokenUser accepted a revoked token")
+	}
+}
+
+func TestCanReorder(t *testing.T) {
+	plain := &Hook{ID: "hook", Components: []HookComponent{{Name: "log-action"}, {Name: "forward-request-action"}}}
+	privileged := &Hook{ID: "hook", Components: []HookComponent{{Name: "log-action"}, {Name: "execute-action"}}}
+	tests := []struct {
+		user *User
+		hook *Hook
+		want bool
+	}{
+		{&User{Role: RoleAdmin}, plain, true},
+		{&User{Role: RoleAdmin}, privileged, true},
+		{&User{Role: RoleEditor, Hooks: []string{"hook"}}, plain, true},
+		{&User{Role: RoleEditor, Hooks: []string{"hook"}}, privileged, false},
+		{&User{Role: RoleEditor, Hooks: []string{"other"}}, plain, false},
+		{&User{Role: RoleViewer}, plain, false},
+		{nil, plain, false},
+	}
+	for _, tt := range tests {
+		if got := tt.user.CanReorder(tt.hook); got != tt.want {
+			t.Errorf("%+v CanReorder(%v) = %t, want %t", tt.user, tt.hook.Components, got, tt.want)
+		}
+	}
+}
+
+func TestCanConfigure(t *testing.T) {
+	tests := []struct {
+		user      *User
+		component string
+		want      bool
+	}{
+		{&User{Role: RoleAdmin}, "forward-request-action", true},
+		{&User{Role: RoleAdmin}, "execute-action", true},
+		{&User{Role: RoleEditor, Hooks: []string{"hook"}}, "forward-request-action", true},
+		{&User{Role: RoleEditor, Hooks: []string{"hook"}}, "execute-action", false},
+		{&User{Role: RoleEditor, Hooks: []string{"hook"}}, "write-file-action", false},
+		{&User{Role: RoleEditor, Hooks: []string{"other"}}, "forward-request-action", false},
+		{&User{Role: RoleViewer, Hooks: []string{"hook"}}, "forward-request-action", false},
+		{nil, "forward-request-action", false},
+	}
+	for _, tt := range tests {
+		if got := tt.user.CanConfigure("hook", tt.component); got != tt.want {
+			t.Errorf("%+v CanConfigure(hook, %s) = %t, want %t", tt.user, tt.component, got, tt.want)
+		}
+	}
+}
+
+func TestSetRole(t *testing.T) {
+	s := &UserStore{testDB(t)}
+	for _, u := range []User{{Name: "admin", Role: RoleAdmin}, {Name: "user", Role: RoleViewer}} {
+		if err := s.Create(u, "password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.SetRole("user", "owner", nil); err == nil {
+		t.Error("SetRole accepted an invalid role")
+	}
+	if err := s.SetRole("admin", RoleEditor, nil); err == nil {
+		t.Error("SetRole demoted the last admin")
+	}
+
+	if err := s.SetRole("user", RoleEditor, []string{"hook"}); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := s.Find("user"); u.Role != RoleEditor || len(u.Hooks) != 1 || u.Hooks[0] != "hook" {
+		t.Errorf("user after SetRole = %+v, want editor of hook", u)
+	}
+
+	// only editors are assigned hooks
+	if err := s.SetRole("user", RoleAdmin, []string{"hook"}); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := s.Find("user"); u.Role != RoleAdmin || u.Hooks != nil {
+		t.Errorf("user after SetRole = %+v, want admin without hooks", u)
+	}
+	if err := s.SetRole("admin", RoleViewer, nil); err != nil {
+		t.Errorf("SetRole of an admin while another one exists: %s", err)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"encoding/hex"
 	"fmt"
 	"os"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -24,8 +26,15 @@ func (WriteFileAction) Name() string { return "Write to file" }
 // Template returns the HTML template name of this component.
 func (WriteFileAction) Template() string { return "" }
 
-// Params returns the currently stored configuration parameters for hook h
-// from bucket b.
+// Privileged returns true, writing files requires admin access.
+func (WriteFileAction) Privileged() bool { return true }
+
+// Parameters returns the names of the configuration parameters.
+func (WriteFileAction) Parameters() []string {
+	return nil
+}
+
+// Params returns the currently stored configuration parameters from bucket b.
 func (WriteFileAction) Params(h Hook, b *bolt.Bucket) map[string]string {
 	return nil
 }
@@ -35,8 +44,8 @@ func (WriteFileAction) Init(h Hook, params map[string]string, b *bolt.Bucket) er
 	return nil
 }
 
-// Process writes a new file to the logs directory containing the headers and
-// body of request r.
+// Process writes a new file to the logs directory containing the details,
+// headers and body of request r.
 func (WriteFileAction) Process(h Hook, r Request, b *bolt.Bucket) error {
 	buf := make([]byte, 8)
 	if _, err := rand.Read(buf); err != nil {
@@ -57,11 +66,30 @@ func (WriteFileAction) Process(h Hook, r Request, b *bolt.Bucket) error {
 	defer f.Close()
 
 	fmt.Fprintf(f, "Hook %q received at %s\n", h.ID, time.Now())
-	fmt.Fprintf(f, "%s /h/%s\n\n", r.Method, h.ID)
-	fmt.Fprintf(f, "Headers:\n")
-	for k, v := range r.Headers {
-		fmt.Fprintf(f, "%s = %s\n", k, v)
+	fmt.Fprintf(f, "%s /h/%s%s\n\n", r.Method, h.ID, r.URI())
+	fmt.Fprintf(f, "Remote address: %s\n", r.RemoteAddr)
+	if len(r.ForwardedFor) > 0 {
+		fmt.Fprintf(f, "Forwarded for: %s\n", strings.Join(r.ForwardedFor, ", "))
+	}
+	if r.Host != "" {
+		fmt.Fprintf(f, "Host: %s\n", r.Host)
+	}
+	if r.TLS != nil {
+		fmt.Fprintf(f, "TLS: %s %s (server name %q)\n", r.TLS.Version, r.TLS.CipherSuite, r.TLS.ServerName)
+	}
+
+	fmt.Fprintf(f, "\nHeaders:\n")
+	header := r.AllHeaders()
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range header[k] {
+			fmt.Fprintf(f, "%s = %s\n", k, v)
+		}
 	}
-	fmt.Fprintf(f, "\nBody:\n%s", r.Body)
+	_, err = fmt.Fprintf(f, "\nBody:\n%s", r.Body)
 	return err
 }